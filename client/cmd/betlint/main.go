@@ -0,0 +1,217 @@
+// Command betlint checks an agency dataset without a server. It validates
+// every record as the client does before batching and reports the invalid
+// rows by reason, the duplicate documents, the distribution of the bet
+// numbers and the amount of batches the upload would take.
+//
+//	betlint -dataset .data/dataset.zip -agency 1 -format json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// bucketSize Width of the ranges of bet numbers in the distribution
+const bucketSize = 1000
+
+// Options Settings of a dataset check
+type Options struct {
+	Agency         int
+	Codec          common.BetCodec
+	BatchMaxAmount int
+	Signed         bool
+	Now            time.Time
+}
+
+// Bucket Amount of bets whose number falls in [From, To]
+type Bucket struct {
+	From  int `json:"from"`
+	To    int `json:"to"`
+	Count int `json:"count"`
+}
+
+// Report Result of checking a dataset
+type Report struct {
+	Dataset         string         `json:"dataset"`
+	Entry           string         `json:"entry,omitempty"`
+	Rows            int            `json:"rows"`
+	ValidRows       int            `json:"valid_rows"`
+	InvalidRows     int            `json:"invalid_rows"`
+	InvalidByReason map[string]int `json:"invalid_by_reason"`
+	// DuplicateDocuments Documents found in more than one valid row, and
+	// DuplicateRows the rows beyond the first one of each of them
+	DuplicateDocuments int      `json:"duplicate_documents"`
+	DuplicateRows      int      `json:"duplicate_rows"`
+	Numbers            []Bucket `json:"numbers"`
+	Codec              string   `json:"codec"`
+	BatchMaxAmount     int      `json:"batch_max_amount"`
+	EstimatedBatches   int      `json:"estimated_batches"`
+}
+
+// Clean Checks if the dataset has neither invalid nor duplicate rows
+func (r *Report) Clean() bool {
+	return r.InvalidRows == 0 && r.DuplicateRows == 0
+}
+
+// lint Checks every record of the dataset
+func lint(dataset *common.Dataset, options Options) (*Report, error) {
+	report := &Report{
+		InvalidByReason: map[string]int{},
+		Codec:           options.Codec.Name(),
+		BatchMaxAmount:  options.BatchMaxAmount,
+	}
+	for from := common.MinNumber; from <= common.MaxNumber; from += bucketSize {
+		to := from + bucketSize - 1
+		if to > common.MaxNumber {
+			to = common.MaxNumber
+		}
+		report.Numbers = append(report.Numbers, Bucket{From: from, To: to})
+	}
+
+	validator := common.NewValidator(options.Agency, options.Now)
+	batcher := common.NewBatcher(options.Codec, options.BatchMaxAmount,
+		common.MaxBatchPayload(options.Signed, strconv.Itoa(options.Agency)))
+	documents := map[int]int{}
+	for {
+		record, err := dataset.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read dataset line %v: %v", dataset.Line()+1, err)
+		}
+		report.Rows++
+
+		bet, reasons := validator.ParseRecord(record)
+		if len(reasons) > 0 {
+			report.InvalidRows++
+			for _, reason := range reasons {
+				report.InvalidByReason[reason]++
+			}
+			continue
+		}
+		report.ValidRows++
+
+		documents[bet.Document]++
+		switch documents[bet.Document] {
+		case 1:
+		case 2:
+			report.DuplicateDocuments++
+			report.DuplicateRows++
+		default:
+			report.DuplicateRows++
+		}
+		report.Numbers[(bet.Number-common.MinNumber)/bucketSize].Count++
+
+		batch, err := batcher.Add(bet)
+		if err != nil {
+			return nil, fmt.Errorf("could not encode bet at dataset line %v: %v", dataset.Line(), err)
+		}
+		if batch != nil {
+			report.EstimatedBatches++
+		}
+	}
+	if batcher.Flush() != nil {
+		report.EstimatedBatches++
+	}
+	return report, nil
+}
+
+// writeText Writes the report in a human readable format
+func writeText(w io.Writer, report *Report) {
+	name := report.Dataset
+	if report.Entry != "" {
+		name = fmt.Sprintf("%v (%v)", report.Dataset, report.Entry)
+	}
+	fmt.Fprintf(w, "dataset: %v\n", name)
+	fmt.Fprintf(w, "rows: %v\n", report.Rows)
+	fmt.Fprintf(w, "valid rows: %v\n", report.ValidRows)
+	fmt.Fprintf(w, "invalid rows: %v\n", report.InvalidRows)
+
+	reasons := make([]string, 0, len(report.InvalidByReason))
+	for reason := range report.InvalidByReason {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "  %v: %v\n", reason, report.InvalidByReason[reason])
+	}
+
+	fmt.Fprintf(w, "duplicate documents: %v (%v extra rows)\n", report.DuplicateDocuments, report.DuplicateRows)
+	fmt.Fprintf(w, "bet numbers:\n")
+	for _, bucket := range report.Numbers {
+		fmt.Fprintf(w, "  %04d-%04d: %v\n", bucket.From, bucket.To, bucket.Count)
+	}
+	fmt.Fprintf(w, "estimated batches: %v (codec: %v, batch max amount: %v)\n",
+		report.EstimatedBatches,
+		report.Codec,
+		report.BatchMaxAmount,
+	)
+}
+
+func main() {
+	path := flag.String("dataset", "", "path of the agency CSV file, or of a zip archive holding it")
+	entry := flag.String("entry", "", "CSV file inside the zip archive (default: the file of the agency)")
+	agency := flag.Int("agency", 1, "agency the dataset belongs to")
+	codecName := flag.String("codec", common.CodecText, "bet codec used to estimate the batches")
+	batchMaxAmount := flag.Int("batch-max-amount", 100, "maximum amount of bets per batch")
+	signed := flag.Bool("signed", false, "estimate batches for frames signed with HMAC")
+	format := flag.String("format", "text", "output format: text or json")
+	strict := flag.Bool("strict", false, "exit with status 1 if there are invalid or duplicate rows")
+	flag.Parse()
+
+	codec, err := common.NewBetCodec(*codecName)
+	if err != nil || *path == "" || (*format != "text" && *format != "json") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *entry == "" {
+		*entry = common.DatasetEntry(strconv.Itoa(*agency))
+	}
+
+	dataset, err := common.OpenDataset(*path, *entry)
+	if err != nil {
+		log.Fatalf("action: betlint | result: fail | error: %v", err)
+	}
+	defer dataset.Close()
+
+	report, err := lint(dataset, Options{
+		Agency:         *agency,
+		Codec:          codec,
+		BatchMaxAmount: *batchMaxAmount,
+		Signed:         *signed,
+		Now:            time.Now(),
+	})
+	if err != nil {
+		log.Fatalf("action: betlint | result: fail | error: %v", err)
+	}
+	report.Dataset = *path
+	if strings.HasSuffix(*path, ".zip") {
+		report.Entry = *entry
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			log.Fatalf("action: betlint | result: fail | error: %v", err)
+		}
+	} else {
+		writeText(os.Stdout, report)
+	}
+
+	if *strict && !report.Clean() {
+		os.Exit(1)
+	}
+}
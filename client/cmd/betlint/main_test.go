@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+func TestLintReportsInvalidAndDuplicateRows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agency-1.csv")
+	rows := "Santiago Lionel,Lorca,30904465,1999-03-17,7574\n" +
+		"Santiago Lionel,Lorca,30904465,1999-03-17,15\n" +
+		",Lopez,36789210,1985-11-02,2201\n" +
+		"Ana,Di Lorenzo,24543210,1970-01-30,15000\n" +
+		"Maria,Rivera,24543211,1971-02-01,1500\n" +
+		"\"Lorca, Ana\",Lorca,24543212,1971-02-01,16\n" +
+		strings.Repeat("a", common.MaxNameSize+1) + ",Lorca,24543213,1971-02-01,17\n"
+	if err := os.WriteFile(path, []byte(rows), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dataset, err := common.OpenDataset(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dataset.Close()
+
+	report, err := lint(dataset, Options{
+		Agency:         1,
+		Codec:          common.TextCodec{},
+		BatchMaxAmount: 2,
+		Now:            time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rows != 7 || report.ValidRows != 3 || report.InvalidRows != 4 {
+		t.Fatalf("unexpected row counts: %+v", report)
+	}
+	if report.InvalidByReason[common.ReasonEmptyName] != 1 || report.InvalidByReason[common.ReasonNumber] != 1 ||
+		report.InvalidByReason[common.ReasonName] != 2 {
+		t.Fatalf("unexpected reasons: %v", report.InvalidByReason)
+	}
+	if report.DuplicateDocuments != 1 || report.DuplicateRows != 1 {
+		t.Fatalf("expected one duplicate document, got %v (%v rows)", report.DuplicateDocuments, report.DuplicateRows)
+	}
+	if report.Numbers[0].Count != 1 || report.Numbers[1].Count != 1 || report.Numbers[7].Count != 1 {
+		t.Fatalf("unexpected number distribution: %v", report.Numbers)
+	}
+	if report.EstimatedBatches != 2 || report.Clean() {
+		t.Fatalf("expected 2 batches and a dirty report, got %v", report.EstimatedBatches)
+	}
+}
@@ -0,0 +1,156 @@
+// Command certgen mints a development CA together with a server certificate
+// and one client certificate per agency, to be used with mutual TLS in local
+// docker compose setups. The generated keys are NOT meant for production.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// issuer Certificate and key used to sign the generated certificates
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newSerialNumber Returns a random 128 bits certificate serial number
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// createCertificate Generates a new key pair and signs the template with
+// the issuer key. If issuer is nil, the certificate is self-signed
+func createCertificate(template *x509.Certificate, parent *issuer) (*issuer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &issuer{cert: cert, key: key}, nil
+}
+
+// writePair Writes the certificate and its private key as <name>.pem and
+// <name>-key.pem inside dir
+func writePair(dir string, name string, pair *issuer) error {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pair.cert.Raw})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0644); err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(pair.key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600)
+}
+
+func run(outDir string, agencies int, serverName string, validFor time.Duration) error {
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := notBefore.Add(validFor)
+
+	ca, err := createCertificate(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "tp0-dev-ca"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if err := writePair(outDir, "ca", ca); err != nil {
+		return err
+	}
+	log.Infof("action: create_ca | result: success | dir: %v", outDir)
+
+	server, err := createCertificate(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: serverName},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    []string{serverName, "localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}, ca)
+	if err != nil {
+		return err
+	}
+	if err := writePair(outDir, "server", server); err != nil {
+		return err
+	}
+	log.Infof("action: create_server_cert | result: success | server_name: %v | pin: %v", serverName, common.SPKIPin(server.cert))
+
+	for id := 1; id <= agencies; id++ {
+		name := common.AgencyCommonName(strconv.Itoa(id))
+		agency, err := createCertificate(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: name},
+			NotBefore:   notBefore,
+			NotAfter:    notAfter,
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca)
+		if err != nil {
+			return err
+		}
+		if err := writePair(outDir, name, agency); err != nil {
+			return err
+		}
+		log.Infof("action: create_agency_cert | result: success | client_id: %v", id)
+	}
+	return nil
+}
+
+func main() {
+	outDir := flag.String("out", "./certs", "directory where certificates and keys are written")
+	agencies := flag.Int("agencies", 5, "number of agency client certificates to generate")
+	serverName := flag.String("server-name", "server", "DNS name of the central server")
+	validFor := flag.Duration("valid-for", 365*24*time.Hour, "validity period of the certificates")
+	flag.Parse()
+
+	if *agencies < 0 {
+		fmt.Fprintln(os.Stderr, "agencies must not be negative")
+		os.Exit(2)
+	}
+
+	if err := run(*outDir, *agencies, *serverName, *validFor); err != nil {
+		log.Fatalf("action: certgen | result: fail | error: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package common
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultBusyMaxWait Time the client waits on a busy server by default
+const DefaultBusyMaxWait = 30 * time.Second
+
+// minRetryAfter Shortest pause after a busy reply, so that a server asking
+// to retry at once is not flooded and still counts towards the limit
+const minRetryAfter = 10 * time.Millisecond
+
+// ErrServerBusy Returned when the server stays busy for longer than the
+// configured maximum wait
+var ErrServerBusy = errors.New("server busy")
+
+// backOff Pauses the client as long as the busy server asked before the
+// request is sent again, keeping its request ID. The pauses add up until the server accepts a
+// request; once they would exceed BusyMaxWait, ErrServerBusy is returned.
+// If the client is stopped meanwhile, errStopped is returned
+func (c *Client) backOff(busy *ServerBusy, request uint64) error {
+	maxWait := c.config.BusyMaxWait
+	if maxWait <= 0 {
+		maxWait = DefaultBusyMaxWait
+	}
+	retryAfter := busy.RetryAfter
+	if retryAfter < minRetryAfter {
+		retryAfter = minRetryAfter
+	}
+	if c.busyWaited+retryAfter > maxWait {
+		log.Errorf("action: backpressure | result: fail | client_id: %v | batch_id: %v | request_id: %v | retry_after: %v | waited: %v",
+			c.config.ID,
+			busy.BatchID,
+			requestID(request),
+			retryAfter,
+			c.busyWaited,
+		)
+		return errors.Wrapf(ErrServerBusy, "still busy after waiting %v", c.busyWaited)
+	}
+
+	log.Warnf("action: backpressure | result: in_progress | client_id: %v | batch_id: %v | request_id: %v | retry_after: %v | waited: %v",
+		c.config.ID,
+		busy.BatchID,
+		requestID(request),
+		retryAfter,
+		c.busyWaited,
+	)
+	select {
+	case <-c.stop:
+		return errStopped
+	case <-c.clock.After(retryAfter):
+	}
+	c.busyWaited += retryAfter
+	return nil
+}
+
+// accepted Records that the server handled a request, so a later busy
+// period starts waiting from zero and every server can be failed over to
+// again
+func (c *Client) accepted() {
+	c.failovers = 0
+	if c.busyWaited > 0 {
+		log.Infof("action: backpressure | result: success | client_id: %v | waited: %v", c.config.ID, c.busyWaited)
+		c.busyWaited = 0
+	}
+}
@@ -0,0 +1,132 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// The payload of a batch message (MsgBatch) is
+//
+//	| batch id (uint32) | amount of bets (uint16) | encoded bets |
+//
+// where the bets are encoded with the codec negotiated in the handshake.
+// The server answers every batch with an acknowledgement (MsgAck) whose
+// payload is the batch id, or with an error (MsgError) carrying it. Several
+// batches may be in flight, so replies are matched by batch id.
+
+const batchHeaderSize = 4 + 2
+
+// EncodedBatch Batch of bets ready to be sent
+type EncodedBatch struct {
+	ID      uint32
+	Count   int
+	Payload []byte
+}
+
+// Batcher Groups bets in batches of at most maxAmount bets whose payload
+// does not exceed maxSize bytes
+type Batcher struct {
+	codec     BetCodec
+	maxAmount int
+	maxSize   int
+	nextID    uint32
+	count     int
+	payload   []byte
+}
+
+// NewBatcher Initializes a batcher. Batch IDs start from 1. If maxAmount
+// is not positive, batches are only limited by their size
+func NewBatcher(codec BetCodec, maxAmount int, maxSize int) *Batcher {
+	if maxAmount <= 0 || maxAmount > math.MaxUint16 {
+		maxAmount = math.MaxUint16
+	}
+	b := &Batcher{
+		codec:     codec,
+		maxAmount: maxAmount,
+		maxSize:   maxSize,
+		nextID:    1,
+	}
+	b.reset()
+	return b
+}
+
+// StartAfter Numbers the following batches after the given batch ID, to
+// resume an upload without reusing the IDs already acknowledged
+func (b *Batcher) StartAfter(id uint32) {
+	b.nextID = id + 1
+}
+
+func (b *Batcher) reset() {
+	b.count = 0
+	b.payload = make([]byte, batchHeaderSize, b.maxSize)
+}
+
+// Add Appends the bet to the current batch. If the bet does not fit, the
+// current batch is closed and returned, and the bet starts the next one.
+// Otherwise nil is returned
+func (b *Batcher) Add(bet Bet) (*EncodedBatch, error) {
+	encoded, err := b.codec.AppendBet(nil, bet)
+	if err != nil {
+		return nil, err
+	}
+	return b.AddEncoded(encoded)
+}
+
+// AddEncoded Works as Add for a bet already encoded with the batcher codec
+func (b *Batcher) AddEncoded(encoded []byte) (*EncodedBatch, error) {
+	if batchHeaderSize+len(encoded) > b.maxSize {
+		return nil, fmt.Errorf("bet of %v bytes does not fit in a batch", len(encoded))
+	}
+
+	var full *EncodedBatch
+	if b.count == b.maxAmount || len(b.payload)+len(encoded) > b.maxSize {
+		full = b.Flush()
+	}
+	b.payload = append(b.payload, encoded...)
+	b.count++
+	return full, nil
+}
+
+// Flush Closes and returns the current batch, or nil if it is empty
+func (b *Batcher) Flush() *EncodedBatch {
+	if b.count == 0 {
+		return nil
+	}
+	batch := &EncodedBatch{ID: b.nextID, Count: b.count, Payload: b.payload}
+	binary.BigEndian.PutUint32(batch.Payload[0:], batch.ID)
+	binary.BigEndian.PutUint16(batch.Payload[4:], uint16(batch.Count))
+	b.nextID++
+	b.reset()
+	return batch
+}
+
+// DecodeBatch Decodes the payload of a batch message
+func DecodeBatch(codec BetCodec, payload []byte) (uint32, []Bet, error) {
+	if len(payload) < batchHeaderSize {
+		return 0, nil, ErrMalformedBet
+	}
+	id := binary.BigEndian.Uint32(payload[0:])
+	count := int(binary.BigEndian.Uint16(payload[4:]))
+	data := payload[batchHeaderSize:]
+
+	// Every bet takes at least one byte, so the amount in the header cannot
+	// force an allocation larger than the payload itself
+	capacity := count
+	if capacity > len(data) {
+		capacity = len(data)
+	}
+	bets := make([]Bet, 0, capacity)
+	for i := 0; i < count; i++ {
+		bet, n, err := codec.DecodeBet(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		bets = append(bets, bet)
+		data = data[n:]
+	}
+	if len(data) != 0 {
+		return 0, nil, ErrMalformedBet
+	}
+	return id, bets, nil
+}
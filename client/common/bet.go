@@ -0,0 +1,53 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BirthdateLayout Format of the birthdate in datasets and in the text codec
+const BirthdateLayout = "2006-01-02"
+
+// betFields Amount of fields of a bet record in an agency dataset
+const betFields = 5
+
+// Bet A lottery bet placed by a person in an agency
+type Bet struct {
+	Agency    int
+	FirstName string
+	LastName  string
+	Document  int
+	Birthdate time.Time
+	Number    int
+}
+
+// ParseBet Builds a bet of the given agency from a dataset record with the
+// fields first name, last name, document, birthdate and number
+func ParseBet(agency int, record []string) (Bet, error) {
+	if len(record) != betFields {
+		return Bet{}, fmt.Errorf("expected %v fields, got %v", betFields, len(record))
+	}
+	document, err := strconv.Atoi(record[2])
+	if err != nil {
+		return Bet{}, errors.Wrapf(err, "invalid document %q", record[2])
+	}
+	birthdate, err := time.Parse(BirthdateLayout, record[3])
+	if err != nil {
+		return Bet{}, errors.Wrapf(err, "invalid birthdate %q", record[3])
+	}
+	number, err := strconv.Atoi(record[4])
+	if err != nil {
+		return Bet{}, errors.Wrapf(err, "invalid number %q", record[4])
+	}
+	return Bet{
+		Agency:    agency,
+		FirstName: record[0],
+		LastName:  record[1],
+		Document:  document,
+		Birthdate: birthdate,
+		Number:    number,
+	}, nil
+}
@@ -0,0 +1,260 @@
+package common
+
+import (
+	"expvar"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// States of a circuit breaker
+const (
+	// BreakerClosed Connections are attempted as usual
+	BreakerClosed = "closed"
+	// BreakerOpen Connections are not attempted until the cooldown elapses
+	BreakerOpen = "open"
+	// BreakerHalfOpen A single connection is attempted to probe the server
+	BreakerHalfOpen = "half_open"
+)
+
+// DefaultBreakerCooldown Time an open breaker waits by default before
+// probing the server
+const DefaultBreakerCooldown = 30 * time.Second
+
+// DefaultBreakerMaxProbes Failed probes after which the client gives up
+// connecting by default
+const DefaultBreakerMaxProbes = 3
+
+// DefaultBreakerBackoff Time a closed breaker waits by default after the
+// first failed connection before allowing another one
+const DefaultBreakerBackoff = 500 * time.Millisecond
+
+// Circuit breaker state and amount of times it opened, by agency. They are
+// published with expvar, and served by the metrics endpoint
+var (
+	breakerStates = expvar.NewMap("circuit_breaker_state")
+	breakerTrips  = expvar.NewMap("circuit_breaker_trips")
+)
+
+// BreakerConfig Settings of the circuit breaker around the connection to
+// the server. A threshold that is not positive disables the breaker, which
+// is the default
+type BreakerConfig struct {
+	// FailureThreshold Consecutive connection failures that open the
+	// circuit
+	FailureThreshold int
+	// Cooldown Time the circuit stays open before a probe. Defaults to
+	// DefaultBreakerCooldown
+	Cooldown time.Duration
+	// MaxProbes Failed probes of a half-open circuit after which the
+	// connection fails. Defaults to DefaultBreakerMaxProbes
+	MaxProbes int
+	// Backoff Time the closed circuit waits after the first of consecutive
+	// failures, doubled after each of the rest up to Cooldown. Defaults to
+	// DefaultBreakerBackoff
+	Backoff time.Duration
+}
+
+// Enabled Checks if the breaker is enabled
+func (c BreakerConfig) Enabled() bool {
+	return c.FailureThreshold > 0
+}
+
+// CircuitBreaker Stops connection attempts after consecutive failures.
+// While the circuit is closed, attempts after a failure wait a backoff
+// that doubles with every failure, so that a short outage does not reach
+// the threshold right away. Once the threshold is reached the circuit
+// opens, and no connection is attempted until the cooldown elapses. Then
+// it becomes half-open: the next attempt probes the server, closing the
+// circuit if it succeeds and opening it again otherwise
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	backoff   time.Duration
+	clock     Clock
+	state     string
+	failures  int
+	failedAt  time.Time
+	openedAt  time.Time
+
+	// OnChange Called on every state change
+	OnChange func(from string, to string, failures int)
+}
+
+// NewCircuitBreaker Creates a closed breaker
+func NewCircuitBreaker(config BreakerConfig, clock Clock) *CircuitBreaker {
+	cooldown := config.Cooldown
+	if cooldown <= 0 {
+		cooldown = DefaultBreakerCooldown
+	}
+	backoff := config.Backoff
+	if backoff <= 0 {
+		backoff = DefaultBreakerBackoff
+	}
+	return &CircuitBreaker{
+		threshold: config.FailureThreshold,
+		cooldown:  cooldown,
+		backoff:   backoff,
+		clock:     clock,
+		state:     BreakerClosed,
+	}
+}
+
+// State Returns the current state
+func (b *CircuitBreaker) State() string {
+	return b.state
+}
+
+// Allow Checks if a connection can be attempted. A closed breaker allows
+// it once the backoff after the last failure elapsed. An open breaker
+// whose cooldown elapsed becomes half-open and allows a single probe
+func (b *CircuitBreaker) Allow() bool {
+	switch b.state {
+	case BreakerClosed:
+		return b.RetryIn() == 0
+	case BreakerOpen:
+		if b.RetryIn() > 0 {
+			return false
+		}
+		b.change(BreakerHalfOpen)
+		return true
+	}
+	// The probe of a half-open breaker is in progress
+	return false
+}
+
+// RetryIn Returns the time left until a closed breaker allows another
+// connection after a failure, or an open one allows a probe
+func (b *CircuitBreaker) RetryIn() time.Duration {
+	var retryAt time.Time
+	switch {
+	case b.state == BreakerOpen:
+		retryAt = b.openedAt.Add(b.cooldown)
+	case b.state == BreakerClosed && b.failures > 0:
+		retryAt = b.failedAt.Add(b.backoffAfter(b.failures))
+	default:
+		return 0
+	}
+	if left := retryAt.Sub(b.clock.Now()); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// backoffAfter Returns the backoff after the given consecutive failures,
+// doubled after each failure but the first and capped at the cooldown
+func (b *CircuitBreaker) backoffAfter(failures int) time.Duration {
+	backoff := b.backoff
+	for i := 1; i < failures && backoff < b.cooldown; i++ {
+		backoff *= 2
+	}
+	if backoff > b.cooldown {
+		return b.cooldown
+	}
+	return backoff
+}
+
+// Success Records a successful connection, closing the circuit
+func (b *CircuitBreaker) Success() {
+	b.failures = 0
+	if b.state != BreakerClosed {
+		b.change(BreakerClosed)
+	}
+}
+
+// Failure Records a failed connection. The circuit opens once the
+// threshold is reached, or right away if the failure was a probe
+func (b *CircuitBreaker) Failure() {
+	b.failures++
+	b.failedAt = b.clock.Now()
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+		b.openedAt = b.clock.Now()
+		b.change(BreakerOpen)
+	}
+}
+
+func (b *CircuitBreaker) change(state string) {
+	from := b.state
+	b.state = state
+	if b.OnChange != nil {
+		b.OnChange(from, state, b.failures)
+	}
+}
+
+// publishBreakerState Publishes the breaker state of the agency
+func publishBreakerState(agency string, state string) {
+	value := new(expvar.String)
+	value.Set(state)
+	breakerStates.Set(agency, value)
+}
+
+// breakerChanged Logs a state change of the breaker and publishes it
+func (c *Client) breakerChanged(from string, to string, failures int) {
+	publishBreakerState(c.config.ID, to)
+	switch to {
+	case BreakerOpen:
+		breakerTrips.Add(c.config.ID, 1)
+		log.Warnf("action: circuit_breaker | result: success | client_id: %v | from: %v | to: %v | failures: %v | retry_in: %v",
+			c.config.ID,
+			from,
+			to,
+			failures,
+			c.breaker.RetryIn(),
+		)
+	default:
+		log.Infof("action: circuit_breaker | result: success | client_id: %v | from: %v | to: %v",
+			c.config.ID,
+			from,
+			to,
+		)
+	}
+}
+
+// connectThroughBreaker Connects to a server, attempting it again while
+// the breaker allows it. While the circuit is closed, failed attempts are
+// followed by a backoff; while it is open no connection is attempted, and
+// once its cooldown elapses the server is probed. Once
+// MaxProbes probes failed, the last connection error is returned. Returns
+// errStopped if the client is stopped meanwhile
+func (c *Client) connectThroughBreaker() (*frameConn, error) {
+	maxProbes := c.config.Breaker.MaxProbes
+	if maxProbes <= 0 {
+		maxProbes = DefaultBreakerMaxProbes
+	}
+	for probes := 0; ; {
+		if c.stopped() {
+			return nil, errStopped
+		}
+		if !c.breaker.Allow() {
+			select {
+			case <-c.stop:
+				return nil, errStopped
+			case <-c.clock.After(c.breaker.RetryIn()):
+			}
+			continue
+		}
+
+		probing := c.breaker.State() == BreakerHalfOpen
+		fc, err := c.connectServer()
+		if err == nil {
+			c.breaker.Success()
+			return fc, nil
+		}
+		log.Errorf("action: connect | result: fail | client_id: %v | breaker: %v | error_class: %v | error: %v",
+			c.config.ID,
+			c.breaker.State(),
+			errorClass(err),
+			err,
+		)
+		c.breaker.Failure()
+		if c.isClosed() {
+			return nil, ErrClientClosed
+		}
+		if probing {
+			probes++
+			if probes >= maxProbes {
+				return nil, err
+			}
+		}
+	}
+}
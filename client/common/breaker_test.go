@@ -0,0 +1,210 @@
+package common_test
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common/clienttest"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	clock := clienttest.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	breaker := common.NewCircuitBreaker(common.BreakerConfig{FailureThreshold: 2, Cooldown: time.Second, Backoff: 100 * time.Millisecond}, clock)
+	var changes []string
+	breaker.OnChange = func(from string, to string, failures int) {
+		changes = append(changes, to)
+	}
+
+	breaker.Failure()
+	clock.Advance(100 * time.Millisecond)
+	if !breaker.Allow() {
+		t.Fatal("expected the breaker to stay closed below the threshold")
+	}
+	breaker.Failure()
+	if breaker.Allow() || breaker.RetryIn() != time.Second {
+		t.Fatalf("expected the breaker to open for a second, got %v for %v", breaker.State(), breaker.RetryIn())
+	}
+
+	// A failed probe opens the circuit again, and a successful one closes it
+	clock.Advance(time.Second)
+	if !breaker.Allow() || breaker.Allow() {
+		t.Fatal("expected a single probe once the cooldown elapsed")
+	}
+	breaker.Failure()
+	clock.Advance(time.Second)
+	if !breaker.Allow() {
+		t.Fatal("expected a probe once the cooldown elapsed again")
+	}
+	breaker.Success()
+
+	expected := []string{common.BreakerOpen, common.BreakerHalfOpen, common.BreakerOpen, common.BreakerHalfOpen, common.BreakerClosed}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected changes %v, got %v", expected, changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Fatalf("expected changes %v, got %v", expected, changes)
+		}
+	}
+}
+
+func TestCircuitBreakerBacksOffWhileClosed(t *testing.T) {
+	clock := clienttest.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	breaker := common.NewCircuitBreaker(common.BreakerConfig{FailureThreshold: 5, Cooldown: time.Second, Backoff: 300 * time.Millisecond}, clock)
+
+	// The backoff doubles with every failure, up to the cooldown
+	for _, backoff := range []time.Duration{300 * time.Millisecond, 600 * time.Millisecond, time.Second, time.Second} {
+		breaker.Failure()
+		if breaker.Allow() || breaker.RetryIn() != backoff || breaker.State() != common.BreakerClosed {
+			t.Fatalf("expected a closed breaker to wait %v, got %v for %v", backoff, breaker.State(), breaker.RetryIn())
+		}
+		clock.Advance(backoff)
+		if !breaker.Allow() {
+			t.Fatalf("expected a connection to be allowed after %v", backoff)
+		}
+	}
+
+	// A success resets the backoff
+	breaker.Success()
+	if !breaker.Allow() || breaker.RetryIn() != 0 {
+		t.Fatalf("expected no backoff after a success, got %v", breaker.RetryIn())
+	}
+	breaker.Failure()
+	if breaker.RetryIn() != 300*time.Millisecond {
+		t.Fatalf("expected the backoff to start over, got %v", breaker.RetryIn())
+	}
+}
+
+func TestSendBetsBacksOffBetweenConnectionAttempts(t *testing.T) {
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectBatch(1),
+		clienttest.ReplyAck(),
+		clienttest.ExpectFrame(common.MsgDone),
+		clienttest.ReplyAckOf(0),
+		clienttest.ExpectFrame(common.MsgWinnersQuery),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgWinners, Payload: common.EncodeWinners(nil)}),
+		clienttest.ExpectEOF(),
+	})
+	clock := clienttest.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	dialer := clienttest.NewFakeDialer(
+		clienttest.DialError(syscall.ECONNREFUSED),
+		clienttest.DialError(syscall.ECONNREFUSED),
+	)
+	config := clienttest.Config(server.Addr())
+	config.Bets.Dataset = writeDataset(t, sampleDataset)
+	config.Breaker = common.BreakerConfig{FailureThreshold: 5, Cooldown: time.Minute, Backoff: 100 * time.Millisecond}
+	config.Clock = clock
+	config.Dialer = dialer
+	client := clienttest.NewClient(t, config)
+
+	// The second attempt waits the backoff, and the third twice as long
+	go func() {
+		for dials, backoff := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+			clock.BlockUntil(1)
+			clock.Advance(backoff - time.Millisecond)
+			if dialer.Dials() != dials+1 {
+				t.Errorf("expected %v dials before the backoff elapsed, got %v", dials+1, dialer.Dials())
+			}
+			clock.Advance(time.Millisecond)
+		}
+	}()
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected bets to be sent after backing off, got %v", err)
+	}
+	if dialer.Dials() != 3 {
+		t.Fatalf("expected 3 dials, got %v", dialer.Dials())
+	}
+}
+
+func TestSendBetsWaitsForOpenBreaker(t *testing.T) {
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectBatch(1),
+		clienttest.ReplyAck(),
+		clienttest.ExpectFrame(common.MsgDone),
+		clienttest.ReplyAckOf(0),
+		clienttest.ExpectFrame(common.MsgWinnersQuery),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgWinners, Payload: common.EncodeWinners(nil)}),
+		clienttest.ExpectEOF(),
+	})
+	clock := clienttest.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	dialer := clienttest.NewFakeDialer(
+		clienttest.DialError(syscall.ECONNREFUSED),
+		clienttest.DialError(syscall.ECONNREFUSED),
+	)
+	config := clienttest.Config(server.Addr())
+	config.Bets.Dataset = writeDataset(t, sampleDataset)
+	config.Breaker = common.BreakerConfig{FailureThreshold: 2, Cooldown: time.Minute, Backoff: time.Second}
+	config.Clock = clock
+	config.Dialer = dialer
+	client := clienttest.NewClient(t, config)
+
+	// No connection is attempted until the cooldown elapses
+	go func() {
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+		clock.BlockUntil(1)
+		if dialer.Dials() != 2 {
+			t.Errorf("expected 2 dials before the breaker opened, got %v", dialer.Dials())
+		}
+		clock.Advance(time.Minute)
+	}()
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected bets to be sent once the server is probed, got %v", err)
+	}
+	if dialer.Dials() != 3 {
+		t.Fatalf("expected 3 dials, got %v", dialer.Dials())
+	}
+}
+
+func TestSendBetsStopsWhileBreakerIsOpen(t *testing.T) {
+	clock := clienttest.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	dialer := clienttest.NewFakeDialer(clienttest.DialError(syscall.ECONNREFUSED))
+	config := clienttest.Config("127.0.0.1:1")
+	config.Bets.Dataset = writeDataset(t, sampleDataset)
+	config.Breaker = common.BreakerConfig{FailureThreshold: 1, Cooldown: time.Minute}
+	config.Clock = clock
+	config.Dialer = dialer
+	client := clienttest.NewClient(t, config)
+
+	go func() {
+		clock.BlockUntil(1)
+		client.Stop()
+	}()
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected graceful shutdown, got %v", err)
+	}
+	if dialer.Dials() != 1 {
+		t.Fatalf("expected a single dial, got %v", dialer.Dials())
+	}
+}
+
+func TestSendBetsFailsOnceBreakerProbesAreExhausted(t *testing.T) {
+	clock := clienttest.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	dialer := clienttest.NewFakeDialer(
+		clienttest.DialError(syscall.ECONNREFUSED),
+		clienttest.DialError(syscall.ECONNREFUSED),
+		clienttest.DialError(syscall.ECONNREFUSED),
+	)
+	config := clienttest.Config("127.0.0.1:1")
+	config.Bets.Dataset = writeDataset(t, sampleDataset)
+	config.Breaker = common.BreakerConfig{FailureThreshold: 1, Cooldown: time.Minute, MaxProbes: 2}
+	config.Clock = clock
+	config.Dialer = dialer
+	client := clienttest.NewClient(t, config)
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			clock.BlockUntil(1)
+			clock.Advance(time.Minute)
+		}
+	}()
+	if err := clienttest.Run(t, client.SendBets); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("expected the last connection error, got %v", err)
+	}
+	if dialer.Dials() != 3 {
+		t.Fatalf("expected the first dial and 2 probes, got %v dials", dialer.Dials())
+	}
+}
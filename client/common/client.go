@@ -1,15 +1,13 @@
 package common
 
 import (
-	"bufio"
+	"crypto/tls"
 	"fmt"
 	"net"
-	"time"
-	"os"
-	"os/signal"
-	"syscall"
 	"sync"
+	"time"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -17,88 +15,375 @@ import (
 type ClientConfig struct {
 	ID            string
 	ServerAddress string
+	// ServerAddresses Addresses of the central servers, picked according to
+	// ServerPolicy. If empty, ServerAddress is the only server
+	ServerAddresses []string
+	ServerPolicy    string
+	// ServerCooldown Time a failing server is avoided. Defaults to
+	// DefaultServerCooldown
+	ServerCooldown time.Duration
 	LoopLapse     time.Duration
 	LoopPeriod    time.Duration
+	TLS           TLSConfig
+
+	// HMACSecretFile Path of the file holding the agency shared secret.
+	// If set, every frame is signed and every response verified
+	HMACSecretFile string
+	Compression    CompressionConfig
+	Bets           BetsConfig
+	RateLimit      RateLimitConfig
+	Breaker        BreakerConfig
+	Timeouts       TimeoutConfig
+	Heartbeat      HeartbeatConfig
+	// ResumeSessions Asks the server for a session in the handshake, and
+	// presents it on reconnect to resume the upload where the server left it
+	ResumeSessions bool
+	Trace          TraceConfig
+	ClockSkew      ClockSkewConfig
+	// BusyMaxWait Time spent waiting on a busy server, without any request
+	// being handled, before failing. Defaults to DefaultBusyMaxWait
+	BusyMaxWait time.Duration
+
+	// Clock Source of time of the client. Defaults to SystemClock
+	Clock Clock
+	// Dialer Opens the connections to the server. Defaults to a net.Dialer
+	// applying the connect timeout and the keepalive period
+	Dialer Dialer
 }
 
-// Client Entity that encapsulates how
+// Client Entity that encapsulates how the agency talks to the server. It
+// does not handle signals: the owner stops it with Stop, or abandons the
+// in-flight request with Close
 type Client struct {
-	config ClientConfig
-	conn   net.Conn
-	done   chan bool
-	wg	   sync.WaitGroup
-}
+	config    ClientConfig
+	tlsConfig *tls.Config
+	signer    *Signer
+	codec     BetCodec
+	clock     Clock
+	dialer    Dialer
+	limiter   *RateLimiter
+	stats     CompressionStats
+	// busyWaited Time waited on the server since it last handled a request
+	busyWaited time.Duration
+	servers    *serverPool
+	// breaker Circuit breaker around the connections, nil if disabled
+	breaker *CircuitBreaker
+	// failovers Connections replaced since the server last handled a
+	// request
+	failovers int
+	// pushes Handlers of the events pushed by the server. drawCompleted
+	// and gate hold the state the client reactions change
+	pushes        pushDispatcher
+	drawCompleted chan struct{}
+	gate          sendGate
+	// session Token of the last session issued by the server, if any
+	session string
+	tracer  *requestTracer
 
-func (c *Client) sigterm_handler(sigterms chan os.Signal) {
-	<-sigterms
-	log.Infof("action: graceful_shutdown | result: in_progress | client_id: %v",
-		c.config.ID,
-	)
-	log.Infof("action: wait_for_connections | result: in_progress | client_id: %v",
-		c.config.ID,
-	)
-	c.wg.Wait()
-	c.done <- true
-	log.Infof("action: wait_for_connections | result: success | client_id: %v",
-		c.config.ID,
-	)
-	log.Infof("action: close_socket | result: in_progress | client_id: %v",
-		c.config.ID,
-	)
-	c.conn.Close()
-	log.Infof("action: close_socket | result: success | client_id: %v",
-		c.config.ID,
-	)
+	// conn Connection in use. It is only replaced by the goroutine running
+	// the client, and mu guards it against Close
+	conn     *frameConn
+	mu       sync.Mutex
+	closed   bool
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
+// ErrClientClosed Returned when a connection is requested after Close
+var ErrClientClosed = errors.New("client closed")
+
+// errStopped Returned by operations interrupted because the client was
+// stopped, which are not failures
+var errStopped = errors.New("client stopped")
+
 // NewClient Initializes a new client receiving the configuration
-// as a parameter
-func NewClient(config ClientConfig) *Client {
+// as a parameter. An error is returned if the server policy, the parent
+// traceparent or the TLS settings are invalid, the client certificate does not belong to the
+// configured agency or the HMAC secret cannot be loaded
+func NewClient(config ClientConfig) (*Client, error) {
 	client := &Client{
 		config: config,
-		done: make(chan bool, 1),
+		clock:  config.Clock,
+		dialer: config.Dialer,
+		stop:   make(chan struct{}),
+
+		drawCompleted: make(chan struct{}, 1),
+	}
+	client.registerPushReactions()
+	if client.clock == nil {
+		client.clock = SystemClock{}
+	}
+	if client.dialer == nil {
+		client.dialer = &net.Dialer{
+			Timeout:   config.Timeouts.Connect,
+			KeepAlive: config.Timeouts.KeepAlive,
+		}
+	}
+	client.limiter = NewRateLimiter(config.RateLimit, client.clock)
+	tracer, err := newRequestTracer(config.Trace)
+	if err != nil {
+		return nil, err
 	}
+	client.tracer = tracer
 
-	sigterms := make(chan os.Signal, 1)
-	signal.Notify(sigterms, syscall.SIGTERM)
+	if err := ValidateServerPolicy(config.ServerPolicy); err != nil {
+		return nil, err
+	}
+	addresses := config.ServerAddresses
+	if len(addresses) == 0 {
+		addresses = []string{config.ServerAddress}
+	}
+	client.servers = newServerPool(addresses, config.ServerPolicy, config.ServerCooldown, client.clock)
+	if config.Breaker.Enabled() {
+		client.breaker = NewCircuitBreaker(config.Breaker, client.clock)
+		client.breaker.OnChange = client.breakerChanged
+		publishBreakerState(config.ID, BreakerClosed)
+	}
 
-	go client.sigterm_handler(sigterms)
+	if config.TLS.Enabled {
+		tlsConfig, err := newTLSConfig(config.TLS, config.ID)
+		if err != nil {
+			return nil, err
+		}
+		client.tlsConfig = tlsConfig
+	}
 
-	return client
+	if err := ValidateCompression(config.Compression.Algorithm); err != nil {
+		return nil, err
+	}
+
+	codec, err := NewBetCodec(config.Bets.Codec)
+	if err != nil {
+		return nil, err
+	}
+	client.codec = codec
+
+	if config.HMACSecretFile != "" {
+		if len(config.ID) > 255 {
+			return nil, fmt.Errorf("agency ID %v is too long to be signed", config.ID)
+		}
+		secret, err := LoadSecret(config.HMACSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		client.signer = NewSigner(secret, config.ID)
+	}
+	return client, nil
+}
+
+// Stop Asks the running loop or upload to finish gracefully. It returns
+// immediately; the request in flight is completed before stopping
+func (c *Client) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// Close Stops the client and closes its connection, abandoning the
+// request in flight. No connections can be opened afterwards
+func (c *Client) Close() error {
+	c.Stop()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
 }
 
-// CreateClientSocket Initializes client socket. In case of
-// failure, error is printed in stdout/stderr and exit 1
-// is returned
+// isClosed Checks if Close was called
+func (c *Client) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// stopped Checks if Stop was called
+func (c *Client) stopped() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait Waits for the duration to elapse, or until the client is stopped
+func (c *Client) wait(d time.Duration) {
+	select {
+	case <-c.clock.After(d):
+	case <-c.stop:
+	}
+}
+
+// CreateClientSocket Initializes client socket, connecting to the servers
+// in the order given by the server policy until one of them succeeds. In
+// case every server fails, the last error is returned, unless the circuit
+// breaker is enabled: then connections are attempted until one succeeds,
+// the breaker gives up probing the servers or the client is stopped, in
+// which case errStopped is returned
 func (c *Client) createClientSocket() error {
-	c.wg.Add(1)
-	conn, err := net.Dial("tcp", c.config.ServerAddress)
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+
+	var fc *frameConn
+	var err error
+	if c.breaker != nil {
+		fc, err = c.connectThroughBreaker()
+	} else {
+		fc, err = c.connectServer()
+	}
 	if err != nil {
-		log.Fatalf(
-	        "action: connect | result: fail | client_id: %v | error: %v",
-			c.config.ID,
-			err,
-		)
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		fc.Close()
+		return ErrClientClosed
 	}
-	c.conn = conn
+	c.conn = fc
 	return nil
 }
 
-// StartClientLoop Send messages to the client until some time threshold is met
-func (c *Client) StartClientLoop() {
+// connect Opens a connection to the server. If TLS is enabled the
+// handshake is completed before returning, and if signing, compression, a
+// bet codec other than text, sessions or clock skew checks are configured
+// they are negotiated with the server. Both handshakes have to complete
+// within the connect timeout
+func (c *Client) connect(address string) (*frameConn, error) {
+	timeouts := c.config.Timeouts
+	raw, err := c.dialer.Dial("tcp", address)
+	if err != nil {
+		return nil, timeoutError("connect", timeouts.Connect, err)
+	}
+
+	// The connect timeout is replaced by the ones of each operation once
+	// the handshakes complete
+	w := watch(c.clock, timeouts.Connect, "connect", raw.SetDeadline)
+	fc, err := c.handshakes(raw, address)
+	if err = w.stop(err); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	fc.readTimeout = timeouts.Read
+	fc.writeTimeout = timeouts.Write
+	fc.start(newHeartbeat(c.config.Heartbeat, c.clock, c.config.ID, c.tracer), c.dispatchPush)
+	return fc, nil
+}
+
+// handshakes Completes the TLS handshake and the protocol one, if frames
+// are signed or any setting has to be negotiated with the server
+func (c *Client) handshakes(raw net.Conn, address string) (*frameConn, error) {
+	conn, err := c.secureConn(raw, address)
+	if err != nil {
+		return nil, err
+	}
+	var signer *Signer
+	if c.signer != nil {
+		if signer, err = c.signer.session(); err != nil {
+			return nil, err
+		}
+	}
+	fc := newFrameConn(conn, signer, &c.stats, c.clock)
+	// Signed connections always start with a hello, which exchanges the
+	// nonces their frames cover
+	if signer != nil || c.config.Compression.Enabled() || c.codec.Name() != CodecText || c.config.ResumeSessions || c.config.ClockSkew.Enabled() {
+		if err := c.handshake(fc); err != nil {
+			return nil, err
+		}
+	}
+	return fc, nil
+}
+
+// handshake Sends the client offer to the server and applies the
+// settings it accepted to the connection
+func (c *Client) handshake(fc *frameConn) error {
+	offer := Hello{
+		Agency: c.config.ID,
+		Codec:  c.codec.Name(),
+	}
+	if c.config.Compression.Enabled() {
+		offer.Compression = []string{c.config.Compression.Algorithm}
+	}
+	if c.config.ResumeSessions {
+		offer.Session = c.session
+		if offer.Session == "" {
+			offer.Session = SessionNew
+		}
+	}
+	if c.config.ClockSkew.Enabled() {
+		offer.Time = c.clock.Now()
+	}
+	if fc.signer != nil {
+		offer.Nonce = fc.signer.nonce
+	}
+	if err := fc.send(c.tracer.frame(MsgHello, offer.Encode())); err != nil {
+		return err
+	}
+	reply, err := fc.receive()
+	if err != nil {
+		return err
+	}
+	received := c.clock.Now()
+	if reply.Type != MsgHello {
+		return fmt.Errorf("unexpected message type %v during handshake", reply.Type)
+	}
+	accepted, err := DecodeHello(reply.Payload)
+	if err != nil {
+		return err
+	}
+	if fc.signer != nil {
+		if len(accepted.Nonce) == 0 {
+			return errors.New("server did not send a nonce for the signed connection")
+		}
+		fc.signer.bind(accepted.Nonce)
+	}
+
+	fc.compression = negotiateCompression(offer.Compression, accepted.Compression)
+	fc.threshold = c.config.Compression.Threshold
+	fc.codec = negotiateCodec(c.codec, accepted.Codec)
+	if c.config.ResumeSessions {
+		c.startSession(fc, offer.Session, accepted)
+	}
+	if c.config.ClockSkew.Enabled() {
+		c.checkClockSkew(fc, offer.Time, accepted.Time, received)
+	}
+	log.Debugf("action: handshake | result: success | client_id: %v | compression: %v | codec: %v",
+		c.config.ID,
+		fc.compression,
+		fc.codec.Name(),
+	)
+	return nil
+}
+
+// isVerificationError Checks if the error was caused by a frame that
+// failed the HMAC verification
+func isVerificationError(err error) bool {
+	return errors.Is(err, ErrFrameUnsigned) ||
+		errors.Is(err, ErrFrameTampered) ||
+		errors.Is(err, ErrFrameReplayed)
+}
+
+// StartClientLoop Send messages to the client until some time threshold is met.
+// If the server cannot be reached or a message cannot be exchanged, the
+// loop is stopped and the error is returned. With the circuit breaker
+// enabled, an unreachable server is waited for instead
+func (c *Client) StartClientLoop() error {
 	// autoincremental msgID to identify every message sent
 	msgID := 1
+	c.logTrace()
 
 loop:
 	// Send messages if the loopLapse threshold has not been surpassed
-	for timeout := time.After(c.config.LoopLapse); ; {
+	for timeout := c.clock.After(c.config.LoopLapse); ; {
 		select {
 		case <-timeout:
 	        log.Infof("action: timeout_detected | result: success | client_id: %v",
                 c.config.ID,
             )
 			break loop
-		case <-c.done:
+		case <-c.stop:
 			log.Infof("action: graceful_shutdown | result: success | client_id: %v",
                 c.config.ID,
             )
@@ -107,35 +392,70 @@ loop:
 		}
 
 		// Create the connection the server in every loop iteration. Send an
-		c.createClientSocket()
+		err := c.createClientSocket()
+		if err == errStopped {
+			log.Infof("action: graceful_shutdown | result: success | client_id: %v",
+				c.config.ID,
+			)
+			break loop
+		}
+		if err != nil {
+			log.Errorf("action: connect | result: fail | client_id: %v | error_class: %v | error: %v",
+				c.config.ID,
+				errorClass(err),
+				err,
+			)
+			return err
+		}
 
-		// TODO: Modify the send to avoid short-write
-		fmt.Fprintf(
-			c.conn,
-			"[CLIENT %v] Message N°%v\n",
-			c.config.ID,
-			msgID,
-		)
-		msg, err := bufio.NewReader(c.conn).ReadString('\n')
+		request := c.tracer.frame(MsgEcho, []byte(fmt.Sprintf("[CLIENT %v] Message N°%v", c.config.ID, msgID)))
+		err = c.conn.send(request)
+		var reply Frame
+		if err == nil {
+			reply, err = c.conn.receive()
+		}
 		msgID++
 		c.conn.Close()
-		c.wg.Done()
 
+		if isVerificationError(err) {
+			log.Errorf("action: verify_message | result: fail | client_id: %v | request_id: %v | error: %v",
+				c.config.ID,
+				requestID(request.RequestID),
+				err,
+			)
+			return err
+		}
 		if err != nil {
-			log.Errorf("action: receive_message | result: fail | client_id: %v | error: %v",
+			log.Errorf("action: receive_message | result: fail | client_id: %v | request_id: %v | error_class: %v | error: %v",
                 c.config.ID,
+				requestID(request.RequestID),
+				errorClass(err),
 				err,
 			)
-			return
+			return err
 		}
-		log.Infof("action: receive_message | result: success | client_id: %v | msg: %v",
+		log.Infof("action: receive_message | result: success | client_id: %v | request_id: %v | msg: %s",
             c.config.ID,
-            msg,
+            requestID(request.RequestID),
+            reply.Payload,
         )
 
-		// Wait a time between sending one message and the next one
-		time.Sleep(c.config.LoopPeriod)
+		// Wait a time between sending one message and the next one. If
+		// the client is stopped meanwhile, the loop ends in the next check
+		c.wait(c.config.LoopPeriod)
+	}
+
+	if c.config.Compression.Enabled() {
+		frames, rawBytes, wireBytes := c.stats.Snapshot()
+		log.Infof("action: compression_stats | result: success | client_id: %v | frames: %v | bytes: %v | compressed_bytes: %v | ratio: %.2f",
+			c.config.ID,
+			frames,
+			rawBytes,
+			wireBytes,
+			compressionRatio(rawBytes, wireBytes),
+		)
 	}
 
 	log.Infof("action: loop_finished | result: success | client_id: %v", c.config.ID)
+	return nil
 }
@@ -0,0 +1,704 @@
+package common_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common/clienttest"
+)
+
+// echoScript Answers a single echo message and waits for the client to
+// close the connection
+var echoScript = clienttest.Script{
+	clienttest.ExpectFrame(common.MsgEcho),
+	clienttest.ReplyEcho(),
+	clienttest.ExpectEOF(),
+}
+
+func TestClientLoopStopsWhenLoopLapseExpires(t *testing.T) {
+	server := clienttest.NewServer(t, echoScript)
+	client := clienttest.NewClient(t, clienttest.Config(server.Addr()))
+
+	if err := clienttest.RunLoop(t, client); err != nil {
+		t.Fatalf("expected loop to finish cleanly, got %v", err)
+	}
+	if server.Accepted() < 2 {
+		t.Fatalf("expected a connection per message, got %v", server.Accepted())
+	}
+}
+
+func TestClientLoopStopsWhenStopped(t *testing.T) {
+	server := clienttest.NewServer(t, echoScript)
+	config := clienttest.Config(server.Addr())
+	config.LoopLapse = time.Hour
+	config.LoopPeriod = time.Hour
+	client := clienttest.NewClient(t, config)
+
+	go func() {
+		for server.Accepted() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		client.Stop()
+	}()
+	if err := clienttest.RunLoop(t, client); err != nil {
+		t.Fatalf("expected graceful shutdown, got %v", err)
+	}
+	if server.Accepted() != 1 {
+		t.Fatalf("expected no messages after stopping, got %v connections", server.Accepted())
+	}
+}
+
+func TestClientCloseAbandonsRequestInFlight(t *testing.T) {
+	// The server never replies, so the loop only returns if Close
+	// interrupts the request
+	received := make(chan struct{})
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectFrame(common.MsgEcho),
+		clienttest.Notify(received),
+		clienttest.ExpectEOF(),
+	})
+	client := clienttest.NewClient(t, clienttest.Config(server.Addr()))
+
+	go func() {
+		<-received
+		client.Close()
+	}()
+	if err := clienttest.RunLoop(t, client); err == nil {
+		t.Fatal("expected the abandoned request to fail")
+	}
+}
+
+func TestClientLoopRunsOnVirtualTime(t *testing.T) {
+	server := clienttest.NewServer(t, echoScript)
+	clock := clienttest.NewFakeClock(time.Unix(0, 0))
+	config := clienttest.Config(server.Addr())
+	config.LoopLapse = time.Hour
+	config.LoopPeriod = time.Minute
+	config.Clock = clock
+	client := clienttest.NewClient(t, config)
+
+	go func() {
+		// The loop waits on the lapse timer and on the period between messages
+		for i := 0; i < 3; i++ {
+			clock.BlockUntil(2)
+			clock.Advance(time.Minute)
+		}
+		clock.BlockUntil(2)
+		clock.Advance(time.Hour)
+	}()
+	if err := clienttest.RunLoop(t, client); err != nil {
+		t.Fatalf("expected loop to finish cleanly, got %v", err)
+	}
+	if server.Accepted() != 4 {
+		t.Fatalf("expected 4 messages, got %v", server.Accepted())
+	}
+}
+
+func TestClientLoopFailsOnDialError(t *testing.T) {
+	config := clienttest.Config("127.0.0.1:1")
+	config.Dialer = clienttest.NewFakeDialer(clienttest.DialError(syscall.ECONNREFUSED))
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.RunLoop(t, client); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("expected dial error, got %v", err)
+	}
+}
+
+func TestClientLoopFailsOnConnectionReset(t *testing.T) {
+	server := clienttest.NewServer(t, echoScript, clienttest.Script{clienttest.ExpectEOF()})
+	dialer := clienttest.NewFakeDialer(clienttest.DialOK(), clienttest.DialReset(0))
+	config := clienttest.Config(server.Addr())
+	config.Dialer = dialer
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.RunLoop(t, client); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("expected connection reset, got %v", err)
+	}
+	if dialer.Dials() != 2 {
+		t.Fatalf("expected the loop to stop at the second connection, got %v dials", dialer.Dials())
+	}
+}
+
+func TestClientLoopFailsWhenServerIsUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	client := clienttest.NewClient(t, clienttest.Config(address))
+	if err := clienttest.RunLoop(t, client); err == nil {
+		t.Fatal("expected connection error")
+	}
+}
+
+func TestClientLoopFailsWhenConnectionIsDropped(t *testing.T) {
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectFrame(common.MsgEcho),
+		clienttest.Drop(),
+	})
+	client := clienttest.NewClient(t, clienttest.Config(server.Addr()))
+
+	if err := clienttest.RunLoop(t, client); err == nil {
+		t.Fatal("expected error when the server drops the connection")
+	}
+}
+
+func TestClientLoopFailsOnPartialReply(t *testing.T) {
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectFrame(common.MsgEcho),
+		clienttest.SendPartial(common.Frame{Type: common.MsgEcho, Payload: []byte("hello")}, 7),
+	})
+	client := clienttest.NewClient(t, clienttest.Config(server.Addr()))
+
+	if err := clienttest.RunLoop(t, client); err == nil {
+		t.Fatal("expected error on truncated reply")
+	}
+}
+
+// writeDataset Writes an agency dataset with the given records
+func writeDataset(t *testing.T, lines string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "agency-1.csv")
+	if err := os.WriteFile(path, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const sampleDataset = "Santiago Lionel,Lorca,30904465,1999-03-17,7574\n" +
+	"Joaquin Tomas,Lopez,36789210,1985-11-02,2201\n" +
+	"Ana,Di Lorenzo,24543210,1970-01-30,15\n"
+
+func TestSendBetsQueriesWinnersAfterDraw(t *testing.T) {
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectFrame(common.MsgBatch),
+		clienttest.ReplyAck(),
+		clienttest.ExpectFrame(common.MsgDone),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgAck, Payload: common.EncodeAck(common.Ack{})}),
+		clienttest.ExpectFrame(common.MsgWinnersQuery),
+		clienttest.ReplyError(common.ErrorCodeDrawPending, "draw pending"),
+		clienttest.ExpectFrame(common.MsgWinnersQuery),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgWinners, Payload: common.EncodeWinners([]uint32{30904465})}),
+		clienttest.ExpectEOF(),
+	})
+	config := clienttest.Config(server.Addr())
+	config.Bets.Dataset = writeDataset(t, sampleDataset)
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected bets to be sent, got %v", err)
+	}
+}
+
+// replyDrawPending Answers every winners query with a draw pending error
+// until the client closes the connection
+func replyDrawPending(c *clienttest.Conn) error {
+	for {
+		if _, err := common.ReadFrame(c); err != nil {
+			return nil
+		}
+		serverErr := common.ServerError{Code: common.ErrorCodeDrawPending, Message: "draw pending"}
+		if err := common.WriteFrame(c, common.Frame{Type: common.MsgError, Payload: common.EncodeError(serverErr)}); err != nil {
+			return err
+		}
+	}
+}
+
+func TestSendBetsGivesUpWhenDrawIsPendingAfterLoopLapse(t *testing.T) {
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectFrame(common.MsgBatch),
+		clienttest.ReplyAck(),
+		clienttest.ExpectFrame(common.MsgDone),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgAck, Payload: common.EncodeAck(common.Ack{})}),
+		replyDrawPending,
+	})
+	clock := clienttest.NewFakeClock(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC))
+	config := clienttest.Config(server.Addr())
+	config.Bets.Dataset = writeDataset(t, sampleDataset)
+	config.LoopLapse = time.Hour
+	config.Clock = clock
+	client := clienttest.NewClient(t, config)
+
+	go func() {
+		clock.BlockUntil(2)
+		clock.Advance(time.Hour)
+	}()
+	if err := clienttest.Run(t, client.SendBets); err == nil {
+		t.Fatal("expected error when the draw is still pending")
+	}
+}
+
+func TestSendBetsReturnsServerError(t *testing.T) {
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectFrame(common.MsgBatch),
+		clienttest.ReplyError(common.ErrorCodeInvalidBatch, "invalid batch"),
+	})
+	config := clienttest.Config(server.Addr())
+	config.Bets.Dataset = writeDataset(t, sampleDataset)
+	client := clienttest.NewClient(t, config)
+
+	err := clienttest.Run(t, client.SendBets)
+	var serverErr *common.ServerError
+	if !errors.As(err, &serverErr) || serverErr.Code != common.ErrorCodeInvalidBatch || serverErr.BatchID != 1 {
+		t.Fatalf("expected invalid batch error for batch 1, got %v", err)
+	}
+}
+
+func TestSendBetsResumesAfterStop(t *testing.T) {
+	progressFile := filepath.Join(t.TempDir(), "progress")
+	dataset := writeDataset(t, sampleDataset)
+	newConfig := func(address string) common.ClientConfig {
+		config := clienttest.Config(address)
+		config.Bets.Dataset = dataset
+		config.Bets.BatchMaxAmount = 1
+		config.Bets.ProgressFile = progressFile
+		return config
+	}
+
+	// The client is stopped while the second batch is in flight. The batch
+	// is completed and the third bet is left pending
+	var client *common.Client
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectBatch(1),
+		clienttest.ReplyAck(),
+		clienttest.ExpectBatch(2),
+		func(c *clienttest.Conn) error {
+			client.Stop()
+			return nil
+		},
+		clienttest.ReplyAck(),
+		clienttest.ExpectEOF(),
+	})
+	client = clienttest.NewClient(t, newConfig(server.Addr()))
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected graceful shutdown, got %v", err)
+	}
+	progress, err := common.LoadProgress(progressFile)
+	if err != nil || progress != (common.Progress{Records: 2, Batch: 2}) {
+		t.Fatalf("expected progress of 2 records and batch 2, got %+v (%v)", progress, err)
+	}
+
+	// The next upload only sends the pending bet, numbered after batch 2
+	server = clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectBatch(3),
+		clienttest.ReplyAck(),
+		clienttest.ExpectFrame(common.MsgDone),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgAck, Payload: common.EncodeAck(common.Ack{})}),
+		clienttest.ExpectFrame(common.MsgWinnersQuery),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgWinners, Payload: common.EncodeWinners(nil)}),
+		clienttest.ExpectEOF(),
+	})
+	client = clienttest.NewClient(t, newConfig(server.Addr()))
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected upload to be resumed, got %v", err)
+	}
+	progress, err = common.LoadProgress(progressFile)
+	if err != nil || progress != (common.Progress{Records: 3, Batch: 3}) {
+		t.Fatalf("expected progress of 3 records and batch 3, got %+v (%v)", progress, err)
+	}
+}
+
+// longName Name longer than the binary codec can encode
+var longName = strings.Repeat("a", common.MaxNameSize+1)
+
+// datasetWithInvalidRows Holds rows the validator rejects, names that a
+// codec cannot encode among them, before and after the valid ones
+var datasetWithInvalidRows = "Santiago Lionel,Lorca,30904465,1999-03-17,7574\n" +
+	",Lopez,36789210,1985-11-02,2201\n" +
+	"Ana,Di Lorenzo,24543210,1970-01-30,15000\n" +
+	"\"Lorca, Ana\",Lorca,24543212,1971-02-01,16\n" +
+	longName + ",Lorca,24543213,1971-02-01,17\n" +
+	"Maria,Rivera,24543211,1971-02-01,15\n" +
+	"\"Ana\nMaria\",Rivera,24543214,1971-02-01,18\n"
+
+func TestSendBetsReportsInvalidRows(t *testing.T) {
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectFrame(common.MsgBatch),
+		func(c *clienttest.Conn) error {
+			_, bets, err := common.DecodeBatch(common.TextCodec{}, c.Last.Payload)
+			if err != nil || len(bets) != 2 {
+				return errors.Errorf("expected the 2 valid bets, got %v (%v)", len(bets), err)
+			}
+			return nil
+		},
+		clienttest.ReplyAck(),
+		clienttest.ExpectFrame(common.MsgDone),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgAck, Payload: common.EncodeAck(common.Ack{})}),
+		clienttest.ExpectFrame(common.MsgWinnersQuery),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgWinners, Payload: common.EncodeWinners(nil)}),
+		clienttest.ExpectEOF(),
+	})
+	rejectsFile := filepath.Join(t.TempDir(), "rejects.csv")
+	config := clienttest.Config(server.Addr())
+	config.Bets.Dataset = writeDataset(t, datasetWithInvalidRows)
+	config.Bets.RejectsFile = rejectsFile
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected valid bets to be sent, got %v", err)
+	}
+	rejects, err := os.ReadFile(rejectsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "2,empty_name,,Lopez,36789210,1985-11-02,2201\n" +
+		"3,invalid_number,Ana,Di Lorenzo,24543210,1970-01-30,15000\n" +
+		"4,invalid_name,\"Lorca, Ana\",Lorca,24543212,1971-02-01,16\n" +
+		"5,invalid_name," + longName + ",Lorca,24543213,1971-02-01,17\n" +
+		"7,invalid_name,\"Ana\nMaria\",Rivera,24543214,1971-02-01,18\n"
+	if string(rejects) != expected {
+		t.Fatalf("expected rejects\n%s\ngot\n%s", expected, rejects)
+	}
+}
+
+func TestSendBetsAbortsOnInvalidRowInStrictMode(t *testing.T) {
+	server := clienttest.NewServer(t, clienttest.Script{clienttest.ExpectEOF()})
+	config := clienttest.Config(server.Addr())
+	config.Bets.Dataset = writeDataset(t, datasetWithInvalidRows)
+	config.Bets.StrictValidation = true
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); !errors.Is(err, common.ErrInvalidBet) {
+		t.Fatalf("expected invalid bet error, got %v", err)
+	}
+}
+
+const datasetWithDuplicates = "Santiago Lionel,Lorca,30904465,1999-03-17,7574\n" +
+	"Santiago Lionel,Lorca,30904465,1999-03-17,15\n" +
+	"Santiago Lionel,Lorca,30904465,1999-03-17,7574\n"
+
+func TestSendBetsDropsDuplicates(t *testing.T) {
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectFrame(common.MsgBatch),
+		func(c *clienttest.Conn) error {
+			_, bets, err := common.DecodeBatch(common.TextCodec{}, c.Last.Payload)
+			if err != nil || len(bets) != 2 || bets[0].Number != 7574 || bets[1].Number != 15 {
+				return errors.Errorf("expected the 2 distinct bets, got %+v (%v)", bets, err)
+			}
+			return nil
+		},
+		clienttest.ReplyAck(),
+		clienttest.ExpectFrame(common.MsgDone),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgAck, Payload: common.EncodeAck(common.Ack{})}),
+		clienttest.ExpectFrame(common.MsgWinnersQuery),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgWinners, Payload: common.EncodeWinners(nil)}),
+		clienttest.ExpectEOF(),
+	})
+	config := clienttest.Config(server.Addr())
+	config.Bets.Dataset = writeDataset(t, datasetWithDuplicates)
+	config.Bets.Duplicates = common.DuplicatesDrop
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected distinct bets to be sent, got %v", err)
+	}
+}
+
+func TestSendBetsFailsOnDuplicate(t *testing.T) {
+	server := clienttest.NewServer(t, clienttest.Script{clienttest.ExpectEOF()})
+	config := clienttest.Config(server.Addr())
+	config.Bets.Dataset = writeDataset(t, datasetWithDuplicates)
+	config.Bets.Duplicates = common.DuplicatesFail
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); !errors.Is(err, common.ErrDuplicateBet) {
+		t.Fatalf("expected duplicate bet error, got %v", err)
+	}
+}
+
+// pipelineConfig Returns the configuration of an upload of sampleDataset in
+// batches of one bet, with up to three batches in flight
+func pipelineConfig(t *testing.T, address string) common.ClientConfig {
+	config := clienttest.Config(address)
+	config.Bets.Dataset = writeDataset(t, sampleDataset)
+	config.Bets.BatchMaxAmount = 1
+	config.Bets.Window = 3
+	config.Bets.ProgressFile = filepath.Join(t.TempDir(), "progress")
+	return config
+}
+
+func TestSendBetsPipelinesBatchesAndMatchesAcksByID(t *testing.T) {
+	// Every batch is sent before the first acknowledgement, and the
+	// acknowledgements arrive out of order
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectBatch(1),
+		clienttest.ExpectBatch(2),
+		clienttest.ExpectBatch(3),
+		clienttest.ReplyAckOf(2),
+		clienttest.ReplyAckOf(3),
+		clienttest.ReplyAckOf(1),
+		clienttest.ExpectFrame(common.MsgDone),
+		clienttest.ReplyAckOf(0),
+		clienttest.ExpectFrame(common.MsgWinnersQuery),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgWinners, Payload: common.EncodeWinners(nil)}),
+		clienttest.ExpectEOF(),
+	})
+	config := pipelineConfig(t, server.Addr())
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected bets to be sent, got %v", err)
+	}
+	progress, err := common.LoadProgress(config.Bets.ProgressFile)
+	if err != nil || progress != (common.Progress{Records: 3, Batch: 3}) {
+		t.Fatalf("expected progress of 3 records and batch 3, got %+v (%v)", progress, err)
+	}
+}
+
+func TestSendBetsKeepsProgressBeforeFailedBatch(t *testing.T) {
+	// Batch 2 fails before batch 1 is acknowledged. The acknowledgement of
+	// batch 1 is still recorded, and the one of batch 3 is not
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectBatch(1),
+		clienttest.ExpectBatch(2),
+		clienttest.ExpectBatch(3),
+		clienttest.ReplyErrorOf(2, common.ErrorCodeInvalidBatch, "invalid batch"),
+		clienttest.ReplyAckOf(3),
+		clienttest.ReplyAckOf(1),
+		clienttest.ExpectEOF(),
+	})
+	config := pipelineConfig(t, server.Addr())
+	client := clienttest.NewClient(t, config)
+
+	err := clienttest.Run(t, client.SendBets)
+	var serverErr *common.ServerError
+	if !errors.As(err, &serverErr) || serverErr.BatchID != 2 {
+		t.Fatalf("expected error of batch 2, got %v", err)
+	}
+	progress, err := common.LoadProgress(config.Bets.ProgressFile)
+	if err != nil || progress != (common.Progress{Records: 1, Batch: 1}) {
+		t.Fatalf("expected progress of 1 record and batch 1, got %+v (%v)", progress, err)
+	}
+}
+
+func TestSendBetsSavesProgressAsBatchesSettle(t *testing.T) {
+	// The progress of batch 1 is saved before the upload ends, so it
+	// survives the client being killed mid upload
+	config := pipelineConfig(t, "")
+	savedFirst := func(*clienttest.Conn) error {
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(5 * time.Millisecond) {
+			progress, err := common.LoadProgress(config.Bets.ProgressFile)
+			if err != nil {
+				return err
+			}
+			if progress == (common.Progress{Records: 1, Batch: 1}) {
+				return nil
+			}
+		}
+		return errors.New("expected progress of batch 1 to be saved")
+	}
+	server := clienttest.NewServer(t, append(clienttest.Script{
+		clienttest.ExpectBatch(1),
+		clienttest.ExpectBatch(2),
+		clienttest.ExpectBatch(3),
+		clienttest.ReplyAckOf(1),
+		savedFirst,
+		clienttest.ReplyAckOf(2),
+		clienttest.ReplyAckOf(3),
+	}, finishUpload...))
+	config.ServerAddress = server.Addr()
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected bets to be sent, got %v", err)
+	}
+}
+
+func TestSendBetsRetriesBatchesWhileServerIsBusy(t *testing.T) {
+	// The server is busy for batch 2 while batches 1 and 3 are stored, and
+	// then for the notification that the upload is done
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectBatch(1),
+		clienttest.ExpectBatch(2),
+		clienttest.ExpectBatch(3),
+		clienttest.ReplyAckOf(1),
+		clienttest.ReplyBusyOf(2, 20*time.Millisecond),
+		clienttest.ReplyAckOf(3),
+		clienttest.ExpectBatch(2),
+		clienttest.ReplyAck(),
+		clienttest.ExpectFrame(common.MsgDone),
+		clienttest.ReplyBusy(20 * time.Millisecond),
+		clienttest.ExpectFrame(common.MsgDone),
+		clienttest.ReplyAckOf(0),
+		clienttest.ExpectFrame(common.MsgWinnersQuery),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgWinners, Payload: common.EncodeWinners(nil)}),
+		clienttest.ExpectEOF(),
+	})
+	config := pipelineConfig(t, server.Addr())
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected bets to be sent, got %v", err)
+	}
+	progress, err := common.LoadProgress(config.Bets.ProgressFile)
+	if err != nil || progress != (common.Progress{Records: 3, Batch: 3}) {
+		t.Fatalf("expected progress of 3 records and batch 3, got %+v (%v)", progress, err)
+	}
+}
+
+func TestSendBetsFailsWhenServerStaysBusy(t *testing.T) {
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectBatch(1),
+		clienttest.ReplyBusy(60 * time.Millisecond),
+		clienttest.ExpectBatch(1),
+		clienttest.ReplyBusy(60 * time.Millisecond),
+		clienttest.ExpectEOF(),
+	})
+	config := clienttest.Config(server.Addr())
+	config.Bets.Dataset = writeDataset(t, sampleDataset)
+	config.BusyMaxWait = 100 * time.Millisecond
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); !errors.Is(err, common.ErrServerBusy) {
+		t.Fatalf("expected server busy error, got %v", err)
+	}
+}
+
+func TestSendBetsStopsWhileServerIsBusy(t *testing.T) {
+	// The client is stopped while waiting on the busy server, so batch 2 is
+	// abandoned while batch 1 is still recorded
+	var client *common.Client
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectBatch(1),
+		clienttest.ExpectBatch(2),
+		clienttest.ExpectBatch(3),
+		clienttest.ReplyBusyOf(2, time.Hour),
+		func(c *clienttest.Conn) error {
+			client.Stop()
+			return nil
+		},
+		clienttest.ReplyAckOf(1),
+		clienttest.ExpectEOF(),
+	})
+	config := pipelineConfig(t, server.Addr())
+	config.BusyMaxWait = 2 * time.Hour
+	client = clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected graceful shutdown, got %v", err)
+	}
+	progress, err := common.LoadProgress(config.Bets.ProgressFile)
+	if err != nil || progress != (common.Progress{Records: 1, Batch: 1}) {
+		t.Fatalf("expected progress of 1 record and batch 1, got %+v (%v)", progress, err)
+	}
+}
+
+func TestSendBetsFailsOverAndResendsBatchesInFlight(t *testing.T) {
+	// The first server stores batch 1 and dies. The batches in flight are
+	// sent again with the same IDs to the second one
+	primary := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectBatch(1),
+		clienttest.ExpectBatch(2),
+		clienttest.ExpectBatch(3),
+		clienttest.ReplyAckOf(1),
+		clienttest.Drop(),
+	})
+	secondary := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectBatch(2),
+		clienttest.ExpectBatch(3),
+		clienttest.ReplyAckOf(2),
+		clienttest.ReplyAckOf(3),
+		clienttest.ExpectFrame(common.MsgDone),
+		clienttest.ReplyAckOf(0),
+		clienttest.ExpectFrame(common.MsgWinnersQuery),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgWinners, Payload: common.EncodeWinners(nil)}),
+		clienttest.ExpectEOF(),
+	})
+	config := pipelineConfig(t, primary.Addr())
+	config.ServerAddresses = []string{primary.Addr(), secondary.Addr()}
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected bets to be sent, got %v", err)
+	}
+	progress, err := common.LoadProgress(config.Bets.ProgressFile)
+	if err != nil || progress != (common.Progress{Records: 3, Batch: 3}) {
+		t.Fatalf("expected progress of 3 records and batch 3, got %+v (%v)", progress, err)
+	}
+	if primary.Accepted() != 1 || secondary.Accepted() != 1 {
+		t.Fatalf("expected one connection to each server, got %v and %v", primary.Accepted(), secondary.Accepted())
+	}
+}
+
+func TestSendBetsSkipsUnreachableServer(t *testing.T) {
+	down := clienttest.NewServer(t)
+	down.Close()
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectBatch(1),
+		clienttest.ReplyAck(),
+		clienttest.ExpectFrame(common.MsgDone),
+		clienttest.ReplyAckOf(0),
+		clienttest.ExpectFrame(common.MsgWinnersQuery),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgWinners, Payload: common.EncodeWinners(nil)}),
+		clienttest.ExpectEOF(),
+	})
+	config := clienttest.Config(down.Addr())
+	config.ServerAddresses = []string{down.Addr(), server.Addr()}
+	config.Bets.Dataset = writeDataset(t, sampleDataset)
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected bets to be sent to the second server, got %v", err)
+	}
+}
+
+// replyClock Answers the client hello with the clock of a server that is
+// offset from the client one
+func replyClock(offset time.Duration) clienttest.Step {
+	return func(c *clienttest.Conn) error {
+		offer, err := common.DecodeHello(c.Last.Payload)
+		if err != nil {
+			return err
+		}
+		accepted := common.Hello{Time: offer.Time.Add(offset)}
+		return common.WriteFrame(c, common.Frame{Type: common.MsgHello, Payload: accepted.Encode()})
+	}
+}
+
+func TestSendBetsRefusesBetsWhenClockIsSkewed(t *testing.T) {
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectFrame(common.MsgHello),
+		replyClock(time.Hour),
+		clienttest.ExpectEOF(),
+	})
+	config := clienttest.Config(server.Addr())
+	config.Bets.Dataset = writeDataset(t, sampleDataset)
+	config.ClockSkew = common.ClockSkewConfig{WarnThreshold: time.Second, RefuseThreshold: time.Minute}
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); !errors.Is(err, common.ErrClockSkew) {
+		t.Fatalf("expected bets to be refused because of clock skew, got %v", err)
+	}
+}
+
+func TestSendBetsOnlyWarnsAboutClockSkewBelowRefuseThreshold(t *testing.T) {
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectFrame(common.MsgHello),
+		replyClock(-time.Hour),
+		clienttest.ExpectBatch(1),
+		clienttest.ReplyAck(),
+		clienttest.ExpectFrame(common.MsgDone),
+		clienttest.ReplyAckOf(0),
+		clienttest.ExpectFrame(common.MsgWinnersQuery),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgWinners, Payload: common.EncodeWinners(nil)}),
+		clienttest.ExpectEOF(),
+	})
+	config := clienttest.Config(server.Addr())
+	config.Bets.Dataset = writeDataset(t, sampleDataset)
+	config.ClockSkew = common.ClockSkewConfig{WarnThreshold: time.Second}
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected bets to be sent despite the warning, got %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package clienttest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+const (
+	// LoopLapse Loop lapse used by Config, short enough to keep tests fast
+	LoopLapse = 200 * time.Millisecond
+	// LoopPeriod Loop period used by Config
+	LoopPeriod = 10 * time.Millisecond
+	// RunTimeout Time a client is given to finish before the test fails
+	RunTimeout = 5 * time.Second
+)
+
+// Config Returns the configuration of agency 1 connecting to the given
+// address, with a short LoopLapse and LoopPeriod
+func Config(address string) common.ClientConfig {
+	return common.ClientConfig{
+		ID:            "1",
+		ServerAddress: address,
+		LoopLapse:     LoopLapse,
+		LoopPeriod:    LoopPeriod,
+		Bets: common.BetsConfig{
+			Codec: common.CodecText,
+		},
+	}
+}
+
+// NewClient Creates a client with the given configuration, failing the
+// test if it is invalid
+func NewClient(t testing.TB, config common.ClientConfig) *common.Client {
+	t.Helper()
+	client, err := common.NewClient(config)
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	return client
+}
+
+// Run Runs fn in the background and returns its error. The test fails if
+// fn does not return within RunTimeout
+func Run(t testing.TB, fn func() error) error {
+	t.Helper()
+	result := make(chan error, 1)
+	go func() {
+		result <- fn()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(RunTimeout):
+		t.Fatalf("client did not finish after %v", RunTimeout)
+		return nil
+	}
+}
+
+// RunLoop Runs the echo loop of the client. See Run
+func RunLoop(t testing.TB, client *common.Client) error {
+	t.Helper()
+	return Run(t, client.StartClientLoop)
+}
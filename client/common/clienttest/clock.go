@@ -0,0 +1,80 @@
+package clienttest
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock Clock whose time only moves when Advance is called
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewFakeClock Creates a fake clock starting at the given time
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now Returns the virtual time
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After Returns a channel that receives the virtual time once it has
+// advanced by d
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, waiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Sleep Blocks until the virtual time has advanced by d
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// Advance Moves the virtual time forward, firing the timers that expire
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+// Waiters Returns the amount of timers that have not fired yet
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// BlockUntil Waits until at least n timers are pending, so that time is
+// only advanced once the client is waiting on it
+func (c *FakeClock) BlockUntil(n int) {
+	for c.Waiters() < n {
+		time.Sleep(time.Millisecond)
+	}
+}
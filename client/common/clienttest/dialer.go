@@ -0,0 +1,113 @@
+package clienttest
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// DialStep Outcome of a dial made through a FakeDialer
+type DialStep func(network, address string) (net.Conn, error)
+
+// FakeDialer Dialer that runs a DialStep per dial, in order. Once the steps
+// are exhausted it connects normally
+type FakeDialer struct {
+	mu    sync.Mutex
+	steps []DialStep
+	dials int
+}
+
+// NewFakeDialer Creates a dialer running the given steps
+func NewFakeDialer(steps ...DialStep) *FakeDialer {
+	return &FakeDialer{steps: steps}
+}
+
+// Dial Runs the next step, or connects normally if there are none left
+func (d *FakeDialer) Dial(network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	step := DialStep(net.Dial)
+	if d.dials < len(d.steps) {
+		step = d.steps[d.dials]
+	}
+	d.dials++
+	d.mu.Unlock()
+	return step(network, address)
+}
+
+// Dials Returns the amount of dials made so far
+func (d *FakeDialer) Dials() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials
+}
+
+// DialOK Connects normally
+func DialOK() DialStep {
+	return net.Dial
+}
+
+// DialError Fails the dial with the given error
+func DialError(err error) DialStep {
+	return func(network, address string) (net.Conn, error) {
+		return nil, err
+	}
+}
+
+// DialSlow Waits d on the clock before connecting
+func DialSlow(clock common.Clock, d time.Duration) DialStep {
+	return func(network, address string) (net.Conn, error) {
+		clock.Sleep(d)
+		return net.Dial(network, address)
+	}
+}
+
+// DialReset Connects normally, but the connection is reset by the peer
+// once n bytes were written through it
+func DialReset(n int) DialStep {
+	return func(network, address string) (net.Conn, error) {
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &resetConn{Conn: conn, left: n}, nil
+	}
+}
+
+// resetConn Connection that fails with ECONNRESET after writing a number
+// of bytes
+type resetConn struct {
+	net.Conn
+	mu    sync.Mutex
+	left  int
+	reset bool
+}
+
+func (c *resetConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reset {
+		return 0, syscall.ECONNRESET
+	}
+	if len(b) <= c.left {
+		c.left -= len(b)
+		return c.Conn.Write(b)
+	}
+	n, _ := c.Conn.Write(b[:c.left])
+	c.left = 0
+	c.reset = true
+	c.Conn.Close()
+	return n, syscall.ECONNRESET
+}
+
+func (c *resetConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	reset := c.reset
+	c.mu.Unlock()
+	if reset {
+		return 0, syscall.ECONNRESET
+	}
+	return c.Conn.Read(b)
+}
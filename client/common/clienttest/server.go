@@ -0,0 +1,400 @@
+// Package clienttest provides a scriptable fake server to exercise
+// common.Client in unit tests without containers.
+//
+// Every accepted connection runs a Script, a list of steps such as
+// expecting a frame, replying, waiting or dropping the connection:
+//
+//	server := clienttest.NewServer(t, clienttest.Script{
+//		clienttest.ExpectFrame(common.MsgEcho),
+//		clienttest.ReplyEcho(),
+//	})
+//	client, _ := common.NewClient(clienttest.Config(server.Addr()))
+package clienttest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// Conn Connection accepted by the fake server
+type Conn struct {
+	net.Conn
+	// Last Last frame received with ExpectFrame
+	Last common.Frame
+	// Pings Heartbeats received from the client
+	Pings int
+	pings pingMode
+}
+
+// pingMode How the steps reading from the connection treat the heartbeats
+// of the client
+type pingMode int
+
+const (
+	// pingsExpected Heartbeats are read as any other frame
+	pingsExpected pingMode = iota
+	// pingsAnswered Heartbeats are answered and skipped
+	pingsAnswered
+	// pingsIgnored Heartbeats are skipped without an answer
+	pingsIgnored
+)
+
+// readFrame Reads the next frame, handling the heartbeats as configured
+func (c *Conn) readFrame() (common.Frame, error) {
+	for {
+		f, err := common.ReadFrame(c)
+		if err != nil || f.Type != common.MsgPing || c.pings == pingsExpected {
+			return f, err
+		}
+		c.Pings++
+		if c.pings == pingsAnswered {
+			if err := common.WriteFrame(c, common.Frame{Type: common.MsgPong, Payload: f.Payload}); err != nil {
+				return common.Frame{}, err
+			}
+		}
+	}
+}
+
+// Step Action performed by the fake server on a connection. Returning
+// errStop ends the script without reporting a failure
+type Step func(c *Conn) error
+
+// Script Steps run in order on a connection. The connection is closed
+// once every step ran
+type Script []Step
+
+var errStop = fmt.Errorf("script stopped")
+
+// Server Fake server listening on localhost
+type Server struct {
+	t        testing.TB
+	listener net.Listener
+	scripts  []Script
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	accepted int
+}
+
+// NewServer Starts a fake server. The i-th accepted connection runs the
+// i-th script, and connections beyond the last script run the last one
+// again. Failed steps are reported as test errors. The server is closed
+// when the test finishes
+func NewServer(t testing.TB, scripts ...Script) *Server {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{t: t, listener: listener, scripts: scripts}
+	t.Cleanup(s.Close)
+
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Addr Returns the address the server listens on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Accepted Returns the amount of connections accepted so far
+func (s *Server) Accepted() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+// Close Stops accepting connections and waits for the running scripts
+func (s *Server) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		i := s.accepted
+		s.accepted++
+		s.mu.Unlock()
+
+		if len(s.scripts) == 0 {
+			conn.Close()
+			continue
+		}
+		script := s.scripts[len(s.scripts)-1]
+		if i < len(s.scripts) {
+			script = s.scripts[i]
+		}
+		s.wg.Add(1)
+		go s.run(i, &Conn{Conn: conn}, script)
+	}
+}
+
+func (s *Server) run(i int, c *Conn, script Script) {
+	defer s.wg.Done()
+	defer c.Close()
+	for n, step := range script {
+		if err := step(c); err != nil {
+			if err != errStop {
+				s.t.Errorf("fake server: connection %v, step %v: %v", i, n, err)
+			}
+			return
+		}
+	}
+}
+
+// Expect Reads len(data) bytes and checks they match data
+func Expect(data []byte) Step {
+	return func(c *Conn) error {
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return err
+		}
+		if !bytes.Equal(buf, data) {
+			return fmt.Errorf("expected %q, got %q", data, buf)
+		}
+		return nil
+	}
+}
+
+// ExpectFrame Reads a frame and checks its type. The frame is kept in
+// Conn.Last for the following steps
+func ExpectFrame(t common.MessageType) Step {
+	return func(c *Conn) error {
+		f, err := c.readFrame()
+		if err != nil {
+			return err
+		}
+		if f.Type != t {
+			return fmt.Errorf("expected frame of type %v, got %v", t, f.Type)
+		}
+		c.Last = f
+		return nil
+	}
+}
+
+// ExpectEOF Waits for the client to close the connection
+func ExpectEOF() Step {
+	return func(c *Conn) error {
+		if c.pings != pingsExpected {
+			f, err := c.readFrame()
+			if err != io.EOF {
+				return fmt.Errorf("expected connection to be closed, got frame of type %v and %v", f.Type, err)
+			}
+			return nil
+		}
+		var buf [1]byte
+		if n, err := c.Read(buf[:]); err != io.EOF {
+			return fmt.Errorf("expected connection to be closed, got %v bytes and %v", n, err)
+		}
+		return nil
+	}
+}
+
+// Reply Writes raw bytes to the connection
+func Reply(data []byte) Step {
+	return func(c *Conn) error {
+		_, err := c.Write(data)
+		return err
+	}
+}
+
+// ReplyFrame Writes a frame to the connection
+func ReplyFrame(f common.Frame) Step {
+	return func(c *Conn) error {
+		return common.WriteFrame(c, f)
+	}
+}
+
+// ReplyEcho Writes back the last frame received
+func ReplyEcho() Step {
+	return func(c *Conn) error {
+		return common.WriteFrame(c, c.Last)
+	}
+}
+
+// ReplyAck Acknowledges the last batch received
+func ReplyAck() Step {
+	return func(c *Conn) error {
+		if c.Last.Type != common.MsgBatch || len(c.Last.Payload) < 4 {
+			return fmt.Errorf("last frame is not a batch")
+		}
+		ack := common.Ack{BatchID: binary.BigEndian.Uint32(c.Last.Payload)}
+		return common.WriteFrame(c, common.Frame{Type: common.MsgAck, Payload: common.EncodeAck(ack)})
+	}
+}
+
+// ReplyError Reports a server error for the last batch received, or for
+// no batch if the last frame was not one
+func ReplyError(code uint16, message string) Step {
+	return func(c *Conn) error {
+		serverErr := common.ServerError{Code: code, Message: message}
+		if c.Last.Type == common.MsgBatch && len(c.Last.Payload) >= 4 {
+			serverErr.BatchID = binary.BigEndian.Uint32(c.Last.Payload)
+		}
+		return common.WriteFrame(c, common.Frame{Type: common.MsgError, Payload: common.EncodeError(serverErr)})
+	}
+}
+
+// Push Sends an announcement to the client, as the server does on its own
+func Push(event common.PushEvent, message string) Step {
+	return func(c *Conn) error {
+		push := common.Push{Event: event, Message: message}
+		return common.WriteFrame(c, common.Frame{Type: common.MsgPush, Payload: common.EncodePush(push)})
+	}
+}
+
+// ExpectSilence Fails if the client sends anything within d
+func ExpectSilence(d time.Duration) Step {
+	return func(c *Conn) error {
+		if err := c.SetReadDeadline(time.Now().Add(d)); err != nil {
+			return err
+		}
+		defer c.SetReadDeadline(time.Time{})
+		f, err := c.readFrame()
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			return fmt.Errorf("expected no frames, got frame of type %v and %v", f.Type, err)
+		}
+		return nil
+	}
+}
+
+// Delay Waits before running the next step
+func Delay(d time.Duration) Step {
+	return func(c *Conn) error {
+		time.Sleep(d)
+		return nil
+	}
+}
+
+// Drop Closes the connection and ends the script
+func Drop() Step {
+	return func(c *Conn) error {
+		c.Close()
+		return errStop
+	}
+}
+
+// SendPartial Writes only the first n bytes of the frame and closes the
+// connection, simulating a server that dies in the middle of a reply
+func SendPartial(f common.Frame, n int) Step {
+	return func(c *Conn) error {
+		var buf bytes.Buffer
+		if err := common.WriteFrame(&buf, f); err != nil {
+			return err
+		}
+		if n > buf.Len() {
+			n = buf.Len()
+		}
+		if _, err := c.Write(buf.Bytes()[:n]); err != nil {
+			return err
+		}
+		c.Close()
+		return errStop
+	}
+}
+
+// Repeat Runs the steps n times
+func Repeat(n int, steps ...Step) Step {
+	return func(c *Conn) error {
+		for i := 0; i < n; i++ {
+			for _, step := range steps {
+				if err := step(c); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// Notify Closes the channel, letting the test know the script reached
+// this step
+func Notify(ch chan struct{}) Step {
+	return func(c *Conn) error {
+		close(ch)
+		return nil
+	}
+}
+
+// ExpectBatch Reads a batch frame and checks its ID. The frame is kept in
+// Conn.Last, so ReplyAck acknowledges it
+func ExpectBatch(id uint32) Step {
+	return func(c *Conn) error {
+		if err := ExpectFrame(common.MsgBatch)(c); err != nil {
+			return err
+		}
+		if len(c.Last.Payload) < 4 {
+			return fmt.Errorf("batch payload of %v bytes", len(c.Last.Payload))
+		}
+		if got := binary.BigEndian.Uint32(c.Last.Payload); got != id {
+			return fmt.Errorf("expected batch %v, got batch %v", id, got)
+		}
+		return nil
+	}
+}
+
+// ReplyAckOf Acknowledges the batch with the given ID, regardless of the
+// last frame received
+func ReplyAckOf(id uint32) Step {
+	return ReplyFrame(common.Frame{Type: common.MsgAck, Payload: common.EncodeAck(common.Ack{BatchID: id})})
+}
+
+// ReplyErrorOf Reports a server error for the batch with the given ID
+func ReplyErrorOf(id uint32, code uint16, message string) Step {
+	serverErr := common.ServerError{BatchID: id, Code: code, Message: message}
+	return ReplyFrame(common.Frame{Type: common.MsgError, Payload: common.EncodeError(serverErr)})
+}
+
+// ReplyBusy Asks the client to send the last batch received again after
+// the given delay, or the last request if it was not a batch
+func ReplyBusy(retryAfter time.Duration) Step {
+	return func(c *Conn) error {
+		busy := common.ServerBusy{RetryAfter: retryAfter}
+		if c.Last.Type == common.MsgBatch && len(c.Last.Payload) >= 4 {
+			busy.BatchID = binary.BigEndian.Uint32(c.Last.Payload)
+		}
+		return common.WriteFrame(c, common.Frame{Type: common.MsgBusy, Payload: common.EncodeBusy(busy)})
+	}
+}
+
+// ReplyBusyOf Asks the client to send the batch with the given ID again
+// after the given delay
+func ReplyBusyOf(id uint32, retryAfter time.Duration) Step {
+	busy := common.ServerBusy{BatchID: id, RetryAfter: retryAfter}
+	return ReplyFrame(common.Frame{Type: common.MsgBusy, Payload: common.EncodeBusy(busy)})
+}
+
+// AnswerPings Answers the heartbeats of the client from then on, without
+// handing them to the steps
+func AnswerPings() Step {
+	return func(c *Conn) error {
+		c.pings = pingsAnswered
+		return nil
+	}
+}
+
+// IgnorePings Skips the heartbeats of the client from then on without
+// answering them, as a server that hung would
+func IgnorePings() Step {
+	return func(c *Conn) error {
+		c.pings = pingsIgnored
+		return nil
+	}
+}
@@ -0,0 +1,58 @@
+package common
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// Clock Source of time of the client. Tests replace it to advance time
+// without waiting
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// Dialer Opens the connections to the server. Tests replace it to
+// simulate dial failures, slow connects and resets
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// SystemClock Clock backed by the time package
+type SystemClock struct{}
+
+// Now Returns the current time
+func (SystemClock) Now() time.Time { return time.Now() }
+
+// After Waits for the duration to elapse and then sends the current time
+func (SystemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Sleep Pauses the current goroutine for the duration
+func (SystemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// secureConn Completes the TLS handshake over a connection to a server,
+// if TLS is enabled
+func (c *Client) secureConn(conn net.Conn, address string) (net.Conn, error) {
+	if c.tlsConfig == nil {
+		return conn, nil
+	}
+
+	// As tls.Dial does, verify the host of the address unless a server
+	// name was configured
+	config := c.tlsConfig
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
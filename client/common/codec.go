@@ -0,0 +1,190 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Names of the supported bet codecs
+const (
+	CodecText   = "text"
+	CodecBinary = "binary"
+)
+
+// ErrMalformedBet Returned when an encoded bet cannot be decoded
+var ErrMalformedBet = errors.New("malformed bet")
+
+// BetCodec Wire format of the bets sent to the server
+type BetCodec interface {
+	// Name Returns the name announced in the handshake
+	Name() string
+	// AppendBet Appends the encoding of the bet to buf
+	AppendBet(buf []byte, bet Bet) ([]byte, error)
+	// DecodeBet Decodes the first bet of data, returning the amount of
+	// bytes it used
+	DecodeBet(data []byte) (Bet, int, error)
+}
+
+// NewBetCodec Returns the codec with the given name. An empty name
+// selects the text codec
+func NewBetCodec(name string) (BetCodec, error) {
+	switch name {
+	case "", CodecText:
+		return TextCodec{}, nil
+	case CodecBinary:
+		return BinaryCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown bet codec %q", name)
+}
+
+// TextCodec Encodes every bet as a line with its comma separated fields
+//
+//	agency,first name,last name,document,birthdate (YYYY-MM-DD),number\n
+type TextCodec struct{}
+
+// Name Returns the name of the codec
+func (TextCodec) Name() string {
+	return CodecText
+}
+
+// AppendBet Appends the bet line to buf. Names containing the separators
+// cannot be encoded
+func (TextCodec) AppendBet(buf []byte, bet Bet) ([]byte, error) {
+	if strings.ContainsAny(bet.FirstName, ",\n") || strings.ContainsAny(bet.LastName, ",\n") {
+		return buf, fmt.Errorf("bet names cannot contain commas or new lines")
+	}
+	buf = strconv.AppendInt(buf, int64(bet.Agency), 10)
+	buf = append(buf, ',')
+	buf = append(buf, bet.FirstName...)
+	buf = append(buf, ',')
+	buf = append(buf, bet.LastName...)
+	buf = append(buf, ',')
+	buf = strconv.AppendInt(buf, int64(bet.Document), 10)
+	buf = append(buf, ',')
+	buf = bet.Birthdate.AppendFormat(buf, BirthdateLayout)
+	buf = append(buf, ',')
+	buf = strconv.AppendInt(buf, int64(bet.Number), 10)
+	buf = append(buf, '\n')
+	return buf, nil
+}
+
+// DecodeBet Decodes the first bet line of data
+func (TextCodec) DecodeBet(data []byte) (Bet, int, error) {
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		return Bet{}, 0, ErrMalformedBet
+	}
+	fields := strings.Split(string(data[:end]), ",")
+	if len(fields) != betFields+1 {
+		return Bet{}, 0, ErrMalformedBet
+	}
+	agency, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return Bet{}, 0, ErrMalformedBet
+	}
+	bet, err := ParseBet(agency, fields[1:])
+	if err != nil {
+		return Bet{}, 0, errors.Wrap(ErrMalformedBet, err.Error())
+	}
+	return bet, end + 1, nil
+}
+
+// BinaryCodec Encodes every bet with fixed width integers and length
+// prefixed UTF-8 names
+//
+//	| agency (uint16) | document (uint32) | number (uint16) | birthdate (int32) |
+//	| first name length (uint8) | first name | last name length (uint8) | last name |
+//
+// where birthdate is the amount of days since the Unix epoch
+type BinaryCodec struct{}
+
+const binaryBetFixedSize = 2 + 4 + 2 + 4 + 1 + 1
+
+const secondsPerDay = 24 * 60 * 60
+
+// Name Returns the name of the codec
+func (BinaryCodec) Name() string {
+	return CodecBinary
+}
+
+// AppendBet Appends the binary encoding of the bet to buf. Values that do
+// not fit in their fixed width cannot be encoded
+func (BinaryCodec) AppendBet(buf []byte, bet Bet) ([]byte, error) {
+	if bet.Agency < 0 || bet.Agency > math.MaxUint16 {
+		return buf, fmt.Errorf("agency %v out of range", bet.Agency)
+	}
+	if bet.Document < 0 || int64(bet.Document) > math.MaxUint32 {
+		return buf, fmt.Errorf("document %v out of range", bet.Document)
+	}
+	if bet.Number < 0 || bet.Number > math.MaxUint16 {
+		return buf, fmt.Errorf("number %v out of range", bet.Number)
+	}
+	if len(bet.FirstName) > math.MaxUint8 || len(bet.LastName) > math.MaxUint8 {
+		return buf, fmt.Errorf("bet names cannot exceed %v bytes", math.MaxUint8)
+	}
+	if !utf8.ValidString(bet.FirstName) || !utf8.ValidString(bet.LastName) {
+		return buf, fmt.Errorf("bet names must be valid UTF-8")
+	}
+
+	var fixed [12]byte
+	binary.BigEndian.PutUint16(fixed[0:], uint16(bet.Agency))
+	binary.BigEndian.PutUint32(fixed[2:], uint32(bet.Document))
+	binary.BigEndian.PutUint16(fixed[6:], uint16(bet.Number))
+	binary.BigEndian.PutUint32(fixed[8:], uint32(int32(daysSinceEpoch(bet.Birthdate))))
+	buf = append(buf, fixed[:]...)
+	buf = append(buf, byte(len(bet.FirstName)))
+	buf = append(buf, bet.FirstName...)
+	buf = append(buf, byte(len(bet.LastName)))
+	buf = append(buf, bet.LastName...)
+	return buf, nil
+}
+
+// DecodeBet Decodes the first binary bet of data
+func (BinaryCodec) DecodeBet(data []byte) (Bet, int, error) {
+	if len(data) < binaryBetFixedSize {
+		return Bet{}, 0, ErrMalformedBet
+	}
+	bet := Bet{
+		Agency:    int(binary.BigEndian.Uint16(data[0:])),
+		Document:  int(binary.BigEndian.Uint32(data[2:])),
+		Number:    int(binary.BigEndian.Uint16(data[6:])),
+		Birthdate: dateFromDays(int32(binary.BigEndian.Uint32(data[8:]))),
+	}
+
+	offset := 12
+	names := [2]string{}
+	for i := range names {
+		if len(data) < offset+1 {
+			return Bet{}, 0, ErrMalformedBet
+		}
+		size := int(data[offset])
+		offset++
+		if len(data) < offset+size || !utf8.Valid(data[offset:offset+size]) {
+			return Bet{}, 0, ErrMalformedBet
+		}
+		names[i] = string(data[offset : offset+size])
+		offset += size
+	}
+	bet.FirstName, bet.LastName = names[0], names[1]
+	return bet, offset, nil
+}
+
+// daysSinceEpoch Returns the amount of days between the Unix epoch and
+// the date, which is negative for dates before 1970
+func daysSinceEpoch(date time.Time) int64 {
+	y, m, d := date.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / secondsPerDay
+}
+
+// dateFromDays Inverse of daysSinceEpoch
+func dateFromDays(days int32) time.Time {
+	return time.Unix(int64(days)*secondsPerDay, 0).UTC()
+}
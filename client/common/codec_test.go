@@ -0,0 +1,170 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+var sampleFirstNames = []string{"Santiago Lionel", "Agustin Emanuel", "Tiago Nicolás", "María José", "Ana"}
+var sampleLastNames = []string{"Lorca", "Zambrano", "Rivera", "Fernández", "Di Lorenzo"}
+
+// sampleBets Returns n deterministic bets resembling the agency datasets
+func sampleBets(n int) []Bet {
+	bets := make([]Bet, n)
+	for i := range bets {
+		bets[i] = Bet{
+			Agency:    1 + i%5,
+			FirstName: sampleFirstNames[i%len(sampleFirstNames)],
+			LastName:  sampleLastNames[(i/3)%len(sampleLastNames)],
+			Document:  20000000 + (i*7919)%20000000,
+			Birthdate: time.Date(1940+i%70, time.Month(1+i%12), 1+i%28, 0, 0, 0, 0, time.UTC),
+			Number:    (i * 31) % 10000,
+		}
+	}
+	return bets
+}
+
+func assertEqualBets(t *testing.T, expected Bet, got Bet) {
+	t.Helper()
+	if expected.Agency != got.Agency || expected.FirstName != got.FirstName ||
+		expected.LastName != got.LastName || expected.Document != got.Document ||
+		!expected.Birthdate.Equal(got.Birthdate) || expected.Number != got.Number {
+		t.Fatalf("expected bet %+v, got %+v", expected, got)
+	}
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	for _, codec := range []BetCodec{TextCodec{}, BinaryCodec{}} {
+		var buf []byte
+		bets := sampleBets(50)
+		for _, bet := range bets {
+			var err error
+			if buf, err = codec.AppendBet(buf, bet); err != nil {
+				t.Fatalf("%v: %v", codec.Name(), err)
+			}
+		}
+		for _, expected := range bets {
+			got, n, err := codec.DecodeBet(buf)
+			if err != nil {
+				t.Fatalf("%v: %v", codec.Name(), err)
+			}
+			assertEqualBets(t, expected, got)
+			buf = buf[n:]
+		}
+		if len(buf) != 0 {
+			t.Fatalf("%v: %v bytes left after decoding", codec.Name(), len(buf))
+		}
+	}
+}
+
+func TestBinaryCodecRejectsValuesOutOfRange(t *testing.T) {
+	bet := sampleBets(1)[0]
+	bet.Number = 70000
+	if _, err := (BinaryCodec{}).AppendBet(nil, bet); err == nil {
+		t.Fatal("expected number above uint16 to be rejected")
+	}
+}
+
+func TestBatcherRespectsAmountAndSize(t *testing.T) {
+	bets := sampleBets(1000)
+	for _, maxSize := range []int{200, 8000} {
+		batcher := NewBatcher(BinaryCodec{}, 100, maxSize)
+		var batches []*EncodedBatch
+		for _, bet := range bets {
+			batch, err := batcher.Add(bet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if batch != nil {
+				batches = append(batches, batch)
+			}
+		}
+		if batch := batcher.Flush(); batch != nil {
+			batches = append(batches, batch)
+		}
+
+		total := 0
+		for i, batch := range batches {
+			if batch.ID != uint32(i+1) || batch.Count > 100 || len(batch.Payload) > maxSize {
+				t.Fatalf("batch %v exceeds limits: id %v, count %v, size %v", i, batch.ID, batch.Count, len(batch.Payload))
+			}
+			id, decoded, err := DecodeBatch(BinaryCodec{}, batch.Payload)
+			if err != nil || id != batch.ID || len(decoded) != batch.Count {
+				t.Fatalf("batch %v could not be decoded: %v", batch.ID, err)
+			}
+			for j, bet := range decoded {
+				assertEqualBets(t, bets[total+j], bet)
+			}
+			total += batch.Count
+		}
+		if total != len(bets) {
+			t.Fatalf("expected %v bets in batches, got %v", len(bets), total)
+		}
+	}
+}
+
+func benchmarkEncode(b *testing.B, codec BetCodec) {
+	bets := sampleBets(1000)
+	buf := make([]byte, 0, 64*1024)
+	size := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf = buf[:0]
+		for _, bet := range bets {
+			buf, _ = codec.AppendBet(buf, bet)
+		}
+		size = len(buf)
+	}
+	b.ReportMetric(float64(size)/float64(len(bets)), "bytes/bet")
+}
+
+func benchmarkDecode(b *testing.B, codec BetCodec) {
+	bets := sampleBets(1000)
+	var buf []byte
+	for _, bet := range bets {
+		buf, _ = codec.AppendBet(buf, bet)
+	}
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data := buf
+		for len(data) > 0 {
+			_, n, err := codec.DecodeBet(data)
+			if err != nil {
+				b.Fatal(err)
+			}
+			data = data[n:]
+		}
+	}
+	b.ReportMetric(float64(len(buf))/float64(len(bets)), "bytes/bet")
+}
+
+func BenchmarkTextCodecEncode(b *testing.B)   { benchmarkEncode(b, TextCodec{}) }
+func BenchmarkBinaryCodecEncode(b *testing.B) { benchmarkEncode(b, BinaryCodec{}) }
+func BenchmarkTextCodecDecode(b *testing.B)   { benchmarkDecode(b, TextCodec{}) }
+func BenchmarkBinaryCodecDecode(b *testing.B) { benchmarkDecode(b, BinaryCodec{}) }
+
+// BenchmarkBetsPerBatch Reports how many bets fit in a batch of the
+// maximum size of an unsigned frame with each codec
+func BenchmarkBetsPerBatch(b *testing.B) {
+	for _, codec := range []BetCodec{TextCodec{}, BinaryCodec{}} {
+		b.Run(codec.Name(), func(b *testing.B) {
+			bets := sampleBets(10000)
+			var first *EncodedBatch
+			for i := 0; i < b.N; i++ {
+				batcher := NewBatcher(codec, 0, MaxBatchPayload(false, ""))
+				first = nil
+				for _, bet := range bets {
+					if batch, _ := batcher.Add(bet); batch != nil {
+						first = batch
+						break
+					}
+				}
+			}
+			if first == nil {
+				b.Fatalf("no batch was filled with %v bets", len(bets))
+			}
+			b.ReportMetric(float64(first.Count), "bets/batch")
+		})
+	}
+}
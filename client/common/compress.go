@@ -0,0 +1,137 @@
+package common
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Supported payload compression algorithms
+const (
+	CompressionNone  = "none"
+	CompressionGzip  = "gzip"
+	CompressionFlate = "flate"
+)
+
+// maxDecompressedSize Upper bound of a decompressed payload, so that a
+// hostile peer cannot make the client allocate without limit
+const maxDecompressedSize = 64 * 1024
+
+// ErrDecompressedTooLarge Returned when a payload expands beyond
+// maxDecompressedSize
+var ErrDecompressedTooLarge = errors.New("decompressed payload exceeds maximum size")
+
+// CompressionConfig Configuration of the payload compression. Payloads
+// smaller than Threshold bytes are always sent uncompressed
+type CompressionConfig struct {
+	Algorithm string
+	Threshold int
+}
+
+// Enabled Checks if compression has to be offered to the server
+func (c CompressionConfig) Enabled() bool {
+	return c.Algorithm != "" && c.Algorithm != CompressionNone
+}
+
+// ValidateCompression Checks that the algorithm is supported
+func ValidateCompression(algorithm string) error {
+	switch algorithm {
+	case "", CompressionNone, CompressionGzip, CompressionFlate:
+		return nil
+	}
+	return fmt.Errorf("unknown compression algorithm %q", algorithm)
+}
+
+// compress Compresses the payload with the given algorithm
+func compress(algorithm string, payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch algorithm {
+	case CompressionGzip:
+		w = gzip.NewWriter(&buf)
+	case CompressionFlate:
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		w = fw
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %q", algorithm)
+	}
+
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress Decompresses the payload with the given algorithm, failing
+// if the result exceeds maxDecompressedSize
+func decompress(algorithm string, payload []byte) ([]byte, error) {
+	var r io.ReadCloser
+	switch algorithm {
+	case CompressionGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		r = gr
+	case CompressionFlate:
+		r = flate.NewReader(bytes.NewReader(payload))
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %q", algorithm)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxDecompressedSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	return data, nil
+}
+
+// CompressionStats Accumulated sizes of the payloads that went through
+// compression, used to report the achieved ratio. It is safe for
+// concurrent use
+type CompressionStats struct {
+	mu        sync.Mutex
+	frames    int
+	rawBytes  int
+	wireBytes int
+}
+
+// add Records a payload of rawSize bytes that was sent as wireSize bytes
+func (s *CompressionStats) add(rawSize int, wireSize int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frames++
+	s.rawBytes += rawSize
+	s.wireBytes += wireSize
+}
+
+// Snapshot Returns the amount of compressed frames, their original size
+// and their size on the wire
+func (s *CompressionStats) Snapshot() (frames int, rawBytes int, wireBytes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.frames, s.rawBytes, s.wireBytes
+}
+
+// compressionRatio Returns rawBytes/wireBytes, or 1 if nothing was sent
+func compressionRatio(rawBytes int, wireBytes int) float64 {
+	if wireBytes == 0 {
+		return 1
+	}
+	return float64(rawBytes) / float64(wireBytes)
+}
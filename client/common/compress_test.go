@@ -0,0 +1,87 @@
+package common
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	payload := []byte(strings.Repeat("1,Santiago Lionel,Lorca,30904465,1999-03-17,7574\n", 50))
+	for _, algorithm := range []string{CompressionGzip, CompressionFlate} {
+		compressed, err := compress(algorithm, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(compressed) >= len(payload) {
+			t.Fatalf("%v: expected repetitive payload to shrink, got %v bytes", algorithm, len(compressed))
+		}
+		decompressed, err := decompress(algorithm, compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload, decompressed) {
+			t.Fatalf("%v: round trip mismatch", algorithm)
+		}
+	}
+}
+
+func TestDecompressRejectsPayloadsExpandingBeyondLimit(t *testing.T) {
+	bomb, err := compress(CompressionGzip, make([]byte, maxDecompressedSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decompress(CompressionGzip, bomb); !errors.Is(err, ErrDecompressedTooLarge) {
+		t.Fatalf("expected oversized payload to be rejected, got %v", err)
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	if got := negotiateCompression([]string{CompressionGzip}, []string{CompressionGzip}); got != CompressionGzip {
+		t.Fatalf("expected gzip, got %v", got)
+	}
+	if got := negotiateCompression([]string{CompressionGzip}, nil); got != CompressionNone {
+		t.Fatalf("expected no compression when server declines, got %v", got)
+	}
+	if got := negotiateCompression([]string{CompressionGzip}, []string{CompressionFlate}); got != CompressionNone {
+		t.Fatalf("expected no compression when server answers outside the offer, got %v", got)
+	}
+}
+
+func TestFrameConnCompressesOnlyAboveThreshold(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	var stats CompressionStats
+	sender := newFrameConn(client, NewSigner([]byte("secret"), "1"), &stats, SystemClock{})
+	sender.compression = CompressionFlate
+	sender.threshold = 100
+	receiver := newFrameConn(server, NewServerSigner([]byte("secret"), "1"), &CompressionStats{}, SystemClock{})
+	receiver.compression = CompressionFlate
+
+	small := []byte("short")
+	large := []byte(strings.Repeat("compressible ", 100))
+	go func() {
+		sender.send(Frame{Type: MsgEcho, Payload: small})
+		sender.send(Frame{Type: MsgEcho, Payload: large})
+	}()
+
+	for _, expected := range [][]byte{small, large} {
+		f, err := receiver.receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(f.Payload, expected) {
+			t.Fatalf("expected payload %q, got %q", expected, f.Payload)
+		}
+	}
+
+	frames, rawBytes, wireBytes := stats.Snapshot()
+	if frames != 1 || rawBytes != len(large) || wireBytes >= rawBytes {
+		t.Fatalf("unexpected stats: frames %v, raw %v, wire %v", frames, rawBytes, wireBytes)
+	}
+}
@@ -0,0 +1,220 @@
+package common
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// frameConn Connection with the server that exchanges frames, applying
+// the settings negotiated for it in the handshake. Outgoing payloads are
+// compressed and then signed, so incoming ones are verified before being
+// decompressed.
+//
+// Once the handshake is completed, start hands the connection to a reader
+// goroutine that demultiplexes the incoming frames: heartbeats and pushes
+// are handled there, and only replies reach receive, so they keep matching
+// the requests in flight
+type frameConn struct {
+	net.Conn
+	signer      *Signer
+	compression string
+	threshold   int
+	stats       *CompressionStats
+	codec       BetCodec
+	// clock Measures the read and write timeouts
+	clock Clock
+	// resumed Set if the connection resumed a session, in which the server
+	// stored every batch up to lastBatch
+	resumed   bool
+	lastBatch uint32
+	// skewErr Error time-sensitive messages are refused with, if the
+	// server clock is too far off
+	skewErr error
+	// readTimeout and writeTimeout Limits on each frame exchanged, if
+	// positive
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	// writeMu Serializes the frames written by the client and by the
+	// reader and heartbeat goroutines
+	writeMu sync.Mutex
+
+	// replies Frames read by the reader goroutine, closed with readErr
+	// once the connection fails. nil until start is called
+	replies chan Frame
+	readErr error
+	done    chan struct{}
+	once    sync.Once
+
+	heartbeat *heartbeat
+	// onPush Called by the reader goroutine with every push received
+	onPush func(Frame)
+}
+
+// newFrameConn Wraps a connection. Compression stays disabled and bets
+// use the text codec until something else is negotiated
+func newFrameConn(conn net.Conn, signer *Signer, stats *CompressionStats, clock Clock) *frameConn {
+	return &frameConn{
+		Conn:        conn,
+		clock:       clock,
+		signer:      signer,
+		compression: CompressionNone,
+		stats:       stats,
+		codec:       TextCodec{},
+		done:        make(chan struct{}),
+	}
+}
+
+// start Starts the reader goroutine, and the heartbeat one if heartbeats
+// are configured. The connection settings cannot change afterwards
+func (fc *frameConn) start(hb *heartbeat, onPush func(Frame)) {
+	fc.replies = make(chan Frame)
+	fc.heartbeat = hb
+	fc.onPush = onPush
+	go fc.readFrames()
+	if hb != nil {
+		go hb.run(fc)
+	}
+}
+
+// Close Closes the connection and stops its goroutines
+func (fc *frameConn) Close() error {
+	fc.once.Do(func() { close(fc.done) })
+	return fc.Conn.Close()
+}
+
+// send Writes a frame to the connection, compressing its payload if it
+// reaches the threshold and signing it if an HMAC secret is configured.
+// Writes that exceed the write timeout fail with a TimeoutError
+func (fc *frameConn) send(f Frame) error {
+	if fc.compression != CompressionNone && len(f.Payload) >= fc.threshold {
+		compressed, err := compress(fc.compression, f.Payload)
+		if err != nil {
+			return err
+		}
+		// Payloads that do not shrink are sent as they are
+		if len(compressed) < len(f.Payload) {
+			fc.stats.add(len(f.Payload), len(compressed))
+			log.Debugf("action: compress_payload | result: success | algorithm: %v | size: %v | compressed_size: %v | ratio: %.2f",
+				fc.compression,
+				len(f.Payload),
+				len(compressed),
+				compressionRatio(len(f.Payload), len(compressed)),
+			)
+			f.Payload = compressed
+			f.Flags |= FlagCompressed
+		}
+	}
+
+	fc.writeMu.Lock()
+	defer fc.writeMu.Unlock()
+	if err := fc.failure(nil); err != nil {
+		return err
+	}
+	// Signing under the lock keeps the sequences in the order written
+	if fc.signer != nil {
+		f = fc.signer.Seal(f)
+	}
+	w := watch(fc.clock, fc.writeTimeout, "write", fc.Conn.SetWriteDeadline)
+	return w.stop(WriteFrame(fc.Conn, f))
+}
+
+// receive Returns the next reply from the server. If an HMAC secret is
+// configured, frames that fail verification are rejected. Waits that
+// exceed the read timeout fail with a TimeoutError
+func (fc *frameConn) receive() (Frame, error) {
+	if fc.replies == nil {
+		w := watch(fc.clock, fc.readTimeout, "read", fc.Conn.SetReadDeadline)
+		f, err := fc.readFrame()
+		return f, w.stop(err)
+	}
+
+	var timeout <-chan time.Time
+	if fc.readTimeout > 0 {
+		timeout = fc.clock.After(fc.readTimeout)
+	}
+	select {
+	case f, ok := <-fc.replies:
+		if !ok {
+			return Frame{}, fc.readErr
+		}
+		return f, nil
+	case <-timeout:
+		return Frame{}, &TimeoutError{Op: "read", After: fc.readTimeout, Err: os.ErrDeadlineExceeded}
+	}
+}
+
+// readFrame Reads, verifies and decompresses a frame from the connection
+func (fc *frameConn) readFrame() (Frame, error) {
+	f, err := ReadFrame(fc.Conn)
+	if err != nil {
+		return Frame{}, err
+	}
+	if fc.signer != nil {
+		if f, err = fc.signer.Open(f); err != nil {
+			return Frame{}, err
+		}
+	}
+	if f.Flags&FlagCompressed != 0 {
+		payload, err := decompress(fc.compression, f.Payload)
+		if err != nil {
+			return Frame{}, err
+		}
+		f.Payload = payload
+		f.Flags &^= FlagCompressed
+	}
+	return f, nil
+}
+
+// readFrames Reads the frames of the connection until it fails or is
+// closed. Pings are answered, pushes dispatched and every frame proves the
+// server alive, but only the rest of the frames are handed to receive
+func (fc *frameConn) readFrames() {
+	defer close(fc.replies)
+	for {
+		f, err := fc.readFrame()
+		if err != nil {
+			fc.readErr = fc.failure(err)
+			return
+		}
+		if fc.heartbeat != nil {
+			fc.heartbeat.alive()
+		}
+
+		switch f.Type {
+		case MsgPing:
+			pong := Frame{Type: MsgPong, Payload: f.Payload, RequestID: f.RequestID, TraceParent: f.TraceParent}
+			if err := fc.send(pong); err != nil {
+				fc.readErr = err
+				return
+			}
+			continue
+		case MsgPong:
+			continue
+		case MsgPush:
+			fc.onPush(f)
+			continue
+		}
+		select {
+		case fc.replies <- f:
+		case <-fc.done:
+			fc.readErr = fc.failure(net.ErrClosed)
+			return
+		}
+	}
+}
+
+// failure Returns the error a connection failed with. If the heartbeat
+// closed it, the server is reported dead rather than the connection closed
+func (fc *frameConn) failure(err error) error {
+	if fc.heartbeat != nil {
+		if deadErr := fc.heartbeat.deadErr(); deadErr != nil {
+			return deadErr
+		}
+	}
+	return err
+}
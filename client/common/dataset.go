@@ -0,0 +1,99 @@
+package common
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Dataset Reader of the bet records of an agency. Records are read from a
+// CSV file, or from a CSV entry of a zip archive such as the one provided
+// in .data/dataset.zip
+type Dataset struct {
+	closer io.Closer
+	reader *csv.Reader
+	line   int
+}
+
+// DatasetEntry Returns the name of the dataset of an agency inside the
+// zip archive
+func DatasetEntry(agencyID string) string {
+	return fmt.Sprintf("agency-%v.csv", agencyID)
+}
+
+// OpenDataset Opens the dataset at path. If path is a zip archive, the
+// records are read from the given entry
+func OpenDataset(path string, entry string) (*Dataset, error) {
+	if !strings.HasSuffix(path, ".zip") {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not open dataset %v", path)
+		}
+		return newDataset(file, file), nil
+	}
+
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not open dataset archive %v", path)
+	}
+	for _, file := range archive.File {
+		if file.Name != entry {
+			continue
+		}
+		r, err := file.Open()
+		if err != nil {
+			archive.Close()
+			return nil, errors.Wrapf(err, "Could not open entry %v of %v", entry, path)
+		}
+		return newDataset(r, multiCloser{r, archive}), nil
+	}
+	archive.Close()
+	return nil, fmt.Errorf("entry %v not found in dataset archive %v", entry, path)
+}
+
+func newDataset(r io.Reader, closer io.Closer) *Dataset {
+	reader := csv.NewReader(r)
+	// The amount of fields is validated per record, so that a malformed
+	// row does not stop the whole dataset
+	reader.FieldsPerRecord = -1
+	return &Dataset{closer: closer, reader: reader}
+}
+
+// Read Returns the next record of the dataset, or io.EOF once every
+// record was read
+func (d *Dataset) Read() ([]string, error) {
+	record, err := d.reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	d.line, _ = d.reader.FieldPos(0)
+	return record, nil
+}
+
+// Line Returns the line of the last record returned by Read
+func (d *Dataset) Line() int {
+	return d.line
+}
+
+// Close Releases the files used by the dataset
+func (d *Dataset) Close() error {
+	return d.closer.Close()
+}
+
+// multiCloser Closes every closer in order, returning the first error
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var first error
+	for _, c := range m {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Policies applied to duplicate bets, that is bets of the same agency with
+// the same document and number
+const (
+	// DuplicatesSend Sends duplicate bets as any other bet
+	DuplicatesSend = "send"
+	// DuplicatesDrop Sends only the first of the duplicate bets
+	DuplicatesDrop = "drop"
+	// DuplicatesFail Aborts the upload on the first duplicate bet
+	DuplicatesFail = "fail"
+)
+
+// DefaultDuplicatesCapacity Amount of bets tracked by default, about 40 MiB
+const DefaultDuplicatesCapacity = 1 << 20
+
+// ErrDuplicateBet Returned by the fail policy when a duplicate bet is found
+var ErrDuplicateBet = errors.New("duplicate bet")
+
+// ValidateDuplicatesPolicy Checks if the duplicates policy is supported.
+// An empty policy is the same as DuplicatesSend
+func ValidateDuplicatesPolicy(policy string) error {
+	switch policy {
+	case "", DuplicatesSend, DuplicatesDrop, DuplicatesFail:
+		return nil
+	}
+	return fmt.Errorf("unsupported duplicates policy %q", policy)
+}
+
+// DuplicateDetector Detects bets already seen in a dataset. At most
+// capacity bets are tracked, so that memory stays bounded on any dataset:
+// once it is full, bets not tracked yet are not detected as duplicates
+type DuplicateDetector struct {
+	seen     map[uint64]struct{}
+	capacity int
+}
+
+// NewDuplicateDetector Creates a detector tracking at most capacity bets.
+// If capacity is not positive, DefaultDuplicatesCapacity is used
+func NewDuplicateDetector(capacity int) *DuplicateDetector {
+	if capacity <= 0 {
+		capacity = DefaultDuplicatesCapacity
+	}
+	return &DuplicateDetector{seen: make(map[uint64]struct{}), capacity: capacity}
+}
+
+// duplicateKey Packs the document and number of a valid bet in a single
+// key. Numbers are below MaxNumber+1, so different bets never collide
+func duplicateKey(bet Bet) uint64 {
+	return uint64(bet.Document)*(MaxNumber+1) + uint64(bet.Number)
+}
+
+// Seen Records the bet and checks if a bet with the same document and
+// number was recorded before
+func (d *DuplicateDetector) Seen(bet Bet) bool {
+	key := duplicateKey(bet)
+	if _, ok := d.seen[key]; ok {
+		return true
+	}
+	if len(d.seen) < d.capacity {
+		d.seen[key] = struct{}{}
+	}
+	return false
+}
+
+// Capacity Returns the maximum amount of bets tracked
+func (d *DuplicateDetector) Capacity() int {
+	return d.capacity
+}
+
+// Full Checks if the detector reached its capacity
+func (d *DuplicateDetector) Full() bool {
+	return len(d.seen) >= d.capacity
+}
@@ -0,0 +1,32 @@
+package common
+
+import "testing"
+
+func TestDuplicateDetectorIsBounded(t *testing.T) {
+	detector := NewDuplicateDetector(2)
+	first := Bet{Document: 30904465, Number: 7574}
+	second := Bet{Document: 30904465, Number: 15}
+	third := Bet{Document: 24543210, Number: 7574}
+
+	if detector.Seen(first) || detector.Seen(second) {
+		t.Fatal("expected new bets not to be duplicates")
+	}
+	if !detector.Seen(first) || !detector.Seen(second) {
+		t.Fatal("expected repeated bets to be duplicates")
+	}
+	// The detector is full, so the third bet is not tracked
+	if !detector.Full() || detector.Seen(third) || detector.Seen(third) {
+		t.Fatal("expected bets beyond the capacity not to be tracked")
+	}
+}
+
+func TestValidateDuplicatesPolicy(t *testing.T) {
+	for _, policy := range []string{"", DuplicatesSend, DuplicatesDrop, DuplicatesFail} {
+		if err := ValidateDuplicatesPolicy(policy); err != nil {
+			t.Fatalf("expected policy %q to be valid: %v", policy, err)
+		}
+	}
+	if err := ValidateDuplicatesPolicy("ignore"); err == nil {
+		t.Fatal("expected unknown policy to be rejected")
+	}
+}
@@ -0,0 +1,184 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Frames are the unit exchanged with the server. Every frame is encoded as
+//
+//	| length (uint32) | type (uint8) | flags (uint8) | payload |
+//
+// where length counts every byte after the length field itself. All
+// integers in the protocol are big endian.
+//
+// Frames with FlagContext carry the context of the request between the
+// flags and the payload:
+//
+//	| request id (uint64) | trace parent length (uint8) | trace parent |
+//
+// The request ID is chosen by the client and echoed by the server in the
+// reply, so that both sides log the same ID for an exchange. The trace
+// parent, if any, is a W3C traceparent header. The MAC of a signed frame
+// covers its context, so it cannot be rewritten on the way.
+
+// MessageType Kind of message carried by a frame
+type MessageType uint8
+
+const (
+	// MsgEcho Message that the server answers with the same payload
+	MsgEcho MessageType = 1
+	// MsgHello Handshake message, see Hello
+	MsgHello MessageType = 2
+	// MsgBatch Batch of bets, see Batcher
+	MsgBatch MessageType = 3
+	// MsgAck Acknowledgement of a batch stored by the server
+	MsgAck MessageType = 4
+	// MsgError Error reported by the server, see ServerError
+	MsgError MessageType = 5
+	// MsgDone Notification that the agency finished sending its bets
+	MsgDone MessageType = 6
+	// MsgWinnersQuery Query of the winners of the agency
+	MsgWinnersQuery MessageType = 7
+	// MsgWinners Documents of the winners of the agency
+	MsgWinners MessageType = 8
+	// MsgBusy Reply to a request the server is too busy to handle, see
+	// ServerBusy
+	MsgBusy MessageType = 9
+	// MsgPing Heartbeat, answered with a MsgPong carrying the same payload.
+	// Either side may send it at any time
+	MsgPing MessageType = 10
+	// MsgPong Answer to a MsgPing
+	MsgPong MessageType = 11
+	// MsgPush Announcement sent by the server on its own rather than as a
+	// reply, see Push
+	MsgPush MessageType = 12
+)
+
+// Frame flags
+const (
+	// FlagSigned The payload is wrapped in an HMAC envelope (see Signer)
+	FlagSigned uint8 = 1 << 0
+	// FlagCompressed The payload is compressed with the algorithm negotiated
+	// for the connection
+	FlagCompressed uint8 = 1 << 1
+	// FlagContext The frame carries a request ID and a trace parent
+	FlagContext uint8 = 1 << 2
+)
+
+const (
+	frameLengthSize  = 4
+	frameHeaderSize  = 2
+	frameContextSize = 8 + 1
+	// maxTraceParentSize Length of a traceparent of version 00, the only
+	// one sent
+	maxTraceParentSize = 55
+	// MaxFrameSize Maximum amount of bytes of a frame, length field included
+	MaxFrameSize = 8 * 1024
+)
+
+// ErrFrameTooLarge Returned when a frame exceeds MaxFrameSize
+var ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+
+// Frame Message exchanged with the server
+type Frame struct {
+	Type    MessageType
+	Flags   uint8
+	Payload []byte
+	// RequestID and TraceParent Context of the request, sent if any of
+	// them is set or FlagContext is
+	RequestID   uint64
+	TraceParent string
+}
+
+// WriteFrame Encodes the frame and writes it completely to w, retrying
+// on short writes
+func WriteFrame(w io.Writer, f Frame) error {
+	if f.RequestID != 0 || f.TraceParent != "" {
+		f.Flags |= FlagContext
+	}
+	header := frameHeaderSize
+	if f.Flags&FlagContext != 0 {
+		if len(f.TraceParent) > math.MaxUint8 {
+			return fmt.Errorf("trace parent of %v bytes is too long", len(f.TraceParent))
+		}
+		header += frameContextSize + len(f.TraceParent)
+	}
+	size := frameLengthSize + header + len(f.Payload)
+	if size > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf, uint32(header+len(f.Payload)))
+	buf[frameLengthSize] = byte(f.Type)
+	buf[frameLengthSize+1] = f.Flags
+	copy(buf[frameLengthSize+frameHeaderSize:], encodeContext(f))
+	copy(buf[frameLengthSize+header:], f.Payload)
+
+	for written := 0; written < len(buf); {
+		n, err := w.Write(buf[written:])
+		if err != nil {
+			return err
+		}
+		written += n
+	}
+	return nil
+}
+
+// encodeContext Returns the context of the frame as it is written, or nil
+// if FlagContext is not set
+func encodeContext(f Frame) []byte {
+	if f.Flags&FlagContext == 0 {
+		return nil
+	}
+	context := make([]byte, frameContextSize+len(f.TraceParent))
+	binary.BigEndian.PutUint64(context, f.RequestID)
+	context[8] = uint8(len(f.TraceParent))
+	copy(context[frameContextSize:], f.TraceParent)
+	return context
+}
+
+// ReadFrame Reads a complete frame from r, retrying on short reads. The
+// length header is validated before allocating the frame buffer
+func ReadFrame(r io.Reader) (Frame, error) {
+	var lengthBuf [frameLengthSize]byte
+	if _, err := io.ReadFull(r, lengthBuf[:]); err != nil {
+		return Frame{}, err
+	}
+
+	length := binary.BigEndian.Uint32(lengthBuf[:])
+	if length < frameHeaderSize {
+		return Frame{}, fmt.Errorf("invalid frame length %v", length)
+	}
+	if length > MaxFrameSize-frameLengthSize {
+		return Frame{}, ErrFrameTooLarge
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+	f := Frame{
+		Type:    MessageType(buf[0]),
+		Flags:   buf[1],
+		Payload: buf[frameHeaderSize:],
+	}
+	if f.Flags&FlagContext != 0 {
+		context := f.Payload
+		if len(context) < frameContextSize || len(context) < frameContextSize+int(context[8]) {
+			return Frame{}, fmt.Errorf("invalid frame context")
+		}
+		f.RequestID = binary.BigEndian.Uint64(context)
+		f.TraceParent = string(context[frameContextSize : frameContextSize+int(context[8])])
+		f.Payload = context[frameContextSize+int(context[8]):]
+	}
+	return f, nil
+}
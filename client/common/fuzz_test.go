@@ -0,0 +1,150 @@
+package common
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// The seed corpus of every target lives in testdata/fuzz. Run a target
+// with: go test ./client/common -run '^$' -fuzz FuzzReadFrame
+
+func FuzzReadFrame(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frame, err := ReadFrame(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if len(frame.Payload) > MaxFrameSize {
+			t.Fatalf("payload of %v bytes exceeds the maximum frame size", len(frame.Payload))
+		}
+		var buf bytes.Buffer
+		if err := WriteFrame(&buf, frame); err != nil {
+			t.Fatalf("decoded frame could not be encoded: %v", err)
+		}
+		if !bytes.Equal(buf.Bytes(), data[:buf.Len()]) {
+			t.Fatalf("round trip mismatch: %x != %x", buf.Bytes(), data[:buf.Len()])
+		}
+	})
+}
+
+func FuzzDecodeAck(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ack, err := DecodeAck(data)
+		if err != nil {
+			return
+		}
+		if encoded := EncodeAck(ack); !bytes.Equal(encoded, data) {
+			t.Fatalf("round trip mismatch: %x != %x", encoded, data)
+		}
+	})
+}
+
+func FuzzDecodeError(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		serverErr, err := DecodeError(data)
+		if err != nil {
+			return
+		}
+		if encoded := EncodeError(*serverErr); !bytes.Equal(encoded, data) {
+			t.Fatalf("round trip mismatch: %x != %x", encoded, data)
+		}
+	})
+}
+
+func FuzzDecodeBusy(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		busy, err := DecodeBusy(data)
+		if err != nil {
+			return
+		}
+		if encoded := EncodeBusy(*busy); !bytes.Equal(encoded, data) {
+			t.Fatalf("round trip mismatch: %x != %x", encoded, data)
+		}
+	})
+}
+
+func FuzzDecodePush(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		push, err := DecodePush(data)
+		if err != nil {
+			return
+		}
+		if encoded := EncodePush(push); !bytes.Equal(encoded, data) {
+			t.Fatalf("round trip mismatch: %x != %x", encoded, data)
+		}
+	})
+}
+
+func FuzzDecodeWinners(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		winners, err := DecodeWinners(data)
+		if err != nil {
+			return
+		}
+		if encoded := EncodeWinners(winners); !bytes.Equal(encoded, data) {
+			t.Fatalf("round trip mismatch: %x != %x", encoded, data)
+		}
+	})
+}
+
+func FuzzDecodeHello(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		hello, err := DecodeHello(data)
+		if err != nil {
+			return
+		}
+		again, err := DecodeHello(hello.Encode())
+		if err != nil {
+			t.Fatalf("encoded hello could not be decoded: %v", err)
+		}
+		if !reflect.DeepEqual(hello, again) {
+			t.Fatalf("round trip mismatch: %+v != %+v", hello, again)
+		}
+	})
+}
+
+func FuzzDecodeBatch(f *testing.F) {
+	f.Fuzz(func(t *testing.T, binaryCodec bool, data []byte) {
+		var codec BetCodec = TextCodec{}
+		if binaryCodec {
+			codec = BinaryCodec{}
+		}
+		id, bets, err := DecodeBatch(codec, data)
+		if err != nil {
+			return
+		}
+
+		batcher := NewBatcher(codec, len(bets), len(data)+batchHeaderSize)
+		batcher.nextID = id
+		for _, bet := range bets {
+			if full, err := batcher.Add(bet); err != nil || full != nil {
+				t.Fatalf("decoded bet %+v could not be encoded in a single batch: %v", bet, err)
+			}
+		}
+		batch := batcher.Flush()
+		if batch == nil {
+			if len(bets) != 0 {
+				t.Fatal("decoded bets were not batched")
+			}
+			return
+		}
+		againID, again, err := DecodeBatch(codec, batch.Payload)
+		if err != nil {
+			t.Fatalf("encoded batch could not be decoded: %v", err)
+		}
+		if againID != id || len(again) != len(bets) {
+			t.Fatalf("round trip mismatch: batch %v with %v bets, got batch %v with %v bets", id, len(bets), againID, len(again))
+		}
+		for i := range bets {
+			assertEqualBets(t, bets[i], again[i])
+		}
+	})
+}
+
+func TestReadFrameRejectsHostileLength(t *testing.T) {
+	header := []byte{0xff, 0xff, 0xff, 0xff, byte(MsgEcho), 0}
+	if _, err := ReadFrame(bytes.NewReader(header)); err != ErrFrameTooLarge {
+		t.Fatalf("expected oversized frame to be rejected before reading it, got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package common
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hello Handshake message exchanged right after connecting. The client
+// sends its offer and the server answers with the settings it accepted
+// for the connection. It is encoded as "key=value" lines so that fields
+// can be added without breaking older peers, which ignore unknown keys
+type Hello struct {
+	Agency string
+	// Compression Algorithms offered by the client, in order of preference.
+	// The server answers with the single algorithm chosen, if any
+	Compression []string
+	// Codec Bet codec offered by the client. The server answers with the
+	// same codec if it supports it
+	Codec string
+	// Session Token of the session the client asks to resume, or
+	// SessionNew to ask for one. The server answers with the token of the
+	// session of the connection, which is a new one if the requested
+	// session expired or is unknown
+	Session string
+	// Resumed Set by the server if the requested session was resumed
+	Resumed bool
+	// LastBatch Last batch of the resumed session stored by the server,
+	// along with every batch before it
+	LastBatch uint32
+	// Time Clock of the sender when the message was sent, used to estimate
+	// the offset between the client and server clocks
+	Time time.Time
+	// Nonce Nonce picked by the sender for the connection, which the
+	// signed frames it receives must cover. Sent only if frames are signed
+	Nonce []byte
+}
+
+// SessionNew Session requested by a client without a session to resume
+const SessionNew = "new"
+
+// Encode Serializes the hello message
+func (h Hello) Encode() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "agency=%s\n", h.Agency)
+	if len(h.Compression) > 0 {
+		fmt.Fprintf(&buf, "compression=%s\n", strings.Join(h.Compression, ","))
+	}
+	if h.Codec != "" {
+		fmt.Fprintf(&buf, "codec=%s\n", h.Codec)
+	}
+	if h.Session != "" {
+		fmt.Fprintf(&buf, "session=%s\n", h.Session)
+	}
+	if h.Resumed {
+		fmt.Fprintf(&buf, "resumed=%d\n", h.LastBatch)
+	}
+	if !h.Time.IsZero() {
+		fmt.Fprintf(&buf, "time=%d\n", h.Time.UnixNano())
+	}
+	if len(h.Nonce) > 0 {
+		fmt.Fprintf(&buf, "nonce=%s\n", hex.EncodeToString(h.Nonce))
+	}
+	return buf.Bytes()
+}
+
+// DecodeHello Parses a hello message. Unknown keys are ignored
+func DecodeHello(data []byte) (Hello, error) {
+	var h Hello
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return Hello{}, fmt.Errorf("malformed hello line %q", line)
+		}
+		key, value := line[:i], line[i+1:]
+		switch key {
+		case "agency":
+			h.Agency = value
+		case "compression":
+			h.Compression = nil
+			for _, algorithm := range strings.Split(value, ",") {
+				if algorithm != "" {
+					h.Compression = append(h.Compression, algorithm)
+				}
+			}
+		case "codec":
+			h.Codec = value
+		case "session":
+			h.Session = value
+		case "resumed":
+			lastBatch, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return Hello{}, fmt.Errorf("malformed resumed batch %q", value)
+			}
+			h.Resumed = true
+			h.LastBatch = uint32(lastBatch)
+		case "time":
+			nanos, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return Hello{}, fmt.Errorf("malformed time %q", value)
+			}
+			h.Time = time.Unix(0, nanos)
+		case "nonce":
+			nonce, err := hex.DecodeString(value)
+			if err != nil {
+				return Hello{}, fmt.Errorf("malformed nonce %q", value)
+			}
+			h.Nonce = nonce
+		}
+	}
+	return h, nil
+}
+
+// negotiateCompression Returns the algorithm accepted by the server if it
+// was part of the client offer, or CompressionNone otherwise
+func negotiateCompression(offer []string, accepted []string) string {
+	if len(accepted) == 0 {
+		return CompressionNone
+	}
+	for _, algorithm := range offer {
+		if algorithm == accepted[0] {
+			return algorithm
+		}
+	}
+	return CompressionNone
+}
+
+// negotiateCodec Returns the codec offered by the client if the server
+// accepted it, falling back to the text codec otherwise
+func negotiateCodec(offer BetCodec, accepted string) BetCodec {
+	if accepted == offer.Name() {
+		return offer
+	}
+	return TextCodec{}
+}
@@ -0,0 +1,119 @@
+package common
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultMissedBeats Heartbeats without any frame from the server after
+// which the server is considered dead by default
+const DefaultMissedBeats = 3
+
+// HeartbeatConfig Settings of the heartbeats sent on idle and busy
+// connections alike. An interval that is not positive disables them,
+// which is the default: a server that does not answer MsgPing would be
+// considered dead whenever a reply takes longer than the missed beats
+type HeartbeatConfig struct {
+	// Interval Time between pings
+	Interval time.Duration
+	// MissedBeats Intervals without any frame from the server after which
+	// the connection is closed. Defaults to DefaultMissedBeats
+	MissedBeats int
+}
+
+// heartbeat Pings the server of a connection every interval, and closes
+// the connection once the server stays silent for too long. Any frame
+// from the server counts as a beat, not only the pongs
+type heartbeat struct {
+	interval time.Duration
+	missed   int
+	clock    Clock
+	clientID string
+	tracer   *requestTracer
+
+	mu       sync.Mutex
+	lastSeen time.Time
+	dead     error
+	sequence uint32
+}
+
+// newHeartbeat Creates the heartbeat of a connection, or returns nil if
+// heartbeats are disabled
+func newHeartbeat(config HeartbeatConfig, clock Clock, clientID string, tracer *requestTracer) *heartbeat {
+	if config.Interval <= 0 {
+		return nil
+	}
+	missed := config.MissedBeats
+	if missed <= 0 {
+		missed = DefaultMissedBeats
+	}
+	return &heartbeat{
+		interval: config.Interval,
+		missed:   missed,
+		clock:    clock,
+		clientID: clientID,
+		tracer:   tracer,
+		lastSeen: clock.Now(),
+	}
+}
+
+// alive Records a frame from the server
+func (h *heartbeat) alive() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSeen = h.clock.Now()
+}
+
+// deadErr Returns the error the connection was closed with because the
+// server stopped answering, or nil
+func (h *heartbeat) deadErr() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.dead
+}
+
+// run Sends the pings until the connection is closed
+func (h *heartbeat) run(fc *frameConn) {
+	for {
+		select {
+		case <-fc.done:
+			return
+		case <-h.clock.After(h.interval):
+		}
+
+		h.mu.Lock()
+		silent := h.clock.Now().Sub(h.lastSeen)
+		if silent >= h.interval*time.Duration(h.missed) {
+			h.dead = &TimeoutError{Op: "heartbeat", After: silent, Err: os.ErrDeadlineExceeded}
+		}
+		dead := h.dead
+		h.sequence++
+		sequence := h.sequence
+		h.mu.Unlock()
+
+		if dead != nil {
+			log.Warnf("action: heartbeat | result: fail | client_id: %v | missed_beats: %v | silent_for: %v",
+				h.clientID,
+				h.missed,
+				silent,
+			)
+			fc.Close()
+			return
+		}
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, sequence)
+		ping := h.tracer.frame(MsgPing, payload)
+		if err := fc.send(ping); err != nil {
+			return
+		}
+		log.Debugf("action: heartbeat | result: in_progress | client_id: %v | request_id: %v | sequence: %v",
+			h.clientID,
+			requestID(ping.RequestID),
+			sequence,
+		)
+	}
+}
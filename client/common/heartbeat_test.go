@@ -0,0 +1,70 @@
+package common_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common/clienttest"
+)
+
+func TestClientLoopFailsWhenServerStopsAnsweringHeartbeats(t *testing.T) {
+	// The server hangs after reading the echo, so only the heartbeats can
+	// tell it apart from a slow reply
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.IgnorePings(),
+		clienttest.ExpectFrame(common.MsgEcho),
+		clienttest.ExpectEOF(),
+	})
+	config := clienttest.Config(server.Addr())
+	config.LoopLapse = time.Hour
+	config.Heartbeat = common.HeartbeatConfig{Interval: 10 * time.Millisecond, MissedBeats: 2}
+	client := clienttest.NewClient(t, config)
+
+	err := clienttest.RunLoop(t, client)
+	var timeoutErr *common.TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Op != "heartbeat" {
+		t.Fatalf("expected heartbeat timeout, got %v", err)
+	}
+}
+
+func TestSendBetsReconnectsWhenServerStopsAnsweringHeartbeats(t *testing.T) {
+	// The server pings the client in the middle of a request, and later
+	// hangs while the draw is pending. The next query goes to a new
+	// connection
+	server := clienttest.NewServer(t,
+		clienttest.Script{
+			clienttest.IgnorePings(),
+			clienttest.ExpectFrame(common.MsgBatch),
+			clienttest.ReplyFrame(common.Frame{Type: common.MsgPing, Payload: []byte{0, 0, 0, 7}}),
+			clienttest.ExpectFrame(common.MsgPong),
+			clienttest.ReplyAckOf(1),
+			clienttest.ExpectFrame(common.MsgDone),
+			clienttest.ReplyAckOf(0),
+			clienttest.ExpectFrame(common.MsgWinnersQuery),
+			clienttest.ReplyError(common.ErrorCodeDrawPending, "draw pending"),
+			clienttest.ExpectEOF(),
+		},
+		clienttest.Script{
+			clienttest.AnswerPings(),
+			clienttest.ExpectFrame(common.MsgWinnersQuery),
+			clienttest.ReplyFrame(common.Frame{Type: common.MsgWinners, Payload: common.EncodeWinners(nil)}),
+			clienttest.ExpectEOF(),
+		},
+	)
+	config := clienttest.Config(server.Addr())
+	config.Bets.Dataset = writeDataset(t, sampleDataset)
+	config.LoopLapse = 2 * time.Second
+	config.LoopPeriod = 100 * time.Millisecond
+	config.Heartbeat = common.HeartbeatConfig{Interval: 10 * time.Millisecond, MissedBeats: 2}
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected bets to be sent, got %v", err)
+	}
+	if server.Accepted() != 2 {
+		t.Fatalf("expected a new connection after the server hung, got %v connections", server.Accepted())
+	}
+}
@@ -0,0 +1,215 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// The payload of a signed frame (FlagSigned) is wrapped in the envelope
+//
+//	| agency length (uint8) | agency | sequence (uint64) | payload | mac |
+//
+// where mac is the HMAC-SHA256 of the direction of the frame, its type and
+// flags, the nonce of its receiver, the agency, sequence, request context
+// (if FlagContext is set) and payload using the agency shared secret. The direction keeps a frame from being
+// accepted if it is reflected back to its sender. Each side keeps its own
+// sequence, which must strictly increase for the peer to accept a frame.
+//
+// Each side picks a random nonce for every connection and sends it in the
+// hello, so the frames of a connection do not verify on any other. The
+// client hello is signed before the server sent its nonce, which is why
+// the server only accepts a hello as the first frame of a connection.
+
+const (
+	macSize = sha256.Size
+	// nonceSize Size of the nonce picked by each side of a connection
+	nonceSize = 16
+)
+
+// Directions of a signed frame
+const (
+	directionToServer byte = 1
+	directionToClient byte = 2
+)
+
+var (
+	// ErrFrameUnsigned Returned when a signed frame is expected but the
+	// peer sent a plain one
+	ErrFrameUnsigned = errors.New("frame is not signed")
+	// ErrFrameTampered Returned when the MAC or the agency of a signed
+	// frame do not match
+	ErrFrameTampered = errors.New("frame signature mismatch")
+	// ErrFrameReplayed Returned when a signed frame carries a sequence
+	// number that was already seen
+	ErrFrameReplayed = errors.New("frame sequence replayed")
+)
+
+// LoadSecret Reads the agency shared secret from a file. Surrounding
+// whitespace is ignored so that the file can be created with echo
+func LoadSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not read HMAC secret file %v", path)
+	}
+	secret := bytes.TrimSpace(data)
+	if len(secret) == 0 {
+		return nil, errors.Errorf("HMAC secret file %v is empty", path)
+	}
+	return secret, nil
+}
+
+// Signer Signs outgoing frames and verifies incoming ones with the shared
+// secret of an agency. Sequence numbers are kept for the whole life of the
+// signer, so each connection uses a session of its own (see session): the
+// server starts its sequence over in every connection, and so does a
+// server that restarted or took over after a failover
+type Signer struct {
+	secret []byte
+	agency string
+	// sendDirection and recvDirection Directions of the frames signed and
+	// verified, which depend on the side of the connection
+	sendDirection byte
+	recvDirection byte
+	// nonce Nonce picked for the connection, which the frames of the peer
+	// must cover
+	nonce []byte
+	mu    sync.Mutex
+	// peerNonce Nonce picked by the peer, which the frames sent cover
+	peerNonce []byte
+	sentSeq   uint64
+	recvSeq   uint64
+}
+
+// NewSigner Initializes the signer of a client of the given agency
+func NewSigner(secret []byte, agency string) *Signer {
+	return &Signer{
+		secret:        secret,
+		agency:        agency,
+		sendDirection: directionToServer,
+		recvDirection: directionToClient,
+	}
+}
+
+// NewServerSigner Initializes the signer of the server side of the
+// connections of the given agency
+func NewServerSigner(secret []byte, agency string) *Signer {
+	return &Signer{
+		secret:        secret,
+		agency:        agency,
+		sendDirection: directionToClient,
+		recvDirection: directionToServer,
+	}
+}
+
+// session Returns a signer with the same secret and side, whose sequences
+// start over, for a new connection. It picks a new nonce, which must be
+// sent to the peer in the hello
+func (s *Signer) session() (*Signer, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "Could not generate connection nonce")
+	}
+	return &Signer{
+		secret:        s.secret,
+		agency:        s.agency,
+		sendDirection: s.sendDirection,
+		recvDirection: s.recvDirection,
+		nonce:         nonce,
+	}, nil
+}
+
+// bind Sets the nonce the peer picked for the connection, which the
+// frames sent from then on cover
+func (s *Signer) bind(peerNonce []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peerNonce = peerNonce
+}
+
+func (s *Signer) mac(direction byte, f Frame, nonce []byte, agency []byte, seq uint64, payload []byte) []byte {
+	var seqBuf [8]byte
+	binary.BigEndian.PutUint64(seqBuf[:], seq)
+
+	m := hmac.New(sha256.New, s.secret)
+	m.Write([]byte{direction, byte(f.Type), f.Flags, byte(len(nonce))})
+	m.Write(nonce)
+	m.Write([]byte{byte(len(agency))})
+	m.Write(agency)
+	m.Write(seqBuf[:])
+	m.Write(encodeContext(f))
+	m.Write(payload)
+	return m.Sum(nil)
+}
+
+// Seal Wraps the frame payload in a signed envelope using the next
+// sequence number and the nonce of the peer. The flags are set as they
+// will be written, so that the MAC covers them and the context
+func (s *Signer) Seal(f Frame) Frame {
+	f.Flags |= FlagSigned
+	if f.RequestID != 0 || f.TraceParent != "" {
+		f.Flags |= FlagContext
+	}
+
+	s.mu.Lock()
+	s.sentSeq++
+	seq := s.sentSeq
+	peerNonce := s.peerNonce
+	s.mu.Unlock()
+
+	agency := []byte(s.agency)
+	payload := make([]byte, 0, 1+len(agency)+8+len(f.Payload)+macSize)
+	payload = append(payload, byte(len(agency)))
+	payload = append(payload, agency...)
+	var seqBuf [8]byte
+	binary.BigEndian.PutUint64(seqBuf[:], seq)
+	payload = append(payload, seqBuf[:]...)
+	payload = append(payload, f.Payload...)
+	payload = append(payload, s.mac(s.sendDirection, f, peerNonce, agency, seq, f.Payload)...)
+
+	f.Payload = payload
+	return f
+}
+
+// Open Verifies a signed frame and returns it with the original payload.
+// Frames that are unsigned, tampered or replayed are rejected with
+// ErrFrameUnsigned, ErrFrameTampered and ErrFrameReplayed respectively
+func (s *Signer) Open(f Frame) (Frame, error) {
+	if f.Flags&FlagSigned == 0 {
+		return Frame{}, ErrFrameUnsigned
+	}
+
+	envelope := f.Payload
+	if len(envelope) < 1 {
+		return Frame{}, ErrFrameTampered
+	}
+	agencyLen := int(envelope[0])
+	if len(envelope) < 1+agencyLen+8+macSize {
+		return Frame{}, ErrFrameTampered
+	}
+	agency := envelope[1 : 1+agencyLen]
+	seq := binary.BigEndian.Uint64(envelope[1+agencyLen:])
+	payload := envelope[1+agencyLen+8 : len(envelope)-macSize]
+	mac := envelope[len(envelope)-macSize:]
+
+	if !hmac.Equal(mac, s.mac(s.recvDirection, f, s.nonce, agency, seq, payload)) || string(agency) != s.agency {
+		return Frame{}, ErrFrameTampered
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq <= s.recvSeq {
+		return Frame{}, ErrFrameReplayed
+	}
+	s.recvSeq = seq
+
+	f.Flags &^= FlagSigned
+	f.Payload = payload
+	return f, nil
+}
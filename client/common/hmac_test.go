@@ -0,0 +1,158 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestSignerAcceptsFramesSignedByPeer(t *testing.T) {
+	client := NewSigner([]byte("secret"), "1")
+	server := NewServerSigner([]byte("secret"), "1")
+
+	for i := 0; i < 3; i++ {
+		sealed := server.Seal(Frame{Type: MsgEcho, Payload: []byte("hello")})
+		opened, err := client.Open(sealed)
+		if err != nil {
+			t.Fatalf("expected frame %v to be accepted, got %v", i, err)
+		}
+		if string(opened.Payload) != "hello" || opened.Flags&FlagSigned != 0 {
+			t.Fatalf("unexpected opened frame %+v", opened)
+		}
+	}
+}
+
+func TestSignerRejectsTamperedFrames(t *testing.T) {
+	client := NewSigner([]byte("secret"), "1")
+
+	tampered := NewServerSigner([]byte("secret"), "1").Seal(Frame{Type: MsgEcho, Payload: []byte("hello")})
+	tampered.Payload[len(tampered.Payload)-macSize-1] ^= 0xff
+	if _, err := client.Open(tampered); !errors.Is(err, ErrFrameTampered) {
+		t.Fatalf("expected tampered payload to be rejected, got %v", err)
+	}
+
+	retyped := NewServerSigner([]byte("secret"), "1").Seal(Frame{Type: MsgEcho, Payload: []byte("hello")})
+	retyped.Type = MsgEcho + 1
+	if _, err := client.Open(retyped); !errors.Is(err, ErrFrameTampered) {
+		t.Fatalf("expected changed message type to be rejected, got %v", err)
+	}
+
+	otherAgency := NewServerSigner([]byte("secret"), "2").Seal(Frame{Type: MsgEcho, Payload: []byte("hello")})
+	if _, err := client.Open(otherAgency); !errors.Is(err, ErrFrameTampered) {
+		t.Fatalf("expected frame of another agency to be rejected, got %v", err)
+	}
+
+	otherSecret := NewServerSigner([]byte("other"), "1").Seal(Frame{Type: MsgEcho, Payload: []byte("hello")})
+	if _, err := client.Open(otherSecret); !errors.Is(err, ErrFrameTampered) {
+		t.Fatalf("expected frame signed with another secret to be rejected, got %v", err)
+	}
+
+	reflagged := NewServerSigner([]byte("secret"), "1").Seal(Frame{Type: MsgEcho, Payload: []byte("hello")})
+	reflagged.Flags |= FlagCompressed
+	if _, err := client.Open(reflagged); !errors.Is(err, ErrFrameTampered) {
+		t.Fatalf("expected changed flags to be rejected, got %v", err)
+	}
+
+	rerouted := NewServerSigner([]byte("secret"), "1").Seal(Frame{Type: MsgEcho, Payload: []byte("hello"), RequestID: 1, TraceParent: "00-a"})
+	rerouted.RequestID = 2
+	if _, err := client.Open(rerouted); !errors.Is(err, ErrFrameTampered) {
+		t.Fatalf("expected changed request ID to be rejected, got %v", err)
+	}
+
+	retraced := NewServerSigner([]byte("secret"), "1").Seal(Frame{Type: MsgEcho, Payload: []byte("hello"), RequestID: 1, TraceParent: "00-a"})
+	retraced.TraceParent = "00-b"
+	if _, err := client.Open(retraced); !errors.Is(err, ErrFrameTampered) {
+		t.Fatalf("expected changed trace parent to be rejected, got %v", err)
+	}
+
+	if _, err := client.Open(Frame{Type: MsgEcho, Flags: FlagSigned, Payload: []byte{200}}); !errors.Is(err, ErrFrameTampered) {
+		t.Fatalf("expected truncated envelope to be rejected, got %v", err)
+	}
+}
+
+func TestSignerRejectsReplayedAndUnsignedFrames(t *testing.T) {
+	client := NewSigner([]byte("secret"), "1")
+	server := NewServerSigner([]byte("secret"), "1")
+
+	first := server.Seal(Frame{Type: MsgEcho, Payload: []byte("first")})
+	second := server.Seal(Frame{Type: MsgEcho, Payload: []byte("second")})
+	if _, err := client.Open(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Open(second); !errors.Is(err, ErrFrameReplayed) {
+		t.Fatalf("expected replayed frame to be rejected, got %v", err)
+	}
+	if _, err := client.Open(first); !errors.Is(err, ErrFrameReplayed) {
+		t.Fatalf("expected old frame to be rejected, got %v", err)
+	}
+	if _, err := client.Open(Frame{Type: MsgEcho, Payload: []byte("plain")}); !errors.Is(err, ErrFrameUnsigned) {
+		t.Fatalf("expected unsigned frame to be rejected, got %v", err)
+	}
+}
+
+func TestSignerRejectsReflectedFrames(t *testing.T) {
+	// A frame sent by the client and echoed back must not verify, even if
+	// its sequence is new to the client
+	client := NewSigner([]byte("secret"), "1")
+	reflected := NewSigner([]byte("secret"), "1").Seal(Frame{Type: MsgEcho, Payload: []byte("hello")})
+	if _, err := client.Open(reflected); !errors.Is(err, ErrFrameTampered) {
+		t.Fatalf("expected reflected frame to be rejected, got %v", err)
+	}
+
+	server := NewServerSigner([]byte("secret"), "1")
+	reply := NewServerSigner([]byte("secret"), "1").Seal(Frame{Type: MsgEcho, Payload: []byte("hello")})
+	if _, err := server.Open(reply); !errors.Is(err, ErrFrameTampered) {
+		t.Fatalf("expected reflected reply to be rejected, got %v", err)
+	}
+}
+
+// connect Returns the client and server signers of a new connection,
+// once they exchanged their nonces in the hello
+func connect(t *testing.T, client *Signer, server *Signer) (*Signer, *Signer) {
+	t.Helper()
+	clientSession, err := client.session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverSession, err := server.session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSession.bind(serverSession.nonce)
+	serverSession.bind(clientSession.nonce)
+	return clientSession, serverSession
+}
+
+func TestSignerSessionAcceptsRestartedSequence(t *testing.T) {
+	// A new connection, to a server that restarted or to another one,
+	// starts its sequence over
+	client := NewSigner([]byte("secret"), "1")
+	server := NewServerSigner([]byte("secret"), "1")
+	first, firstServer := connect(t, client, server)
+	if _, err := first.Open(firstServer.Seal(Frame{Type: MsgEcho})); err != nil {
+		t.Fatal(err)
+	}
+	second, secondServer := connect(t, client, server)
+	if _, err := second.Open(secondServer.Seal(Frame{Type: MsgEcho})); err != nil {
+		t.Fatalf("expected sequence of a new connection to be accepted, got %v", err)
+	}
+}
+
+func TestSignerRejectsFramesReplayedOnAnotherConnection(t *testing.T) {
+	// The ack of a batch recorded on a connection does not verify on a
+	// later one, even at a sequence that connection did not see yet
+	client := NewSigner([]byte("secret"), "1")
+	server := NewServerSigner([]byte("secret"), "1")
+
+	first, firstServer := connect(t, client, server)
+	ack := firstServer.Seal(Frame{Type: MsgAck, Payload: EncodeAck(Ack{BatchID: 1})})
+	batch := first.Seal(Frame{Type: MsgBatch, Payload: []byte{0, 0, 0, 1, 0, 0}})
+
+	second, secondServer := connect(t, client, server)
+	if _, err := second.Open(ack); !errors.Is(err, ErrFrameTampered) {
+		t.Fatalf("expected ack of another connection to be rejected, got %v", err)
+	}
+	if _, err := secondServer.Open(batch); !errors.Is(err, ErrFrameTampered) {
+		t.Fatalf("expected batch of another connection to be rejected, got %v", err)
+	}
+}
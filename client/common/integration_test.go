@@ -0,0 +1,319 @@
+package common_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common/clienttest"
+)
+
+// startServer Starts the server of the repository with the given
+// environment for a lottery of a single agency, skipping the test if
+// Python is not installed. It runs in a directory of its own, where it
+// stores the bets. Returns the address it listens on and the directory
+func startServer(t *testing.T, env ...string) (string, string) {
+	t.Helper()
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 is not installed")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	main, err := filepath.Abs(filepath.Join("..", "..", "server", "main.py"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cmd := exec.Command(python, main)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("SERVER_PORT=%v", port),
+		"SERVER_LISTEN_BACKLOG=5",
+		"LOGGING_LEVEL=ERROR",
+		"LOTTERY_AGENCIES=1",
+	)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("could not start server: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	address := fmt.Sprintf("127.0.0.1:%v", port)
+	for start := time.Now(); ; time.Sleep(20 * time.Millisecond) {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			return address, dir
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("server did not start listening: %v", err)
+		}
+	}
+}
+
+// writeSecrets Writes the HMAC secret of agency 1 for the client and the
+// server. Returns the secret file of the client and the directory of
+// secrets of the server
+func writeSecrets(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	serverDir := filepath.Join(dir, "secrets")
+	if err := os.Mkdir(serverDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	clientFile := filepath.Join(dir, "secret")
+	for _, path := range []string{clientFile, filepath.Join(serverDir, "1")} {
+		if err := os.WriteFile(path, []byte("secret\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return clientFile, serverDir
+}
+
+func TestClientLoopAgainstServer(t *testing.T) {
+	address, _ := startServer(t)
+	config := clienttest.Config(address)
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.RunLoop(t, client); err != nil {
+		t.Fatalf("expected echo loop to succeed, got %v", err)
+	}
+}
+
+func TestSignedClientLoopAgainstServer(t *testing.T) {
+	// The server verifies the client frames and signs its replies, which
+	// the client only accepts because they are signed in its direction
+	secretFile, secretsDir := writeSecrets(t)
+	address, _ := startServer(t, "HMAC_SECRETS_DIR="+secretsDir)
+	config := clienttest.Config(address)
+	config.HMACSecretFile = secretFile
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.RunLoop(t, client); err != nil {
+		t.Fatalf("expected signed echo loop to succeed, got %v", err)
+	}
+}
+
+// expectStoredBets Checks that the server stored every bet of the sample
+// dataset once
+func expectStoredBets(t *testing.T, dir string) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, "bets.csv"))
+	if err != nil {
+		t.Fatalf("expected bets to be stored: %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != strings.Count(sampleDataset, "\n") {
+		t.Fatalf("expected every bet to be stored once, got:\n%s", data)
+	}
+}
+
+func TestSendBetsAgainstServer(t *testing.T) {
+	for _, codec := range []string{common.CodecText, common.CodecBinary} {
+		t.Run(codec, func(t *testing.T) {
+			address, dir := startServer(t)
+			config := pipelineConfig(t, address)
+			config.Bets.Codec = codec
+			client := clienttest.NewClient(t, config)
+
+			if err := clienttest.Run(t, client.SendBets); err != nil {
+				t.Fatalf("expected bets to be sent, got %v", err)
+			}
+			expectStoredBets(t, dir)
+		})
+	}
+}
+
+func TestServerAcceptsCompression(t *testing.T) {
+	address, _ := startServer(t)
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	offer := common.Hello{Agency: "1", Codec: common.CodecText, Compression: []string{"zstd", common.CompressionFlate}}
+	if err := common.WriteFrame(conn, common.Frame{Type: common.MsgHello, Payload: offer.Encode()}); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := common.ReadFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := common.DecodeHello(reply.Payload)
+	if err != nil || len(accepted.Compression) != 1 || accepted.Compression[0] != common.CompressionFlate {
+		t.Fatalf("expected flate to be accepted, got %+v (%v)", accepted, err)
+	}
+}
+
+func TestCompressedSendBetsAgainstServer(t *testing.T) {
+	for _, algorithm := range []string{common.CompressionGzip, common.CompressionFlate} {
+		t.Run(algorithm, func(t *testing.T) {
+			// Batches of many similar bets, which compress well
+			var dataset strings.Builder
+			for i := 0; i < 100; i++ {
+				fmt.Fprintf(&dataset, "Santiago Lionel,Lorca,%v,1999-03-17,%v\n", 30904465+i, i)
+			}
+			address, dir := startServer(t)
+			config := pipelineConfig(t, address)
+			config.Bets.Dataset = writeDataset(t, dataset.String())
+			config.Bets.BatchMaxAmount = 50
+			config.Compression = common.CompressionConfig{Algorithm: algorithm}
+			client := clienttest.NewClient(t, config)
+
+			if err := clienttest.Run(t, client.SendBets); err != nil {
+				t.Fatalf("expected bets to be sent, got %v", err)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, "bets.csv"))
+			if err != nil || strings.Count(string(data), "\n") != 100 {
+				t.Fatalf("expected every bet to be stored once, got %v lines (%v)", strings.Count(string(data), "\n"), err)
+			}
+		})
+	}
+}
+
+func TestSignedSendBetsAgainstServerStoresBatchesOnce(t *testing.T) {
+	// The second upload starts over from the first batch, which the server
+	// acknowledges without storing it again
+	secretFile, secretsDir := writeSecrets(t)
+	address, dir := startServer(t, "HMAC_SECRETS_DIR="+secretsDir)
+	config := pipelineConfig(t, address)
+	config.HMACSecretFile = secretFile
+	config.ResumeSessions = true
+
+	for i := 0; i < 2; i++ {
+		config.Bets.ProgressFile = filepath.Join(t.TempDir(), "progress")
+		client := clienttest.NewClient(t, config)
+		if err := clienttest.Run(t, client.SendBets); err != nil {
+			t.Fatalf("expected bets to be sent, got %v", err)
+		}
+	}
+	expectStoredBets(t, dir)
+}
+
+func TestServerPushesDrawToWaitingAgency(t *testing.T) {
+	// Agency 1 would wait a minute to query the winners again, unless the
+	// server tells it the draw took place once agency 2 finishes
+	address, dir := startServer(t, "LOTTERY_AGENCIES=2")
+	config := pipelineConfig(t, address)
+	config.LoopLapse = 2 * time.Minute
+	config.LoopPeriod = time.Minute
+	waiting := clienttest.NewClient(t, config)
+	result := make(chan error, 1)
+	go func() {
+		result <- waiting.SendBets()
+	}()
+	t.Cleanup(func() { waiting.Close() })
+
+	// The agency notifies it finished right after its bets are stored
+	for start := time.Now(); ; time.Sleep(20 * time.Millisecond) {
+		data, _ := os.ReadFile(filepath.Join(dir, "bets.csv"))
+		if strings.Count(string(data), "\n") == strings.Count(sampleDataset, "\n") {
+			break
+		}
+		if time.Since(start) > clienttest.RunTimeout {
+			t.Fatal("bets of the waiting agency were not stored")
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	config = pipelineConfig(t, address)
+	config.ID = "2"
+	if err := clienttest.Run(t, clienttest.NewClient(t, config).SendBets); err != nil {
+		t.Fatalf("expected bets of the last agency to be sent, got %v", err)
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("expected the waiting agency to get its winners, got %v", err)
+		}
+	case <-time.After(clienttest.RunTimeout):
+		t.Fatal("expected the waiting agency to be told the draw took place")
+	}
+}
+
+// startTLSServer Starts the server with mutual TLS, trusting the client
+// certificates signed by the CA
+func startTLSServer(t *testing.T, ca *clienttest.CA) (string, string) {
+	t.Helper()
+	certFile, keyFile := ca.Issue(t, "server", x509.ExtKeyUsageServerAuth)
+	return startServer(t,
+		"TLS_ENABLED=true",
+		"TLS_CERT_FILE="+certFile,
+		"TLS_KEY_FILE="+keyFile,
+		"TLS_CLIENT_CA_FILE="+ca.File,
+	)
+}
+
+func TestSendBetsOverMutualTLSAgainstServer(t *testing.T) {
+	ca := clienttest.NewCA(t)
+	address, dir := startTLSServer(t, ca)
+	certFile, keyFile := ca.Issue(t, common.AgencyCommonName("1"), x509.ExtKeyUsageClientAuth)
+	config := pipelineConfig(t, address)
+	config.TLS = common.TLSConfig{Enabled: true, CAFile: ca.File, CertFile: certFile, KeyFile: keyFile}
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected bets to be sent, got %v", err)
+	}
+	expectStoredBets(t, dir)
+}
+
+func TestServerRejectsAgencyImpersonation(t *testing.T) {
+	// The client certificate names agency 2, which cannot claim agency 1
+	ca := clienttest.NewCA(t)
+	address, _ := startTLSServer(t, ca)
+	certFile, keyFile := ca.Issue(t, common.AgencyCommonName("2"), x509.ExtKeyUsageClientAuth)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	caPEM, err := os.ReadFile(ca.File)
+	if err != nil || !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatalf("could not load CA: %v", err)
+	}
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	hello := common.Frame{Type: common.MsgHello, Payload: common.Hello{Agency: "1", Codec: common.CodecText}.Encode()}
+	if err := common.WriteFrame(conn, hello); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := common.ReadFrame(conn); err == nil {
+		t.Fatalf("expected the connection to be closed, got reply %+v", reply)
+	}
+}
+
+func TestServerRequiresClientCertificate(t *testing.T) {
+	ca := clienttest.NewCA(t)
+	address, _ := startTLSServer(t, ca)
+	config := clienttest.Config(address)
+	config.TLS = common.TLSConfig{Enabled: true, CAFile: ca.File}
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.RunLoop(t, client); err == nil {
+		t.Fatal("expected the server to refuse a client without certificate")
+	}
+}
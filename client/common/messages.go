@@ -0,0 +1,251 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Payloads of the structured messages exchanged after the handshake:
+//
+//	MsgAck:     | batch id (uint32) |
+//	MsgError:   | batch id (uint32) | code (uint16) | message length (uint16) | message |
+//	MsgDone:    empty, answered with an acknowledgement of batch 0
+//	MsgWinnersQuery: empty, answered with MsgWinners or MsgError
+//	MsgWinners: | amount (uint32) | document (uint32) ... |
+//	MsgBusy:    | batch id (uint32) | retry after, in ms (uint32) |
+//	MsgPing:    opaque, echoed by MsgPong
+//	MsgPush:    | event (uint8) | message |
+//
+// Errors and busy replies that do not refer to a batch carry batch id 0.
+// A request answered with MsgBusy was not handled, and has to be sent
+// again once the retry delay elapses.
+//
+// Batches not acknowledged when a connection fails are sent again, with
+// the same ID, through the next connection, possibly to another server.
+// Servers sharing their storage have to store each batch ID of an agency
+// once and acknowledge the repeated ones. A client that resumes its
+// session in the handshake, see Hello, only sends again the batches after
+// the last one the session stored. Done notifications and winners queries
+// pending when a connection fails are always sent again.
+
+// ErrMalformedMessage Returned when a message payload cannot be decoded
+var ErrMalformedMessage = errors.New("malformed message")
+
+// Error codes sent by the server in MsgError
+const (
+	// ErrorCodeInvalidBatch The batch could not be decoded or stored
+	ErrorCodeInvalidBatch uint16 = 1
+	// ErrorCodeDrawPending Winners were queried before the draw
+	ErrorCodeDrawPending uint16 = 2
+	// ErrorCodeInternal The server failed while handling the request
+	ErrorCodeInternal uint16 = 3
+)
+
+const (
+	ackSize         = 4
+	busySize        = 4 + 4
+	errorHeaderSize = 4 + 2 + 2
+	winnerSize      = 4
+)
+
+// Ack Acknowledgement of a batch stored by the server
+type Ack struct {
+	BatchID uint32
+}
+
+// EncodeAck Serializes an acknowledgement
+func EncodeAck(ack Ack) []byte {
+	payload := make([]byte, ackSize)
+	binary.BigEndian.PutUint32(payload, ack.BatchID)
+	return payload
+}
+
+// DecodeAck Parses the payload of an acknowledgement
+func DecodeAck(payload []byte) (Ack, error) {
+	if len(payload) != ackSize {
+		return Ack{}, ErrMalformedMessage
+	}
+	return Ack{BatchID: binary.BigEndian.Uint32(payload)}, nil
+}
+
+// ServerError Error reported by the server for a request
+type ServerError struct {
+	BatchID uint32
+	Code    uint16
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error %v: %v", e.Code, e.Message)
+}
+
+// EncodeError Serializes a server error. Messages longer than the
+// uint16 limit are truncated
+func EncodeError(e ServerError) []byte {
+	message := e.Message
+	if len(message) > math.MaxUint16 {
+		message = message[:math.MaxUint16]
+	}
+	payload := make([]byte, errorHeaderSize, errorHeaderSize+len(message))
+	binary.BigEndian.PutUint32(payload[0:], e.BatchID)
+	binary.BigEndian.PutUint16(payload[4:], e.Code)
+	binary.BigEndian.PutUint16(payload[6:], uint16(len(message)))
+	return append(payload, message...)
+}
+
+// DecodeError Parses the payload of a server error
+func DecodeError(payload []byte) (*ServerError, error) {
+	if len(payload) < errorHeaderSize {
+		return nil, ErrMalformedMessage
+	}
+	size := int(binary.BigEndian.Uint16(payload[6:]))
+	if len(payload) != errorHeaderSize+size {
+		return nil, ErrMalformedMessage
+	}
+	return &ServerError{
+		BatchID: binary.BigEndian.Uint32(payload[0:]),
+		Code:    binary.BigEndian.Uint16(payload[4:]),
+		Message: string(payload[errorHeaderSize:]),
+	}, nil
+}
+
+// ServerBusy Reply of a server too busy to handle a request, which has
+// to be repeated after RetryAfter
+type ServerBusy struct {
+	BatchID    uint32
+	RetryAfter time.Duration
+}
+
+func (b *ServerBusy) Error() string {
+	return fmt.Sprintf("server busy, retry after %v", b.RetryAfter)
+}
+
+// EncodeBusy Serializes a busy reply. The delay is sent in milliseconds
+func EncodeBusy(b ServerBusy) []byte {
+	retryAfter := b.RetryAfter.Milliseconds()
+	if retryAfter > math.MaxUint32 {
+		retryAfter = math.MaxUint32
+	}
+	payload := make([]byte, busySize)
+	binary.BigEndian.PutUint32(payload[0:], b.BatchID)
+	binary.BigEndian.PutUint32(payload[4:], uint32(retryAfter))
+	return payload
+}
+
+// DecodeBusy Parses the payload of a busy reply
+func DecodeBusy(payload []byte) (*ServerBusy, error) {
+	if len(payload) != busySize {
+		return nil, ErrMalformedMessage
+	}
+	return &ServerBusy{
+		BatchID:    binary.BigEndian.Uint32(payload[0:]),
+		RetryAfter: time.Duration(binary.BigEndian.Uint32(payload[4:])) * time.Millisecond,
+	}, nil
+}
+
+// PushEvent Kind of announcement pushed by the server
+type PushEvent uint8
+
+// Events pushed by the server
+const (
+	// PushDrawCompleted The draw took place, so winners can be queried
+	PushDrawCompleted PushEvent = 1
+	// PushShutdown The server is shutting down
+	PushShutdown PushEvent = 2
+	// PushPause The client has to stop sending bets until PushResume
+	PushPause PushEvent = 3
+	// PushResume The client can send bets again
+	PushResume PushEvent = 4
+)
+
+func (e PushEvent) String() string {
+	switch e {
+	case PushDrawCompleted:
+		return "draw_completed"
+	case PushShutdown:
+		return "shutdown"
+	case PushPause:
+		return "pause"
+	case PushResume:
+		return "resume"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(e))
+}
+
+// Push Announcement sent by the server without being asked, at any time
+// after the handshake. The message is informative only
+type Push struct {
+	Event   PushEvent
+	Message string
+}
+
+// EncodePush Serializes a push
+func EncodePush(p Push) []byte {
+	payload := make([]byte, 1, 1+len(p.Message))
+	payload[0] = uint8(p.Event)
+	return append(payload, p.Message...)
+}
+
+// DecodePush Parses the payload of a push. Unknown events are decoded, so
+// that the caller can ignore them
+func DecodePush(payload []byte) (Push, error) {
+	if len(payload) < 1 {
+		return Push{}, ErrMalformedMessage
+	}
+	return Push{Event: PushEvent(payload[0]), Message: string(payload[1:])}, nil
+}
+
+// EncodeWinners Serializes the documents of the winners of an agency
+func EncodeWinners(documents []uint32) []byte {
+	payload := make([]byte, 4+winnerSize*len(documents))
+	binary.BigEndian.PutUint32(payload, uint32(len(documents)))
+	for i, document := range documents {
+		binary.BigEndian.PutUint32(payload[4+winnerSize*i:], document)
+	}
+	return payload
+}
+
+// DecodeWinners Parses the documents of the winners of an agency. The
+// amount in the header is checked against the payload size before
+// allocating, so it cannot be used to force a large allocation
+func DecodeWinners(payload []byte) ([]uint32, error) {
+	if len(payload) < 4 {
+		return nil, ErrMalformedMessage
+	}
+	amount := binary.BigEndian.Uint32(payload)
+	if uint64(len(payload)-4) != uint64(amount)*winnerSize {
+		return nil, ErrMalformedMessage
+	}
+	documents := make([]uint32, amount)
+	for i := range documents {
+		documents[i] = binary.BigEndian.Uint32(payload[4+winnerSize*i:])
+	}
+	return documents, nil
+}
+
+// decodeReply Returns the reply payload if it has the expected type. Server
+// errors are decoded and returned as *ServerError, and busy replies as
+// *ServerBusy
+func decodeReply(reply Frame, expected MessageType) ([]byte, error) {
+	switch reply.Type {
+	case expected:
+		return reply.Payload, nil
+	case MsgError:
+		serverErr, err := DecodeError(reply.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return nil, serverErr
+	case MsgBusy:
+		busy, err := DecodeBusy(reply.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return nil, busy
+	}
+	return nil, fmt.Errorf("unexpected reply of type %v while waiting for type %v", reply.Type, expected)
+}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"runtime"
+	"sync"
+)
+
+// pipelineChunkSize Records handed to an encoder at once, so that the cost
+// of the channel operations is shared by many records
+const pipelineChunkSize = 256
+
+// pipelineRecord Dataset record parsed, validated and encoded
+type pipelineRecord struct {
+	line   int
+	record []string
+
+	bet     Bet
+	reasons []string
+	encoded []byte
+	// err Error encoding a valid bet
+	err error
+}
+
+// pipelineChunk Consecutive records of the dataset. err is the error that
+// stopped the reader after them, io.EOF at the end of the dataset, and
+// errLine the line that could not be read
+type pipelineChunk struct {
+	records []pipelineRecord
+	err     error
+	errLine int
+	done    chan struct{}
+}
+
+// betPipeline Reads the dataset in a goroutine and parses, validates and
+// encodes its records in a pool of encoder goroutines. Chunks are
+// delivered in dataset order. The stages are connected by bounded
+// channels, so at most a few chunks per encoder are held in memory
+type betPipeline struct {
+	// order Chunks in dataset order, each ready once its done channel is
+	// closed
+	order chan *pipelineChunk
+	work  chan *pipelineChunk
+	quit  chan struct{}
+	wg    sync.WaitGroup
+	// read Records read by the reader. Only safe to read after stop
+	read int
+}
+
+// startPipeline Starts reading the dataset with the given amount of
+// encoders. If encoders is not positive, one per CPU is started
+func startPipeline(dataset *Dataset, validator Validator, codec BetCodec, encoders int) *betPipeline {
+	if encoders <= 0 {
+		encoders = runtime.NumCPU()
+	}
+	p := &betPipeline{
+		order: make(chan *pipelineChunk, 2*encoders),
+		work:  make(chan *pipelineChunk, encoders),
+		quit:  make(chan struct{}),
+	}
+	p.wg.Add(1 + encoders)
+	go p.readRecords(dataset)
+	for i := 0; i < encoders; i++ {
+		go p.encodeRecords(validator, codec)
+	}
+	return p
+}
+
+// readRecords Splits the dataset in chunks and hands them to the encoders,
+// until the dataset ends, it cannot be read or the pipeline is stopped
+func (p *betPipeline) readRecords(dataset *Dataset) {
+	defer p.wg.Done()
+	defer close(p.order)
+	defer close(p.work)
+
+	for {
+		chunk := &pipelineChunk{
+			records: make([]pipelineRecord, 0, pipelineChunkSize),
+			done:    make(chan struct{}),
+		}
+		for len(chunk.records) < pipelineChunkSize {
+			record, err := dataset.Read()
+			if err != nil {
+				chunk.err = err
+				chunk.errLine = dataset.Line() + 1
+				break
+			}
+			p.read++
+			chunk.records = append(chunk.records, pipelineRecord{line: dataset.Line(), record: record})
+		}
+
+		select {
+		case p.order <- chunk:
+		case <-p.quit:
+			return
+		}
+		select {
+		case p.work <- chunk:
+		case <-p.quit:
+			return
+		}
+		if chunk.err != nil {
+			return
+		}
+	}
+}
+
+// encodeRecords Parses, validates and encodes the records of the chunks
+// handed by the reader
+func (p *betPipeline) encodeRecords(validator Validator, codec BetCodec) {
+	defer p.wg.Done()
+	for chunk := range p.work {
+		for i := range chunk.records {
+			r := &chunk.records[i]
+			r.bet, r.reasons = validator.ParseRecord(r.record)
+			if len(r.reasons) == 0 {
+				r.encoded, r.err = codec.AppendBet(nil, r.bet)
+			}
+		}
+		close(chunk.done)
+	}
+}
+
+// next Returns the next chunk in dataset order once it was encoded, or
+// false after the last chunk
+func (p *betPipeline) next() (*pipelineChunk, bool) {
+	chunk, ok := <-p.order
+	if !ok {
+		return nil, false
+	}
+	<-chunk.done
+	return chunk, true
+}
+
+// stop Stops the pipeline and waits for its goroutines to finish. The
+// chunks not consumed yet are discarded
+func (p *betPipeline) stop() {
+	close(p.quit)
+	p.wg.Wait()
+}
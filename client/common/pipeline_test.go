@@ -0,0 +1,124 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// writeSampleDataset Writes a dataset of n records built from sampleBets
+func writeSampleDataset(tb testing.TB, n int) string {
+	tb.Helper()
+	path := filepath.Join(tb.TempDir(), "agency-1.csv")
+	file, err := os.Create(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	w := bufio.NewWriter(file)
+	for _, bet := range sampleBets(n) {
+		fmt.Fprintf(w, "%s,%s,%d,%s,%d\n", bet.FirstName, bet.LastName, bet.Document, bet.Birthdate.Format(BirthdateLayout), bet.Number)
+	}
+	if err := w.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+func openSampleDataset(tb testing.TB, path string) *Dataset {
+	tb.Helper()
+	dataset, err := OpenDataset(path, "")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return dataset
+}
+
+var pipelineNow = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func TestPipelinePreservesDatasetOrder(t *testing.T) {
+	bets := sampleBets(5000)
+	dataset := openSampleDataset(t, writeSampleDataset(t, len(bets)))
+	defer dataset.Close()
+
+	pipeline := startPipeline(dataset, NewValidator(1, pipelineNow), BinaryCodec{}, 4)
+	defer pipeline.stop()
+	i := 0
+	for chunk, ok := pipeline.next(); ok; chunk, ok = pipeline.next() {
+		for _, r := range chunk.records {
+			if r.line != i+1 || r.bet.Document != bets[i].Document || r.bet.Number != bets[i].Number {
+				t.Fatalf("record %v out of order: line %v, bet %+v", i, r.line, r.bet)
+			}
+			i++
+		}
+	}
+	if i != len(bets) {
+		t.Fatalf("expected %v records, got %v", len(bets), i)
+	}
+}
+
+func TestPipelineStopDoesNotLeakGoroutines(t *testing.T) {
+	dataset := openSampleDataset(t, writeSampleDataset(t, 50000))
+	defer dataset.Close()
+	before := runtime.NumGoroutine()
+
+	pipeline := startPipeline(dataset, NewValidator(1, pipelineNow), TextCodec{}, 8)
+	if _, ok := pipeline.next(); !ok {
+		t.Fatal("expected a chunk")
+	}
+	pipeline.stop()
+
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v goroutines after stopping, got %v", before, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if pipeline.read == 0 || pipeline.read == 50000 {
+		t.Fatalf("expected the reader to stop early, read %v records", pipeline.read)
+	}
+}
+
+// BenchmarkPipeline Reports the throughput of reading, validating, encoding
+// and batching a dataset of 1M records with different amounts of encoders
+func BenchmarkPipeline(b *testing.B) {
+	const rows = 1000000
+	path := writeSampleDataset(b, rows)
+	info, err := os.Stat(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, encoders := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("encoders-%d", encoders), func(b *testing.B) {
+			b.SetBytes(info.Size())
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				dataset := openSampleDataset(b, path)
+				batcher := NewBatcher(BinaryCodec{}, 0, MaxBatchPayload(false, "1"))
+				pipeline := startPipeline(dataset, NewValidator(1, pipelineNow), BinaryCodec{}, encoders)
+				count := 0
+				for chunk, ok := pipeline.next(); ok; chunk, ok = pipeline.next() {
+					for _, r := range chunk.records {
+						if _, err := batcher.AddEncoded(r.encoded); err != nil {
+							b.Fatal(err)
+						}
+						count++
+					}
+				}
+				pipeline.stop()
+				dataset.Close()
+				if count != rows {
+					b.Fatalf("expected %v records, got %v", rows, count)
+				}
+			}
+			b.ReportMetric(float64(rows*b.N)/time.Since(start).Seconds(), "rows/s")
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Progress Part of the agency dataset acknowledged by the server. It is
+// persisted as batches are acknowledged so that an interrupted upload
+// resumes after the last acknowledged batch instead of starting over
+type Progress struct {
+	// Records Amount of dataset records, counted from the start, whose bets
+	// were acknowledged
+	Records int
+	// Batch ID of the last batch acknowledged
+	Batch uint32
+}
+
+// encode Serializes the progress as "key=value" lines
+func (p Progress) encode() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "records=%d\n", p.Records)
+	fmt.Fprintf(&buf, "batch=%d\n", p.Batch)
+	return buf.Bytes()
+}
+
+// LoadProgress Reads the progress file. If the path is empty or the file
+// does not exist yet, the upload starts from the beginning
+func LoadProgress(path string) (Progress, error) {
+	var p Progress
+	if path == "" {
+		return p, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return p, errors.Wrapf(err, "Could not read progress file %v", path)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return Progress{}, fmt.Errorf("malformed progress line %q", line)
+		}
+		key, value := line[:i], line[i+1:]
+		switch key {
+		case "records":
+			p.Records, err = strconv.Atoi(value)
+		case "batch":
+			var batch uint64
+			batch, err = strconv.ParseUint(value, 10, 32)
+			p.Batch = uint32(batch)
+		}
+		if err != nil || p.Records < 0 {
+			return Progress{}, fmt.Errorf("malformed progress line %q", line)
+		}
+	}
+	return p, nil
+}
+
+// SaveProgress Writes the progress file. The file is replaced atomically,
+// so a crash while saving leaves the previous progress intact
+func SaveProgress(path string, p Progress) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrapf(err, "Could not save progress file %v", path)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(p.encode()); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "Could not save progress file %v", path)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "Could not save progress file %v", path)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrapf(err, "Could not save progress file %v", path)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProgressRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress")
+	if p, err := LoadProgress(path); err != nil || p != (Progress{}) {
+		t.Fatalf("expected empty progress for a missing file, got %+v (%v)", p, err)
+	}
+
+	expected := Progress{Records: 1250, Batch: 13}
+	if err := SaveProgress(path, expected); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := LoadProgress(path); err != nil || p != expected {
+		t.Fatalf("expected %+v, got %+v (%v)", expected, p, err)
+	}
+}
+
+func TestLoadProgressRejectsMalformedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress")
+	for _, content := range []string{"records\n", "records=-1\n", "batch=x\n"} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadProgress(path); err == nil {
+			t.Fatalf("expected %q to be rejected", content)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package common
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PushHandler Reacts to an announcement pushed by the server. Handlers run
+// on the goroutine reading the connection, in the order the pushes
+// arrive and before any reply received after them, so they must not
+// block
+type PushHandler func(Push)
+
+// pushDispatcher Handlers registered for each event pushed by the server
+type pushDispatcher struct {
+	mu       sync.Mutex
+	handlers map[PushEvent][]PushHandler
+}
+
+// add Registers a handler for an event, after the ones already registered
+func (d *pushDispatcher) add(event PushEvent, handler PushHandler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.handlers == nil {
+		d.handlers = make(map[PushEvent][]PushHandler)
+	}
+	d.handlers[event] = append(d.handlers[event], handler)
+}
+
+// get Returns the handlers of an event
+func (d *pushDispatcher) get(event PushEvent) []PushHandler {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.handlers[event]
+}
+
+// sendGate Holds the bets back while the server has paused the client
+type sendGate struct {
+	mu sync.Mutex
+	// resumed Closed when the pause ends, nil if not paused
+	resumed chan struct{}
+}
+
+func (g *sendGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+	}
+}
+
+func (g *sendGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		close(g.resumed)
+		g.resumed = nil
+	}
+}
+
+// paused Checks if the client is paused
+func (g *sendGate) paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumed != nil
+}
+
+// wait Waits until the client is not paused. Returns false if stop is
+// closed first
+func (g *sendGate) wait(stop <-chan struct{}) bool {
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// HandlePush Registers a handler for an event pushed by the server. The
+// client already reacts to every event: winners are queried as soon as
+// the draw completes, sending bets pauses and resumes when asked, and the
+// client is stopped when the server shuts down. Handlers registered here
+// run after those reactions
+func (c *Client) HandlePush(event PushEvent, handler PushHandler) {
+	c.pushes.add(event, handler)
+}
+
+// registerPushReactions Registers the reactions of the client to the
+// events pushed by the server
+func (c *Client) registerPushReactions() {
+	c.pushes.add(PushDrawCompleted, func(Push) {
+		select {
+		case c.drawCompleted <- struct{}{}:
+		default:
+		}
+	})
+	c.pushes.add(PushShutdown, func(Push) { c.Stop() })
+	c.pushes.add(PushPause, func(Push) { c.gate.pause() })
+	c.pushes.add(PushResume, func(Push) { c.gate.resume() })
+}
+
+// dispatchPush Decodes a push received from the server and runs the
+// handlers of its event. Malformed pushes and unknown events are logged
+// and ignored, so servers can announce events older clients do not know
+func (c *Client) dispatchPush(f Frame) {
+	push, err := DecodePush(f.Payload)
+	if err != nil {
+		log.Warnf("action: push | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return
+	}
+	handlers := c.pushes.get(push.Event)
+	if len(handlers) == 0 {
+		log.Warnf("action: push | result: fail | client_id: %v | event: %v | error: unknown event", c.config.ID, push.Event)
+		return
+	}
+
+	log.Infof("action: push | result: success | client_id: %v | event: %v | message: %v",
+		c.config.ID,
+		push.Event,
+		push.Message,
+	)
+	for _, handler := range handlers {
+		handler(push)
+	}
+}
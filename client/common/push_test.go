@@ -0,0 +1,91 @@
+package common_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common/clienttest"
+)
+
+func TestSendBetsQueriesWinnersWhenDrawCompletes(t *testing.T) {
+	// The query period is too long for the test, so winners can only be
+	// queried again because of the push
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectBatch(1),
+		clienttest.ReplyAck(),
+		clienttest.ExpectFrame(common.MsgDone),
+		clienttest.ReplyAckOf(0),
+		clienttest.ExpectFrame(common.MsgWinnersQuery),
+		clienttest.ReplyError(common.ErrorCodeDrawPending, "draw pending"),
+		clienttest.Push(common.PushDrawCompleted, "draw 1"),
+		clienttest.ExpectFrame(common.MsgWinnersQuery),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgWinners, Payload: common.EncodeWinners([]uint32{30904465})}),
+		clienttest.ExpectEOF(),
+	})
+	config := clienttest.Config(server.Addr())
+	config.Bets.Dataset = writeDataset(t, sampleDataset)
+	config.LoopLapse = time.Hour
+	config.LoopPeriod = time.Hour
+	client := clienttest.NewClient(t, config)
+
+	pushed := make(chan common.Push, 1)
+	client.HandlePush(common.PushDrawCompleted, func(push common.Push) { pushed <- push })
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected bets to be sent, got %v", err)
+	}
+	select {
+	case push := <-pushed:
+		if push.Message != "draw 1" {
+			t.Fatalf("expected the pushed message, got %q", push.Message)
+		}
+	default:
+		t.Fatal("expected the registered handler to be called")
+	}
+}
+
+func TestSendBetsWaitsWhilePaused(t *testing.T) {
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectBatch(1),
+		clienttest.Push(common.PushPause, ""),
+		clienttest.ReplyAckOf(1),
+		clienttest.ExpectSilence(100 * time.Millisecond),
+		clienttest.Push(common.PushResume, ""),
+		clienttest.ExpectBatch(2),
+		clienttest.ReplyAck(),
+		clienttest.ExpectBatch(3),
+		clienttest.ReplyAck(),
+		clienttest.ExpectFrame(common.MsgDone),
+		clienttest.ReplyAckOf(0),
+		clienttest.ExpectFrame(common.MsgWinnersQuery),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgWinners, Payload: common.EncodeWinners(nil)}),
+		clienttest.ExpectEOF(),
+	})
+	config := pipelineConfig(t, server.Addr())
+	config.Bets.Window = 1
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected bets to be sent after resuming, got %v", err)
+	}
+}
+
+func TestClientLoopStopsWhenServerShutsDown(t *testing.T) {
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectFrame(common.MsgEcho),
+		clienttest.Push(common.PushShutdown, "maintenance"),
+		clienttest.ReplyEcho(),
+		clienttest.ExpectEOF(),
+	})
+	config := clienttest.Config(server.Addr())
+	config.LoopLapse = time.Hour
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.RunLoop(t, client); err != nil {
+		t.Fatalf("expected graceful shutdown, got %v", err)
+	}
+	if server.Accepted() != 1 {
+		t.Fatalf("expected no messages after the shutdown, got %v connections", server.Accepted())
+	}
+}
@@ -0,0 +1,124 @@
+package common
+
+import (
+	"time"
+)
+
+// RateLimitConfig Limits on the bets and bytes sent per second. A rate
+// that is not positive is not limited. Bursts default to one second of
+// the rate
+type RateLimitConfig struct {
+	BetsPerSecond  float64
+	BytesPerSecond float64
+	BetsBurst      float64
+	BytesBurst     float64
+}
+
+// Enabled Checks if any rate is limited
+func (c RateLimitConfig) Enabled() bool {
+	return c.BetsPerSecond > 0 || c.BytesPerSecond > 0
+}
+
+// TokenBucket Token bucket refilled at a constant rate up to its burst.
+// Reservations larger than the available tokens leave the bucket in debt,
+// so that a batch larger than the burst is delayed instead of refused
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	clock  Clock
+}
+
+// NewTokenBucket Creates a full bucket. If burst is not positive, it is
+// one second of the rate
+func NewTokenBucket(rate float64, burst float64, clock Clock) *TokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &TokenBucket{rate: rate, burst: burst, tokens: burst, last: clock.Now(), clock: clock}
+}
+
+// Reserve Takes n tokens and returns how long the caller has to wait
+// before using them
+func (b *TokenBucket) Reserve(n float64) time.Duration {
+	now := b.clock.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// RateLimiter Limits the bets and bytes sent by the client
+type RateLimiter struct {
+	bets  *TokenBucket
+	bytes *TokenBucket
+	clock Clock
+
+	// Amounts sent since the rate was last measured
+	since     time.Time
+	sentBets  int
+	sentBytes int
+}
+
+// NewRateLimiter Creates a limiter, or returns nil if no rate is limited
+func NewRateLimiter(config RateLimitConfig, clock Clock) *RateLimiter {
+	if !config.Enabled() {
+		return nil
+	}
+	l := &RateLimiter{clock: clock, since: clock.Now()}
+	if config.BetsPerSecond > 0 {
+		l.bets = NewTokenBucket(config.BetsPerSecond, config.BetsBurst, clock)
+	}
+	if config.BytesPerSecond > 0 {
+		l.bytes = NewTokenBucket(config.BytesPerSecond, config.BytesBurst, clock)
+	}
+	return l
+}
+
+// Wait Blocks until the given amount of bets and bytes can be sent.
+// Returns false if stop is closed first
+func (l *RateLimiter) Wait(bets int, bytes int, stop <-chan struct{}) bool {
+	var delay time.Duration
+	if l.bets != nil {
+		delay = l.bets.Reserve(float64(bets))
+	}
+	if l.bytes != nil {
+		if d := l.bytes.Reserve(float64(bytes)); d > delay {
+			delay = d
+		}
+	}
+	if delay > 0 {
+		select {
+		case <-l.clock.After(delay):
+		case <-stop:
+			return false
+		}
+	}
+	l.sentBets += bets
+	l.sentBytes += bytes
+	return true
+}
+
+// Rate Returns the bets and bytes per second sent since the last time the
+// rate was measured, once at least a second has passed. Otherwise ok is
+// false
+func (l *RateLimiter) Rate() (betsPerSecond float64, bytesPerSecond float64, ok bool) {
+	elapsed := l.clock.Now().Sub(l.since)
+	if elapsed < time.Second {
+		return 0, 0, false
+	}
+	betsPerSecond = float64(l.sentBets) / elapsed.Seconds()
+	bytesPerSecond = float64(l.sentBytes) / elapsed.Seconds()
+	l.since = l.clock.Now()
+	l.sentBets = 0
+	l.sentBytes = 0
+	return betsPerSecond, bytesPerSecond, true
+}
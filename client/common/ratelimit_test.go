@@ -0,0 +1,82 @@
+package common_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common/clienttest"
+)
+
+func TestTokenBucketDelaysBeyondBurst(t *testing.T) {
+	clock := clienttest.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket := common.NewTokenBucket(10, 10, clock)
+
+	if delay := bucket.Reserve(10); delay != 0 {
+		t.Fatalf("expected the burst to be available at once, got a delay of %v", delay)
+	}
+	if delay := bucket.Reserve(5); delay != 500*time.Millisecond {
+		t.Fatalf("expected a delay of 500ms, got %v", delay)
+	}
+	// The debt is paid after half a second, and the bucket refills up to
+	// its burst only
+	clock.Advance(10 * time.Second)
+	if delay := bucket.Reserve(10); delay != 0 {
+		t.Fatalf("expected the bucket to be full again, got a delay of %v", delay)
+	}
+	if delay := bucket.Reserve(1); delay != 100*time.Millisecond {
+		t.Fatalf("expected a delay of 100ms, got %v", delay)
+	}
+}
+
+func TestRateLimiterWaitsForTokens(t *testing.T) {
+	clock := clienttest.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	limiter := common.NewRateLimiter(common.RateLimitConfig{BetsPerSecond: 100, BytesPerSecond: 1000}, clock)
+	stop := make(chan struct{})
+
+	if !limiter.Wait(100, 500, stop) {
+		t.Fatal("expected the burst to be sent at once")
+	}
+	done := make(chan bool)
+	go func() { done <- limiter.Wait(50, 100, stop) }()
+
+	// The bets bucket is the one that runs out
+	clock.BlockUntil(1)
+	clock.Advance(499 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("expected the limiter to wait for the bets bucket")
+	case <-time.After(clienttest.LoopPeriod):
+	}
+	clock.Advance(time.Millisecond)
+	if !<-done {
+		t.Fatal("expected the limiter to let the bets through")
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	bets, bytes, ok := limiter.Rate()
+	if !ok || bets != 150 || bytes != 600 {
+		t.Fatalf("expected 150 bets/s and 600 bytes/s, got %v, %v, %v", bets, bytes, ok)
+	}
+}
+
+func TestRateLimiterStops(t *testing.T) {
+	clock := clienttest.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	limiter := common.NewRateLimiter(common.RateLimitConfig{BytesPerSecond: 100}, clock)
+	stop := make(chan struct{})
+
+	limiter.Wait(1, 100, stop)
+	done := make(chan bool)
+	go func() { done <- limiter.Wait(1, 100, stop) }()
+	clock.BlockUntil(1)
+	close(stop)
+	if <-done {
+		t.Fatal("expected the limiter to give up once stopped")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	if common.NewRateLimiter(common.RateLimitConfig{}, common.SystemClock{}) != nil {
+		t.Fatal("expected no limiter without rates")
+	}
+}
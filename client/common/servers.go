@@ -0,0 +1,224 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Policies used to pick the server of each connection when several server
+// addresses are configured
+const (
+	// ServerPolicyOrdered Connects to the first healthy server, in the
+	// configured order
+	ServerPolicyOrdered = "ordered"
+	// ServerPolicyRoundRobin Starts every connection attempt from the
+	// server after the one the previous attempt started from
+	ServerPolicyRoundRobin = "round_robin"
+	// ServerPolicyRandom Tries the healthy servers in random order
+	ServerPolicyRandom = "random"
+)
+
+// DefaultServerCooldown Time a failing server is avoided by default
+const DefaultServerCooldown = 10 * time.Second
+
+// ValidateServerPolicy Checks if the server policy is supported. An empty
+// policy is the same as ServerPolicyOrdered
+func ValidateServerPolicy(policy string) error {
+	switch policy {
+	case "", ServerPolicyOrdered, ServerPolicyRoundRobin, ServerPolicyRandom:
+		return nil
+	}
+	return fmt.Errorf("unsupported server policy %q", policy)
+}
+
+// server Health of a server address. A server is unhealthy from a failure
+// until the cooldown elapses
+type server struct {
+	address   string
+	failures  int
+	downUntil time.Time
+}
+
+// serverPool Server addresses the client can connect to, with their
+// health. Unhealthy servers are only tried once the healthy ones failed
+type serverPool struct {
+	servers  []*server
+	policy   string
+	cooldown time.Duration
+	clock    Clock
+	rand     *rand.Rand
+	next     int
+	// current Server of the last connection
+	current *server
+}
+
+// newServerPool Creates a pool with every server healthy
+func newServerPool(addresses []string, policy string, cooldown time.Duration, clock Clock) *serverPool {
+	if cooldown <= 0 {
+		cooldown = DefaultServerCooldown
+	}
+	p := &serverPool{
+		policy:   policy,
+		cooldown: cooldown,
+		clock:    clock,
+		rand:     rand.New(rand.NewSource(clock.Now().UnixNano())),
+	}
+	for _, address := range addresses {
+		p.servers = append(p.servers, &server{address: address})
+	}
+	return p
+}
+
+// candidates Returns the servers to try for a new connection: the healthy
+// ones in the order given by the policy, followed by the unhealthy ones,
+// the ones that recover sooner first
+func (p *serverPool) candidates() []*server {
+	ordered := make([]*server, 0, len(p.servers))
+	switch p.policy {
+	case ServerPolicyRoundRobin:
+		for i := range p.servers {
+			ordered = append(ordered, p.servers[(p.next+i)%len(p.servers)])
+		}
+		p.next = (p.next + 1) % len(p.servers)
+	case ServerPolicyRandom:
+		for _, i := range p.rand.Perm(len(p.servers)) {
+			ordered = append(ordered, p.servers[i])
+		}
+	default:
+		ordered = append(ordered, p.servers...)
+	}
+
+	now := p.clock.Now()
+	sort.SliceStable(ordered, func(i, j int) bool {
+		iDown, jDown := ordered[i].downUntil.After(now), ordered[j].downUntil.After(now)
+		if iDown != jDown {
+			return jDown
+		}
+		return iDown && ordered[i].downUntil.Before(ordered[j].downUntil)
+	})
+	return ordered
+}
+
+// connectServer Connects to the first candidate server that completes the
+// handshake. Servers that fail are marked unhealthy, and switching to a
+// different server than the one of the previous connection is logged
+func (c *Client) connectServer() (*frameConn, error) {
+	var lastErr error
+	for _, s := range c.servers.candidates() {
+		fc, err := c.connect(s.address)
+		if err != nil {
+			c.serverDown(s, err)
+			lastErr = err
+			continue
+		}
+
+		if s.failures > 0 {
+			log.Infof("action: server_health | result: success | client_id: %v | address: %v | failures: %v",
+				c.config.ID,
+				s.address,
+				s.failures,
+			)
+		}
+		s.failures = 0
+		s.downUntil = time.Time{}
+		if previous := c.servers.current; previous != nil && previous != s {
+			log.Warnf("action: failover | result: success | client_id: %v | from: %v | to: %v",
+				c.config.ID,
+				previous.address,
+				s.address,
+			)
+		}
+		c.servers.current = s
+		return fc, nil
+	}
+	return nil, lastErr
+}
+
+// serverDown Marks a server unhealthy for the cooldown
+func (c *Client) serverDown(s *server, cause error) {
+	s.failures++
+	s.downUntil = c.clock.Now().Add(c.servers.cooldown)
+	log.Warnf("action: server_health | result: fail | client_id: %v | address: %v | failures: %v | retry_in: %v | error_class: %v | error: %v",
+		c.config.ID,
+		s.address,
+		s.failures,
+		c.servers.cooldown,
+		errorClass(cause),
+		cause,
+	)
+}
+
+// isConnectionError Checks if the error was caused by a connection that
+// failed or was closed, rather than by the contents of a message
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.As(err, &netErr)
+}
+
+// failover Replaces a connection that failed in the middle of a request
+// with a connection to the next healthy server, and sends the batches in
+// flight of the upload, if any, through it again. Batches keep their ID,
+// so servers sharing their storage store each of them once. If the
+// session was resumed, the batches the server already stored are
+// acknowledged instead.
+//
+// The original error is returned if it is not a connection error, if the
+// client was closed or if every server was tried since the server last
+// handled a request
+func (c *Client) failover(cause error, u *upload) error {
+	if !isConnectionError(cause) || c.failovers >= len(c.servers.servers) {
+		return cause
+	}
+	c.failovers++
+	failed := c.conn
+	failed.Close()
+	c.serverDown(c.servers.current, cause)
+
+	if err := c.createClientSocket(); err != nil {
+		if errors.Is(err, ErrClientClosed) {
+			return cause
+		}
+		return err
+	}
+	// Batches were encoded with the codec of the failed connection
+	if c.conn.codec.Name() != failed.codec.Name() {
+		return fmt.Errorf("server negotiated codec %v, but the pending bets are encoded with %v",
+			c.conn.codec.Name(),
+			failed.codec.Name(),
+		)
+	}
+	if u == nil {
+		return nil
+	}
+	if c.conn.resumed {
+		if err := c.ackResumed(u, c.conn.lastBatch); err != nil {
+			return err
+		}
+	}
+	for _, inflight := range u.window.batches {
+		if inflight.acked {
+			continue
+		}
+		if err := c.conn.send(c.batchFrame(inflight)); err != nil {
+			return err
+		}
+		log.Debugf("action: resend_batch | result: success | client_id: %v | batch_id: %v | request_id: %v",
+			c.config.ID,
+			inflight.batch.ID,
+			requestID(inflight.requestID),
+		)
+	}
+	return nil
+}
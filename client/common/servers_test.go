@@ -0,0 +1,45 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func addresses(servers []*server) []string {
+	var result []string
+	for _, s := range servers {
+		result = append(result, s.address)
+	}
+	return result
+}
+
+func TestServerPoolTriesUnhealthyServersLast(t *testing.T) {
+	pool := newServerPool([]string{"a:1", "b:1", "c:1"}, ServerPolicyOrdered, time.Minute, SystemClock{})
+	now := time.Now()
+	pool.servers[0].downUntil = now.Add(time.Hour)
+	pool.servers[1].downUntil = now.Add(time.Minute)
+
+	if got := addresses(pool.candidates()); len(got) != 3 || got[0] != "c:1" || got[1] != "b:1" || got[2] != "a:1" {
+		t.Fatalf("expected healthy server first and the rest by recovery time, got %v", got)
+	}
+}
+
+func TestServerPoolRoundRobin(t *testing.T) {
+	pool := newServerPool([]string{"a:1", "b:1", "c:1"}, ServerPolicyRoundRobin, time.Minute, SystemClock{})
+	for _, first := range []string{"a:1", "b:1", "c:1", "a:1"} {
+		if got := addresses(pool.candidates()); got[0] != first || len(got) != 3 {
+			t.Fatalf("expected candidates starting at %v, got %v", first, got)
+		}
+	}
+}
+
+func TestValidateServerPolicy(t *testing.T) {
+	for _, policy := range []string{"", ServerPolicyOrdered, ServerPolicyRoundRobin, ServerPolicyRandom} {
+		if err := ValidateServerPolicy(policy); err != nil {
+			t.Fatalf("expected policy %q to be valid: %v", policy, err)
+		}
+	}
+	if err := ValidateServerPolicy("fastest"); err == nil {
+		t.Fatal("expected unknown policy to be rejected")
+	}
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// startSession Applies the session the server assigned to a connection in
+// the handshake. If the requested session was resumed, the connection
+// remembers the last batch the server stored. Otherwise the client keeps
+// the new session, and the batches in flight are sent again as usual, so
+// no bets are lost when a session expires
+func (c *Client) startSession(fc *frameConn, requested string, accepted Hello) {
+	switch {
+	case accepted.Session == "" || accepted.Session == SessionNew:
+		c.session = ""
+		log.Warnf("action: session | result: fail | client_id: %v | error: server did not issue a session",
+			c.config.ID,
+		)
+	case accepted.Resumed && accepted.Session == requested:
+		fc.resumed = true
+		fc.lastBatch = accepted.LastBatch
+		log.Infof("action: resume_session | result: success | client_id: %v | last_batch: %v",
+			c.config.ID,
+			accepted.LastBatch,
+		)
+	default:
+		if requested != SessionNew {
+			log.Warnf("action: resume_session | result: fail | client_id: %v | error: session expired or unknown, starting a new one",
+				c.config.ID,
+			)
+		}
+		c.session = accepted.Session
+		log.Debugf("action: session | result: success | client_id: %v", c.config.ID)
+	}
+}
+
+// ackResumed Acknowledges the batches in flight that the server stored
+// under the resumed session, so that only the rest are sent again
+func (c *Client) ackResumed(u *upload, lastBatch uint32) error {
+	var stored []uint32
+	for _, inflight := range u.window.batches {
+		if !inflight.acked && inflight.batch.ID <= lastBatch {
+			stored = append(stored, inflight.batch.ID)
+		}
+	}
+	for _, id := range stored {
+		if err := c.ack(u, Ack{BatchID: id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package common_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common/clienttest"
+)
+
+// expectSession Reads the client hello and checks the session requested
+func expectSession(session string) clienttest.Step {
+	return func(c *clienttest.Conn) error {
+		if err := clienttest.ExpectFrame(common.MsgHello)(c); err != nil {
+			return err
+		}
+		offer, err := common.DecodeHello(c.Last.Payload)
+		if err != nil {
+			return err
+		}
+		if offer.Session != session {
+			return fmt.Errorf("expected session %q, got %q", session, offer.Session)
+		}
+		return nil
+	}
+}
+
+// replySession Answers the client hello with the given session
+func replySession(accepted common.Hello) clienttest.Step {
+	return clienttest.ReplyFrame(common.Frame{Type: common.MsgHello, Payload: accepted.Encode()})
+}
+
+// finishUpload Completes an upload after the last batch was acknowledged
+var finishUpload = []clienttest.Step{
+	clienttest.ExpectFrame(common.MsgDone),
+	clienttest.ReplyAckOf(0),
+	clienttest.ExpectFrame(common.MsgWinnersQuery),
+	clienttest.ReplyFrame(common.Frame{Type: common.MsgWinners, Payload: common.EncodeWinners(nil)}),
+	clienttest.ExpectEOF(),
+}
+
+func TestSendBetsResumesSessionAfterReconnect(t *testing.T) {
+	// The server stored batch 2 before the connection failed, so only
+	// batch 3 is sent again
+	server := clienttest.NewServer(t,
+		clienttest.Script{
+			expectSession(common.SessionNew),
+			replySession(common.Hello{Session: "s1"}),
+			clienttest.ExpectBatch(1),
+			clienttest.ExpectBatch(2),
+			clienttest.ExpectBatch(3),
+			clienttest.ReplyAckOf(1),
+			clienttest.Drop(),
+		},
+		append(clienttest.Script{
+			expectSession("s1"),
+			replySession(common.Hello{Session: "s1", Resumed: true, LastBatch: 2}),
+			clienttest.ExpectBatch(3),
+			clienttest.ReplyAck(),
+		}, finishUpload...),
+	)
+	config := pipelineConfig(t, server.Addr())
+	config.ResumeSessions = true
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected bets to be sent, got %v", err)
+	}
+	progress, err := common.LoadProgress(config.Bets.ProgressFile)
+	if err != nil || progress != (common.Progress{Records: 3, Batch: 3}) {
+		t.Fatalf("expected progress of 3 records and batch 3, got %+v (%v)", progress, err)
+	}
+}
+
+func TestSendBetsStartsNewSessionWhenExpired(t *testing.T) {
+	// The session expired, so every batch in flight is sent again
+	server := clienttest.NewServer(t,
+		clienttest.Script{
+			expectSession(common.SessionNew),
+			replySession(common.Hello{Session: "s1"}),
+			clienttest.ExpectBatch(1),
+			clienttest.ExpectBatch(2),
+			clienttest.ExpectBatch(3),
+			clienttest.ReplyAckOf(1),
+			clienttest.Drop(),
+		},
+		append(clienttest.Script{
+			expectSession("s1"),
+			replySession(common.Hello{Session: "s2"}),
+			clienttest.ExpectBatch(2),
+			clienttest.ExpectBatch(3),
+			clienttest.ReplyAckOf(2),
+			clienttest.ReplyAckOf(3),
+		}, finishUpload...),
+	)
+	config := pipelineConfig(t, server.Addr())
+	config.ResumeSessions = true
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected bets to be sent, got %v", err)
+	}
+	progress, err := common.LoadProgress(config.Bets.ProgressFile)
+	if err != nil || progress != (common.Progress{Records: 3, Batch: 3}) {
+		t.Fatalf("expected progress of 3 records and batch 3, got %+v (%v)", progress, err)
+	}
+}
@@ -0,0 +1,81 @@
+package common
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrClockSkew Returned when bets or the done notification are refused
+// because the server clock is too far off the client one
+var ErrClockSkew = errors.New("clock skew")
+
+// ClockSkewConfig Thresholds on the offset between the client and server
+// clocks, estimated in every handshake. A threshold that is not positive
+// disables its check. Both are disabled by default, since enabling any of
+// them makes every connection start with a handshake the server has to
+// answer
+type ClockSkewConfig struct {
+	// WarnThreshold Offset above which a warning is logged
+	WarnThreshold time.Duration
+	// RefuseThreshold Offset above which time-sensitive messages are
+	// refused: bets, whose cutoff the server enforces, and the done
+	// notification
+	RefuseThreshold time.Duration
+}
+
+// Enabled Checks if any of the checks is enabled
+func (c ClockSkewConfig) Enabled() bool {
+	return c.WarnThreshold > 0 || c.RefuseThreshold > 0
+}
+
+// estimateSkew Estimates the offset of the server clock from the client
+// one and the round-trip time of the handshake. As in NTP, the server
+// time is assumed to be taken halfway through the round trip, so the
+// offset is off by at most half the round-trip time
+func estimateSkew(sent time.Time, server time.Time, received time.Time) (offset time.Duration, rtt time.Duration) {
+	rtt = received.Sub(sent)
+	return server.Sub(sent.Add(rtt / 2)), rtt
+}
+
+// checkClockSkew Estimates the skew of the server clock from the times of
+// the handshake, logging a warning if it exceeds the warn threshold. If
+// it exceeds the refuse threshold, time-sensitive messages are refused on
+// the connection
+func (c *Client) checkClockSkew(fc *frameConn, sent time.Time, server time.Time, received time.Time) {
+	if server.IsZero() {
+		log.Warnf("action: clock_skew | result: fail | client_id: %v | error: server did not send its time", c.config.ID)
+		return
+	}
+	offset, rtt := estimateSkew(sent, server, received)
+	skew := offset
+	if skew < 0 {
+		skew = -skew
+	}
+
+	skewConfig := c.config.ClockSkew
+	switch {
+	case skewConfig.RefuseThreshold > 0 && skew > skewConfig.RefuseThreshold:
+		fc.skewErr = errors.Wrapf(ErrClockSkew, "server clock is %v off, above %v", offset, skewConfig.RefuseThreshold)
+		log.Errorf("action: clock_skew | result: fail | client_id: %v | offset: %v | rtt: %v | threshold: %v | bets refused",
+			c.config.ID,
+			offset,
+			rtt,
+			skewConfig.RefuseThreshold,
+		)
+	case skewConfig.WarnThreshold > 0 && skew > skewConfig.WarnThreshold:
+		log.Warnf("action: clock_skew | result: fail | client_id: %v | offset: %v | rtt: %v | threshold: %v",
+			c.config.ID,
+			offset,
+			rtt,
+			skewConfig.WarnThreshold,
+		)
+	default:
+		log.Debugf("action: clock_skew | result: success | client_id: %v | offset: %v | rtt: %v",
+			c.config.ID,
+			offset,
+			rtt,
+		)
+	}
+}
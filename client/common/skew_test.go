@@ -0,0 +1,20 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEstimateSkewAssumesServerTimeHalfwayThroughRoundTrip(t *testing.T) {
+	sent := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	received := sent.Add(200 * time.Millisecond)
+
+	offset, rtt := estimateSkew(sent, sent.Add(100*time.Millisecond), received)
+	if offset != 0 || rtt != 200*time.Millisecond {
+		t.Fatalf("expected no offset and 200ms rtt, got %v and %v", offset, rtt)
+	}
+	offset, _ = estimateSkew(sent, sent.Add(-time.Minute), received)
+	if offset != -time.Minute-100*time.Millisecond {
+		t.Fatalf("expected server to be behind, got offset %v", offset)
+	}
+}
@@ -0,0 +1,147 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TimeoutConfig Limits on the operations with the server. A timeout that
+// is not positive does not limit its operation
+type TimeoutConfig struct {
+	// Connect Time to dial a server and complete the TLS and protocol
+	// handshakes
+	Connect time.Duration
+	// Read Time to wait for each frame from the server
+	Read time.Duration
+	// Write Time to write each frame to the server
+	Write time.Duration
+	// KeepAlive Period of the TCP keepalive probes. Zero uses the system
+	// default and a negative period disables them
+	KeepAlive time.Duration
+}
+
+// Classes of errors reported in the logs, see errorClass
+const (
+	ErrorClassTimeout      = "timeout"
+	ErrorClassConnection   = "connection"
+	ErrorClassVerification = "verification"
+	ErrorClassServer       = "server"
+	ErrorClassProtocol     = "protocol"
+)
+
+// TimeoutError Operation with the server that did not complete within its
+// timeout
+type TimeoutError struct {
+	// Op Operation that timed out: connect, read or write
+	Op    string
+	After time.Duration
+	Err   error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%v timed out after %v: %v", e.Op, e.After, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout Reports the error as a timeout, as net.Error does
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary Implements net.Error
+func (e *TimeoutError) Temporary() bool {
+	return true
+}
+
+// timeoutError Wraps err in a TimeoutError if it was caused by a deadline
+// set for the operation, such as the timeout of the dialer
+func timeoutError(op string, after time.Duration, err error) error {
+	var netErr net.Error
+	if after > 0 && errors.As(err, &netErr) && netErr.Timeout() {
+		return &TimeoutError{Op: op, After: after, Err: err}
+	}
+	return err
+}
+
+// errorClass Classifies an error for the logs, so that timeouts can be told
+// apart from connections that failed and from invalid messages
+func errorClass(err error) string {
+	var netErr net.Error
+	var serverErr *ServerError
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorClassTimeout
+	case isVerificationError(err):
+		return ErrorClassVerification
+	case errors.As(err, &serverErr):
+		return ErrorClassServer
+	case isConnectionError(err):
+		return ErrorClassConnection
+	}
+	return ErrorClassProtocol
+}
+
+// expiredDeadline Deadline in the past, which interrupts the operations
+// blocked on a connection
+var expiredDeadline = time.Unix(1, 0)
+
+// watchdog Interrupts an operation with the server once its timeout
+// elapses on the client clock, by moving a deadline of the connection to
+// the past. Unlike a deadline computed from the wall clock, it follows the
+// injected clock, so tests can expire it without waiting
+type watchdog struct {
+	op          string
+	timeout     time.Duration
+	setDeadline func(time.Time) error
+	cancel      chan struct{}
+	done        chan struct{}
+	fired       bool
+}
+
+// watch Starts the watchdog of an operation, whose deadline is set with
+// setDeadline. If the timeout is not positive the operation is not limited
+func watch(clock Clock, timeout time.Duration, op string, setDeadline func(time.Time) error) *watchdog {
+	w := &watchdog{op: op, timeout: timeout, setDeadline: setDeadline}
+	if timeout <= 0 {
+		return w
+	}
+	w.cancel = make(chan struct{})
+	w.done = make(chan struct{})
+	go func() {
+		defer close(w.done)
+		select {
+		case <-clock.After(timeout):
+			w.fired = true
+			w.setDeadline(expiredDeadline)
+		case <-w.cancel:
+		}
+	}()
+	return w
+}
+
+// stop Stops the watchdog once the operation returned err. If the timeout
+// elapsed the deadline is cleared, so the connection can still be used,
+// and the error is wrapped in a TimeoutError
+func (w *watchdog) stop(err error) error {
+	if w.cancel == nil {
+		return err
+	}
+	close(w.cancel)
+	<-w.done
+	if !w.fired {
+		return err
+	}
+	if clearErr := w.setDeadline(time.Time{}); clearErr != nil && err == nil {
+		return clearErr
+	}
+	if err != nil {
+		return &TimeoutError{Op: w.op, After: w.timeout, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package common_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common/clienttest"
+)
+
+func TestClientLoopTimesOutOnSilentServer(t *testing.T) {
+	// The server accepts the message but never replies
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectFrame(common.MsgEcho),
+		clienttest.ExpectEOF(),
+	})
+	clock := clienttest.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	config := clienttest.Config(server.Addr())
+	config.Timeouts.Read = 50 * time.Millisecond
+	config.Clock = clock
+	client := clienttest.NewClient(t, config)
+
+	// The loop lapse and the wait for the reply
+	go func() {
+		clock.BlockUntil(2)
+		clock.Advance(config.Timeouts.Read)
+	}()
+	err := clienttest.RunLoop(t, client)
+	var timeoutErr *common.TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Op != "read" || timeoutErr.After != config.Timeouts.Read {
+		t.Fatalf("expected read timeout, got %v", err)
+	}
+}
+
+func TestClientTimesOutOnStalledHandshake(t *testing.T) {
+	// The server never answers the handshake
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectFrame(common.MsgHello),
+		clienttest.ExpectEOF(),
+	})
+	config := clienttest.Config(server.Addr())
+	config.Bets.Codec = common.CodecBinary
+	config.Timeouts.Connect = 50 * time.Millisecond
+	clock := clienttest.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	config.Clock = clock
+	client := clienttest.NewClient(t, config)
+
+	// The loop lapse and the connect timeout
+	go func() {
+		clock.BlockUntil(2)
+		clock.Advance(config.Timeouts.Connect)
+	}()
+	err := clienttest.RunLoop(t, client)
+	var timeoutErr *common.TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Op != "connect" {
+		t.Fatalf("expected connect timeout, got %v", err)
+	}
+}
+
+func TestConnectTimeoutIsLiftedOnceConnected(t *testing.T) {
+	// The server takes longer than the connect timeout to store the batch,
+	// but less than the read timeout
+	clock := clienttest.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectFrame(common.MsgHello),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgHello, Payload: common.Hello{Codec: common.CodecBinary}.Encode()}),
+		clienttest.ExpectBatch(1),
+		func(*clienttest.Conn) error {
+			clock.Advance(100 * time.Millisecond)
+			return nil
+		},
+		clienttest.ReplyAck(),
+		clienttest.ExpectFrame(common.MsgDone),
+		clienttest.ReplyAckOf(0),
+		clienttest.ExpectFrame(common.MsgWinnersQuery),
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgWinners, Payload: common.EncodeWinners(nil)}),
+		clienttest.ExpectEOF(),
+	})
+	config := clienttest.Config(server.Addr())
+	config.Bets.Codec = common.CodecBinary
+	config.Bets.Dataset = writeDataset(t, sampleDataset)
+	config.Timeouts = common.TimeoutConfig{Connect: 50 * time.Millisecond, Read: time.Second, Write: time.Second}
+	config.Clock = clock
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected bets to be sent, got %v", err)
+	}
+}
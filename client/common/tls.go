@@ -0,0 +1,154 @@
+package common
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TLSConfig Configuration used to secure the connection with the server
+type TLSConfig struct {
+	Enabled    bool
+	CAFile     string
+	ServerName string
+	MinVersion string
+	// CertFile and KeyFile Client certificate presented to the server.
+	// Its subject must encode the agency ID (see AgencyCommonName)
+	CertFile string
+	KeyFile  string
+	// Pins Hex encoded SHA-256 digests of the server certificate public key
+	// (SubjectPublicKeyInfo). If set, the server must present one of them
+	Pins []string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion Parses a TLS version in the "1.x" format. An empty
+// string is parsed as TLS 1.2
+func ParseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return tls.VersionTLS12, nil
+	}
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", version)
+	}
+	return v, nil
+}
+
+// agencyCommonNamePrefix Prefix of the subject common name of agency
+// client certificates
+const agencyCommonNamePrefix = "agency-"
+
+// AgencyCommonName Returns the subject common name expected in the
+// client certificate of the given agency
+func AgencyCommonName(id string) string {
+	return agencyCommonNamePrefix + id
+}
+
+// CertificateAgencyID Returns the agency ID encoded in the subject of a
+// client certificate. An error is returned if the subject does not follow
+// the agency naming convention
+func CertificateAgencyID(cert *x509.Certificate) (string, error) {
+	cn := cert.Subject.CommonName
+	if !strings.HasPrefix(cn, agencyCommonNamePrefix) || len(cn) == len(agencyCommonNamePrefix) {
+		return "", fmt.Errorf("certificate subject %q does not encode an agency ID", cn)
+	}
+	return strings.TrimPrefix(cn, agencyCommonNamePrefix), nil
+}
+
+// SPKIPin Returns the pin of a certificate as expected in TLSConfig.Pins
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// newTLSConfig Builds the crypto/tls configuration from the client
+// TLS settings. The CA bundle and client certificate are loaded once so
+// that every connection reuses them. If a client certificate is set, it
+// must belong to the agency with the given ID
+func newTLSConfig(config TLSConfig, agencyID string) (*tls.Config, error) {
+	minVersion, err := ParseTLSVersion(config.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: config.ServerName,
+		MinVersion: minVersion,
+	}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not read CA bundle %v", config.CAFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %v", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := loadAgencyCertificate(config.CertFile, config.KeyFile, agencyID)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(config.Pins) > 0 {
+		pins := make(map[string]bool, len(config.Pins))
+		for _, pin := range config.Pins {
+			pins[strings.ToLower(pin)] = true
+		}
+		// Pinning is checked on top of the regular chain verification
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("server presented no certificates")
+			}
+			pin := SPKIPin(cs.PeerCertificates[0])
+			if !pins[pin] {
+				return fmt.Errorf("server certificate pin %v does not match any configured pin", pin)
+			}
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// loadAgencyCertificate Loads the client key pair and verifies that its
+// subject matches the configured agency, so that an agency cannot start
+// with a certificate issued to another one
+func loadAgencyCertificate(certFile string, keyFile string, agencyID string) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrapf(err, "Could not load client certificate %v", certFile)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, errors.Wrapf(err, "Could not parse client certificate %v", certFile)
+	}
+	certID, err := CertificateAgencyID(leaf)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if certID != agencyID {
+		return tls.Certificate{}, fmt.Errorf("configured agency ID %v does not match certificate agency ID %v", agencyID, certID)
+	}
+	cert.Leaf = leaf
+	return cert, nil
+}
@@ -0,0 +1,253 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA Self-signed certificate authority generated for a single test
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue Signs a leaf certificate for the given common name. Server
+// certificates are valid for localhost and 127.0.0.1
+func (ca *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCAFile Writes the CA certificate as a PEM bundle in a temp dir
+func (ca *testCA) writeCAFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// startTLSServer Starts a local TLS listener that completes the handshake
+// of every accepted connection and closes it
+func startTLSServer(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func dialTLS(t *testing.T, address string, config TLSConfig) error {
+	t.Helper()
+	config.Enabled = true
+	client := &Client{config: ClientConfig{ID: "1", ServerAddress: address, TLS: config}, codec: TextCodec{}, dialer: &net.Dialer{}}
+	tlsConfig, err := newTLSConfig(config, client.config.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.tlsConfig = tlsConfig
+	conn, err := client.connect(address)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+func TestTLSConnectsWithConfiguredCABundle(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	address := startTLSServer(t, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+
+	err := dialTLS(t, address, TLSConfig{CAFile: ca.writeCAFile(t), ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("expected handshake to succeed, got %v", err)
+	}
+}
+
+func TestTLSRejectsServerSignedByUnknownCA(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := newTestCA(t).issue(t, "server", x509.ExtKeyUsageServerAuth)
+	address := startTLSServer(t, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+
+	err := dialTLS(t, address, TLSConfig{CAFile: ca.writeCAFile(t), ServerName: "localhost"})
+	if err == nil {
+		t.Fatal("expected handshake to fail with an unknown CA")
+	}
+}
+
+func TestTLSPinning(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	address := startTLSServer(t, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+	caFile := ca.writeCAFile(t)
+
+	err := dialTLS(t, address, TLSConfig{CAFile: caFile, ServerName: "localhost", Pins: []string{SPKIPin(serverCert.Leaf)}})
+	if err != nil {
+		t.Fatalf("expected matching pin to be accepted, got %v", err)
+	}
+
+	otherCert := ca.issue(t, "other", x509.ExtKeyUsageServerAuth)
+	err = dialTLS(t, address, TLSConfig{CAFile: caFile, ServerName: "localhost", Pins: []string{SPKIPin(otherCert.Leaf)}})
+	if err == nil {
+		t.Fatal("expected mismatching pin to be rejected")
+	}
+}
+
+func TestTLSMinVersionIsEnforced(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	address := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		MaxVersion:   tls.VersionTLS12,
+	})
+
+	err := dialTLS(t, address, TLSConfig{CAFile: ca.writeCAFile(t), ServerName: "localhost", MinVersion: "1.3"})
+	if err == nil {
+		t.Fatal("expected handshake to fail below the minimum version")
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	if v, err := ParseTLSVersion(""); err != nil || v != tls.VersionTLS12 {
+		t.Fatalf("expected default TLS 1.2, got %v %v", v, err)
+	}
+	if _, err := ParseTLSVersion("2.0"); err == nil {
+		t.Fatal("expected unknown version to fail")
+	}
+}
+
+// writeKeyPair Writes a certificate and its key as PEM files in a temp dir
+func writeKeyPair(t *testing.T, cert tls.Certificate) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestMutualTLSPresentsAgencyCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	address := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+
+	certFile, keyFile := writeKeyPair(t, ca.issue(t, AgencyCommonName("1"), x509.ExtKeyUsageClientAuth))
+	err := dialTLS(t, address, TLSConfig{CAFile: ca.writeCAFile(t), ServerName: "localhost", CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("expected mutual TLS handshake to succeed, got %v", err)
+	}
+}
+
+func TestClientRefusesCertificateOfAnotherAgency(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writeKeyPair(t, ca.issue(t, AgencyCommonName("2"), x509.ExtKeyUsageClientAuth))
+
+	_, err := NewClient(ClientConfig{
+		ID:  "3",
+		TLS: TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile},
+	})
+	if err == nil {
+		t.Fatal("expected client with agency 3 to refuse the certificate of agency 2")
+	}
+}
+
+func TestCertificateAgencyID(t *testing.T) {
+	ca := newTestCA(t)
+	id, err := CertificateAgencyID(ca.issue(t, AgencyCommonName("4"), x509.ExtKeyUsageClientAuth).Leaf)
+	if err != nil || id != "4" {
+		t.Fatalf("expected agency 4, got %q %v", id, err)
+	}
+	if _, err := CertificateAgencyID(ca.issue(t, "server", x509.ExtKeyUsageServerAuth).Leaf); err == nil {
+		t.Fatal("expected non agency subject to be rejected")
+	}
+}
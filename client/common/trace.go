@@ -0,0 +1,118 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TraceConfig Settings of the trace context sent with every request
+type TraceConfig struct {
+	// Enabled Sends a W3C traceparent with every request, whose parent ID
+	// is the request ID
+	Enabled bool
+	// Parent Traceparent of the run the client is part of, whose trace ID
+	// the requests keep. If empty, every client starts a trace of its own
+	Parent string
+}
+
+// ParseTraceParent Parses a W3C traceparent of version 00, returning its
+// trace ID
+func ParseTraceParent(traceParent string) (string, error) {
+	fields := strings.Split(traceParent, "-")
+	if len(fields) != 4 || fields[0] != "00" ||
+		!isTraceHex(fields[1], 32) || !isTraceHex(fields[2], 16) || !isTraceHex(fields[3], 2) {
+		return "", fmt.Errorf("malformed traceparent %q", traceParent)
+	}
+	if strings.Trim(fields[1], "0") == "" || strings.Trim(fields[2], "0") == "" {
+		return "", fmt.Errorf("traceparent %q has a zero ID", traceParent)
+	}
+	return fields[1], nil
+}
+
+// isTraceHex Checks if s has the given length and only lowercase hex
+// digits, as the traceparent fields must
+func isTraceHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestTracer Generates the IDs of the requests of a client and their
+// trace context. IDs are sequential from a random start, so that the
+// requests of different clients and runs do not collide in the logs
+type requestTracer struct {
+	last uint64
+	// traceID Trace the requests belong to, empty if tracing is disabled
+	traceID string
+}
+
+// newRequestTracer Creates the tracer of a client. An error is returned
+// if the parent traceparent is malformed
+func newRequestTracer(config TraceConfig) (*requestTracer, error) {
+	var seed [8 + 16]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		return nil, err
+	}
+	t := &requestTracer{last: binary.BigEndian.Uint64(seed[:8])}
+	if !config.Enabled {
+		return t, nil
+	}
+	if config.Parent != "" {
+		traceID, err := ParseTraceParent(config.Parent)
+		if err != nil {
+			return nil, err
+		}
+		t.traceID = traceID
+	} else {
+		t.traceID = hex.EncodeToString(seed[8:])
+	}
+	return t, nil
+}
+
+// nextID Returns the ID of a new request, which is never zero
+func (t *requestTracer) nextID() uint64 {
+	for {
+		if id := atomic.AddUint64(&t.last, 1); id != 0 {
+			return id
+		}
+	}
+}
+
+// frame Returns the frame of a new request
+func (t *requestTracer) frame(typ MessageType, payload []byte) Frame {
+	return t.context(Frame{Type: typ, Payload: payload}, t.nextID())
+}
+
+// context Attaches the context of the request to a frame. Requests sent
+// again keep their ID
+func (t *requestTracer) context(f Frame, id uint64) Frame {
+	f.RequestID = id
+	if t.traceID != "" {
+		f.TraceParent = fmt.Sprintf("00-%v-%016x-01", t.traceID, id)
+	}
+	return f
+}
+
+// requestID Formats a request ID for the logs
+func requestID(id uint64) string {
+	return fmt.Sprintf("%016x", id)
+}
+
+// logTrace Logs the trace the requests of the client belong to
+func (c *Client) logTrace() {
+	if c.tracer.traceID != "" {
+		log.Infof("action: trace | result: success | client_id: %v | trace_id: %v", c.config.ID, c.tracer.traceID)
+	}
+}
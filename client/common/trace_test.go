@@ -0,0 +1,122 @@
+package common_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common/clienttest"
+)
+
+const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestFrameCarriesRequestContext(t *testing.T) {
+	sent := common.Frame{Type: common.MsgBatch, Payload: []byte("bets"), RequestID: 42, TraceParent: traceParent}
+	var buf bytes.Buffer
+	if err := common.WriteFrame(&buf, sent); err != nil {
+		t.Fatalf("could not write frame: %v", err)
+	}
+	received, err := common.ReadFrame(&buf)
+	if err != nil {
+		t.Fatalf("could not read frame: %v", err)
+	}
+	if received.Flags&common.FlagContext == 0 || received.RequestID != 42 || received.TraceParent != traceParent {
+		t.Fatalf("expected the request context, got %+v", received)
+	}
+	if string(received.Payload) != "bets" {
+		t.Fatalf("expected payload %q, got %q", "bets", received.Payload)
+	}
+}
+
+func TestParseTraceParent(t *testing.T) {
+	traceID, err := common.ParseTraceParent(traceParent)
+	if err != nil || traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("expected trace ID to be parsed, got %q (%v)", traceID, err)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+	} {
+		if _, err := common.ParseTraceParent(invalid); err == nil {
+			t.Errorf("expected traceparent %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestSendBetsKeepsRequestIDWhenResendingBatch(t *testing.T) {
+	// The batch is sent again after a busy reply as the same request, and
+	// every request joins the configured trace
+	var first common.Frame
+	sameRequest := func(c *clienttest.Conn) error {
+		if c.Last.RequestID == 0 || c.Last.RequestID != first.RequestID || c.Last.TraceParent != first.TraceParent {
+			return fmt.Errorf("expected request %x to be sent again, got %x", first.RequestID, c.Last.RequestID)
+		}
+		return nil
+	}
+	inTrace := func(c *clienttest.Conn) error {
+		if !strings.HasPrefix(c.Last.TraceParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") {
+			return fmt.Errorf("expected request in the configured trace, got %q", c.Last.TraceParent)
+		}
+		return nil
+	}
+	server := clienttest.NewServer(t, clienttest.Script{
+		clienttest.ExpectBatch(1),
+		func(c *clienttest.Conn) error {
+			first = c.Last
+			return nil
+		},
+		clienttest.ReplyBusy(10 * time.Millisecond),
+		clienttest.ExpectBatch(1),
+		sameRequest,
+		inTrace,
+		clienttest.ReplyAck(),
+		clienttest.ExpectFrame(common.MsgDone),
+		inTrace,
+		clienttest.ReplyAckOf(0),
+		clienttest.ExpectFrame(common.MsgWinnersQuery),
+		inTrace,
+		clienttest.ReplyFrame(common.Frame{Type: common.MsgWinners, Payload: common.EncodeWinners(nil)}),
+		clienttest.ExpectEOF(),
+	})
+	config := clienttest.Config(server.Addr())
+	config.Bets.Dataset = writeDataset(t, sampleDataset)
+	config.Trace = common.TraceConfig{Enabled: true, Parent: traceParent}
+	client := clienttest.NewClient(t, config)
+
+	if err := clienttest.Run(t, client.SendBets); err != nil {
+		t.Fatalf("expected bets to be sent, got %v", err)
+	}
+}
+
+func TestNewClientRejectsMalformedTraceParent(t *testing.T) {
+	config := clienttest.Config("localhost:12345")
+	config.Trace = common.TraceConfig{Enabled: true, Parent: "not-a-traceparent"}
+	if _, err := common.NewClient(config); err == nil {
+		t.Fatal("expected error for a malformed traceparent")
+	}
+}
+
+func TestFullBatchFitsInFrame(t *testing.T) {
+	for _, signed := range []bool{false, true} {
+		f := common.Frame{
+			Type:        common.MsgBatch,
+			Payload:     make([]byte, common.MaxBatchPayload(signed, "1")),
+			RequestID:   42,
+			TraceParent: traceParent,
+		}
+		if signed {
+			f = common.NewSigner([]byte("secret"), "1").Seal(f)
+		}
+		if err := common.WriteFrame(&bytes.Buffer{}, f); err != nil {
+			t.Errorf("expected full batch to fit in a frame (signed: %v), got %v", signed, err)
+		}
+	}
+}
@@ -0,0 +1,506 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// BetsConfig Configuration of the upload of the agency bets
+type BetsConfig struct {
+	// Dataset Path of the agency CSV file, or of a zip archive holding it
+	Dataset string
+	// DatasetEntry Name of the CSV file inside the zip archive. Defaults to
+	// the agency file name (see DatasetEntry)
+	DatasetEntry string
+	// Codec Bet codec offered to the server (see NewBetCodec)
+	Codec string
+	// BatchMaxAmount Maximum amount of bets sent in a single batch. Batches
+	// are closed earlier if they would not fit in a frame
+	BatchMaxAmount int
+	// Window Maximum amount of batches sent without waiting for their
+	// acknowledgement. Defaults to 1, waiting for each batch
+	Window int
+	// ProgressFile Path of the file where the acknowledged progress is saved
+	// when an upload ends, and resumed from when it starts. Optional
+	ProgressFile string
+	// RejectsFile Path of the CSV file where invalid records are reported
+	// with their reasons. Optional
+	RejectsFile string
+	// StrictValidation Aborts the upload on the first invalid record instead
+	// of skipping it
+	StrictValidation bool
+	// Encoders Amount of goroutines parsing, validating and encoding bets.
+	// If it is not positive, one per CPU is used
+	Encoders int
+	// Duplicates Policy applied to bets with the same document and number
+	// (see DuplicatesSend). Defaults to sending them
+	Duplicates string
+	// DuplicatesCapacity Maximum amount of bets tracked to detect duplicates.
+	// Defaults to DefaultDuplicatesCapacity
+	DuplicatesCapacity int
+}
+
+// ErrInvalidBet Returned in strict validation mode when a record is invalid
+var ErrInvalidBet = errors.New("invalid bet")
+
+// MaxBatchPayload Returns the maximum size of a batch payload so that the
+// frame carrying it does not exceed MaxFrameSize. Every frame carries its
+// request context, and frames signed by the agency also carry its ID, a
+// sequence number and the MAC
+func MaxBatchPayload(signed bool, agencyID string) int {
+	size := MaxFrameSize - frameLengthSize - frameHeaderSize - frameContextSize - maxTraceParentSize
+	if signed {
+		size -= 1 + len(agencyID) + 8 + macSize
+	}
+	return size
+}
+
+// maxBatchPayload Returns the maximum size of a batch payload sent by the
+// client
+func (c *Client) maxBatchPayload() int {
+	return MaxBatchPayload(c.signer != nil, c.config.ID)
+}
+
+// upload State of an upload in progress
+type upload struct {
+	dataset   *Dataset
+	validator Validator
+	rejects   *Rejects
+	// duplicates Detector of duplicate bets, nil if they are sent
+	duplicates     *DuplicateDetector
+	duplicatesFull bool
+	batcher        *Batcher
+	window         *window
+	// read Records read from the dataset, including the ones skipped
+	// because a previous upload already sent them
+	read int
+	// sent Bets acknowledged during this upload
+	sent int
+	// rejected Records that failed validation during this upload
+	rejected int
+	// dropped Duplicate bets dropped during this upload
+	dropped int
+	// acked Progress acknowledged by the server, including previous uploads
+	acked Progress
+}
+
+// SendBets Reads the agency dataset and sends its bets to the server in
+// batches, with up to Window batches waiting for their acknowledgement at
+// any time. Once every bet was stored, the server is notified and the
+// winners of the agency are queried. Everything is sent through the same
+// connection.
+//
+// If the client is stopped, no more bets are read: the batch in flight is
+// completed, unless Close abandons it. The acknowledged progress is saved
+// to the progress file as batches settle, so the next upload resumes from
+// there even if the client is killed before the upload ends
+func (c *Client) SendBets() error {
+	agency, err := strconv.Atoi(c.config.ID)
+	if err != nil {
+		return errors.Wrapf(err, "Agency ID %v is not a number", c.config.ID)
+	}
+	progress, err := LoadProgress(c.config.Bets.ProgressFile)
+	if err != nil {
+		return err
+	}
+	c.logTrace()
+
+	entry := c.config.Bets.DatasetEntry
+	if entry == "" {
+		entry = DatasetEntry(c.config.ID)
+	}
+	dataset, err := OpenDataset(c.config.Bets.Dataset, entry)
+	if err != nil {
+		return err
+	}
+	defer dataset.Close()
+
+	u := &upload{
+		dataset:   dataset,
+		validator: NewValidator(agency, c.clock.Now()),
+		acked:     progress,
+	}
+	if policy := c.config.Bets.Duplicates; policy != "" && policy != DuplicatesSend {
+		u.duplicates = NewDuplicateDetector(c.config.Bets.DuplicatesCapacity)
+	}
+	if err := c.skipAcked(u); err != nil {
+		return err
+	}
+	if path := c.config.Bets.RejectsFile; path != "" {
+		if u.rejects, err = OpenRejects(path); err != nil {
+			return err
+		}
+		defer u.rejects.Close()
+	}
+
+	err = c.createClientSocket()
+	if err == errStopped {
+		log.Infof("action: graceful_shutdown | result: success | client_id: %v", c.config.ID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// The connection is replaced if the client fails over to another server
+	defer func() { c.conn.Close() }()
+
+	u.batcher = NewBatcher(c.conn.codec, c.config.Bets.BatchMaxAmount, c.maxBatchPayload())
+	u.batcher.StartAfter(progress.Batch)
+	u.window = newWindow(c.config.Bets.Window)
+	complete, err := c.uploadBets(u)
+	c.finishUpload(u, complete, err)
+	if err != nil {
+		return err
+	}
+	if !complete {
+		log.Infof("action: graceful_shutdown | result: success | client_id: %v", c.config.ID)
+		return nil
+	}
+
+	log.Infof("action: send_bets | result: success | client_id: %v | bets: %v", c.config.ID, u.sent)
+
+	err = c.notifyDone()
+	if err == errStopped {
+		log.Infof("action: graceful_shutdown | result: success | client_id: %v", c.config.ID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	winners, err := c.queryWinners()
+	if err != nil {
+		return err
+	}
+	if winners != nil {
+		log.Infof("action: consulta_ganadores | result: success | client_id: %v | cant_ganadores: %v", c.config.ID, len(winners))
+	}
+	return nil
+}
+
+// skipAcked Skips the dataset records acknowledged in previous uploads.
+// Their bets are still tracked, so that duplicates of them are detected
+func (c *Client) skipAcked(u *upload) error {
+	for u.read < u.acked.Records {
+		record, err := u.dataset.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Could not read dataset line %v", u.dataset.Line()+1)
+		}
+		u.read++
+		if bet, reasons := u.validator.ParseRecord(record); len(reasons) == 0 && u.duplicates != nil {
+			u.duplicates.Seen(bet)
+		}
+	}
+	if u.read > 0 {
+		log.Infof("action: resume_upload | result: success | client_id: %v | records: %v | last_batch_id: %v",
+			c.config.ID,
+			u.read,
+			u.acked.Batch,
+		)
+	}
+	return nil
+}
+
+// uploadBets Sends the bets of the dataset until every one of them was
+// acknowledged, in which case true is returned, or the client is stopped.
+// In both cases the batches in flight are awaited before returning, but
+// the ones the server is busy with when the client stops are abandoned.
+// Records are read, validated and encoded by a pipeline running in
+// parallel, and consumed here in dataset order
+func (c *Client) uploadBets(u *upload) (bool, error) {
+	pipeline := startPipeline(u.dataset, u.validator, c.conn.codec, c.config.Bets.Encoders)
+	skipped := u.read
+	defer func() {
+		// Records read ahead by the pipeline and discarded are pending too
+		pipeline.stop()
+		u.read = skipped + pipeline.read
+	}()
+
+	for {
+		chunk, ok := pipeline.next()
+		if !ok {
+			// The pipeline only ends early if it was stopped
+			return false, nil
+		}
+		for i := range chunk.records {
+			if c.stopped() {
+				break
+			}
+			u.read++
+			err := c.uploadRecord(u, &chunk.records[i])
+			if err == errStopped {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+		}
+		if c.stopped() {
+			// The batches in flight are completed, the rest are pending
+			if err := c.drainWindow(u); err != errStopped {
+				return false, err
+			}
+			return false, nil
+		}
+
+		if chunk.err == io.EOF {
+			if batch := u.batcher.Flush(); batch != nil {
+				err := c.sendUploadBatch(u, batch, u.read)
+				if err == errStopped {
+					return false, nil
+				}
+				if err != nil {
+					return false, err
+				}
+			}
+			err := c.drainWindow(u)
+			if err == errStopped {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+		if chunk.err != nil {
+			return false, errors.Wrapf(chunk.err, "Could not read dataset line %v", chunk.errLine)
+		}
+	}
+}
+
+// uploadRecord Adds a record to the current batch, sending the batch once
+// it is full. Invalid records and duplicates are handled first
+func (c *Client) uploadRecord(u *upload, r *pipelineRecord) error {
+	if len(r.reasons) > 0 {
+		return c.reject(u, r.line, r.record, r.reasons)
+	}
+	if u.duplicates != nil {
+		if u.duplicates.Seen(r.bet) {
+			return c.duplicate(u, r.line, r.bet)
+		}
+		if u.duplicates.Full() && !u.duplicatesFull {
+			u.duplicatesFull = true
+			log.Warnf("action: detect_duplicates | result: in_progress | client_id: %v | capacity: %v | new bets are no longer tracked",
+				c.config.ID,
+				u.duplicates.Capacity(),
+			)
+		}
+	}
+	if r.err != nil {
+		return errors.Wrapf(r.err, "Could not encode bet at dataset line %v", r.line)
+	}
+
+	batch, err := u.batcher.AddEncoded(r.encoded)
+	if err != nil {
+		return errors.Wrapf(err, "Could not encode bet at dataset line %v", r.line)
+	}
+	// A closed batch holds every record read so far but the current one
+	if batch != nil {
+		return c.sendUploadBatch(u, batch, u.read-1)
+	}
+	return nil
+}
+
+// reject Reports an invalid record. In strict validation mode the upload
+// is aborted
+func (c *Client) reject(u *upload, line int, record []string, reasons []string) error {
+	u.rejected++
+	log.Debugf("action: validate_bet | result: fail | client_id: %v | line: %v | reasons: %v",
+		c.config.ID,
+		line,
+		strings.Join(reasons, ";"),
+	)
+	if u.rejects != nil {
+		if err := u.rejects.Write(line, reasons, record); err != nil {
+			return errors.Wrapf(err, "Could not report invalid bet at dataset line %v", line)
+		}
+	}
+	if c.config.Bets.StrictValidation {
+		return errors.Wrapf(ErrInvalidBet, "dataset line %v: %v", line, strings.Join(reasons, ";"))
+	}
+	return nil
+}
+
+// duplicate Handles a bet whose document and number were already seen,
+// according to the duplicates policy
+func (c *Client) duplicate(u *upload, line int, bet Bet) error {
+	if c.config.Bets.Duplicates == DuplicatesFail {
+		return errors.Wrapf(ErrDuplicateBet, "dataset line %v: document %v, number %v", line, bet.Document, bet.Number)
+	}
+	u.dropped++
+	log.Debugf("action: drop_duplicate | result: success | client_id: %v | line: %v | document: %v | number: %v",
+		c.config.ID,
+		line,
+		bet.Document,
+		bet.Number,
+	)
+	return nil
+}
+
+// saveProgress Saves the acknowledged progress to the progress file, if
+// one is configured. Failures are logged, since the upload can go on: it
+// is only resumed from an older point
+func (c *Client) saveProgress(u *upload) {
+	path := c.config.Bets.ProgressFile
+	if path == "" {
+		return
+	}
+	if err := SaveProgress(path, u.acked); err != nil {
+		log.Errorf("action: save_progress | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return
+	}
+	log.Debugf("action: save_progress | result: success | client_id: %v | records: %v | last_batch_id: %v",
+		c.config.ID,
+		u.acked.Records,
+		u.acked.Batch,
+	)
+}
+
+// finishUpload Logs how many bets were sent and how many read ones are
+// still pending, along with the compression achieved, so batch sizes can
+// be tuned against MaxFrameSize. The rest of the dataset is not read to count the bets
+// never sent, so an interrupted upload finishes within the shutdown grace
+// period
+func (c *Client) finishUpload(u *upload, complete bool, err error) {
+	result := "success"
+	pending := 0
+	if !complete {
+		result = "interrupted"
+		if err != nil {
+			result = "fail"
+		}
+		pending = u.read - u.acked.Records
+	}
+	frames, rawBytes, wireBytes := c.stats.Snapshot()
+	log.Infof("action: upload_summary | result: %v | client_id: %v | bets_sent: %v | bets_pending: %v | bets_rejected: %v | duplicates_dropped: %v | frames: %v | bytes: %v | compressed_bytes: %v | ratio: %.2f",
+		result,
+		c.config.ID,
+		u.sent,
+		pending,
+		u.rejected,
+		u.dropped,
+		frames,
+		rawBytes,
+		wireBytes,
+		compressionRatio(rawBytes, wireBytes),
+	)
+}
+
+// receiveAck Waits for the acknowledgement of the last request. Errors
+// reported by the server are returned as *ServerError
+func (c *Client) receiveAck() (Ack, error) {
+	reply, err := c.conn.receive()
+	if err != nil {
+		return Ack{}, err
+	}
+	payload, err := decodeReply(reply, MsgAck)
+	if err != nil {
+		return Ack{}, err
+	}
+	c.accepted()
+	return DecodeAck(payload)
+}
+
+// notifyDone Notifies the server that every bet of the agency was sent,
+// repeating the notification while the server is busy or after failing
+// over to another server. The notification is time sensitive, so it is
+// refused with ErrClockSkew if the server clock is too far off
+func (c *Client) notifyDone() error {
+	request := c.tracer.frame(MsgDone, nil)
+	for {
+		if err := c.conn.skewErr; err != nil {
+			return err
+		}
+		err := c.conn.send(request)
+		if err == nil {
+			_, err = c.receiveAck()
+		}
+		var busy *ServerBusy
+		if errors.As(err, &busy) {
+			if err := c.backOff(busy, request.RequestID); err != nil {
+				return err
+			}
+			continue
+		}
+		if err == nil {
+			break
+		}
+		if err := c.failover(err, nil); err != nil {
+			return err
+		}
+	}
+	log.Infof("action: notify_done | result: success | client_id: %v | request_id: %v", c.config.ID, requestID(request.RequestID))
+	return nil
+}
+
+// queryWinners Queries the winners of the agency. While the draw is
+// pending, the query is repeated as soon as the server pushes that the
+// draw completed, or every LoopPeriod until LoopLapse expires.
+// While the server is busy, it is repeated when the server asks, and if
+// the connection fails, through the next server, keeping its request ID.
+// If the client is shut down in the meantime, nil winners are returned
+func (c *Client) queryWinners() ([]uint32, error) {
+	timeout := c.clock.After(c.config.LoopLapse)
+	request := c.tracer.frame(MsgWinnersQuery, nil)
+	for {
+		err := c.conn.send(request)
+		var reply Frame
+		if err == nil {
+			reply, err = c.conn.receive()
+		}
+		if err != nil {
+			err := c.failover(err, nil)
+			if err == errStopped {
+				log.Infof("action: graceful_shutdown | result: success | client_id: %v", c.config.ID)
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		payload, err := decodeReply(reply, MsgWinners)
+		var busy *ServerBusy
+		if errors.As(err, &busy) {
+			err := c.backOff(busy, request.RequestID)
+			if err == errStopped {
+				log.Infof("action: graceful_shutdown | result: success | client_id: %v", c.config.ID)
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		c.accepted()
+		if err == nil {
+			return DecodeWinners(payload)
+		}
+		var serverErr *ServerError
+		if !errors.As(err, &serverErr) || serverErr.Code != ErrorCodeDrawPending {
+			return nil, err
+		}
+
+		log.Debugf("action: consulta_ganadores | result: in_progress | client_id: %v | request_id: %v",
+			c.config.ID,
+			requestID(request.RequestID),
+		)
+		select {
+		case <-timeout:
+			return nil, fmt.Errorf("draw still pending after %v", c.config.LoopLapse)
+		case <-c.stop:
+			log.Infof("action: graceful_shutdown | result: success | client_id: %v", c.config.ID)
+			return nil, nil
+		case <-c.drawCompleted:
+		case <-c.clock.After(c.config.LoopPeriod):
+		}
+		request = c.tracer.frame(MsgWinnersQuery, nil)
+	}
+}
@@ -0,0 +1,159 @@
+package common
+
+import (
+	"encoding/csv"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Reasons a dataset record is rejected
+const (
+	ReasonFieldCount   = "field_count"
+	ReasonEmptyName    = "empty_name"
+	ReasonName         = "invalid_name"
+	ReasonDocument     = "invalid_document"
+	ReasonBirthdate    = "invalid_birthdate"
+	ReasonNumber       = "invalid_number"
+	ReasonAgency       = "agency_mismatch"
+	ReasonAgencyFormat = "invalid_agency"
+)
+
+// Ranges accepted for the fields of a bet
+const (
+	MinDocument = 1
+	MaxDocument = 99999999
+	MinNumber   = 0
+	MaxNumber   = 9999
+	// MaxNameSize Bytes of a name, the most the binary codec can encode
+	MaxNameSize = math.MaxUint8
+)
+
+// minBirthdate Earliest birthdate accepted
+var minBirthdate = time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Validator Checks the records of an agency dataset before they are batched
+type Validator struct {
+	agency int
+	now    time.Time
+}
+
+// NewValidator Creates a validator of the bets of the given agency.
+// Birthdates must be before now
+func NewValidator(agency int, now time.Time) Validator {
+	return Validator{agency: agency, now: now}
+}
+
+// ParseRecord Parses a dataset record as ParseBet does and validates the
+// bet. If the record is invalid, the reasons are returned, one per
+// invalid field
+func (v Validator) ParseRecord(record []string) (Bet, []string) {
+	if len(record) == betFields+1 {
+		agency, err := strconv.Atoi(record[0])
+		if err != nil {
+			return Bet{}, []string{ReasonAgencyFormat}
+		}
+		if agency != v.agency {
+			return Bet{}, []string{ReasonAgency}
+		}
+		record = record[1:]
+	}
+	if len(record) != betFields {
+		return Bet{}, []string{ReasonFieldCount}
+	}
+
+	bet, err := ParseBet(v.agency, record)
+	if err == nil {
+		return bet, v.Validate(bet)
+	}
+
+	// Report every field that cannot be parsed, not only the first one
+	var reasons []string
+	if strings.TrimSpace(record[0]) == "" || strings.TrimSpace(record[1]) == "" {
+		reasons = append(reasons, ReasonEmptyName)
+	}
+	if !validName(record[0]) || !validName(record[1]) {
+		reasons = append(reasons, ReasonName)
+	}
+	if _, err := strconv.Atoi(record[2]); err != nil {
+		reasons = append(reasons, ReasonDocument)
+	}
+	if _, err := time.Parse(BirthdateLayout, record[3]); err != nil {
+		reasons = append(reasons, ReasonBirthdate)
+	}
+	if _, err := strconv.Atoi(record[4]); err != nil {
+		reasons = append(reasons, ReasonNumber)
+	}
+	return Bet{}, reasons
+}
+
+// Validate Returns the reasons the bet is invalid, or nil if it is valid
+func (v Validator) Validate(bet Bet) []string {
+	var reasons []string
+	if bet.Agency != v.agency {
+		reasons = append(reasons, ReasonAgency)
+	}
+	if strings.TrimSpace(bet.FirstName) == "" || strings.TrimSpace(bet.LastName) == "" {
+		reasons = append(reasons, ReasonEmptyName)
+	}
+	if !validName(bet.FirstName) || !validName(bet.LastName) {
+		reasons = append(reasons, ReasonName)
+	}
+	if bet.Document < MinDocument || bet.Document > MaxDocument {
+		reasons = append(reasons, ReasonDocument)
+	}
+	if bet.Birthdate.Before(minBirthdate) || !bet.Birthdate.Before(v.now) {
+		reasons = append(reasons, ReasonBirthdate)
+	}
+	if bet.Number < MinNumber || bet.Number > MaxNumber {
+		reasons = append(reasons, ReasonNumber)
+	}
+	return reasons
+}
+
+// validName Checks that every bet codec can encode the name: the text
+// codec cannot encode its separators, and the binary one names longer than
+// MaxNameSize or that are not valid UTF-8. Names are checked the same way
+// whatever the codec, since the server may not accept the one configured
+func validName(name string) bool {
+	return !strings.ContainsAny(name, ",\n") && len(name) <= MaxNameSize && utf8.ValidString(name)
+}
+
+// Rejects Report of the dataset records rejected by validation. Every row
+// holds the dataset line, the reasons separated by ';' and the original
+// record fields
+type Rejects struct {
+	file   *os.File
+	writer *csv.Writer
+}
+
+// OpenRejects Opens the rejects file. Rows are appended, so the rows of an
+// interrupted upload are kept when it is resumed
+func OpenRejects(path string) (*Rejects, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not open rejects file %v", path)
+	}
+	return &Rejects{file: file, writer: csv.NewWriter(file)}, nil
+}
+
+// Write Adds a rejected record to the report
+func (r *Rejects) Write(line int, reasons []string, record []string) error {
+	row := append([]string{strconv.Itoa(line), strings.Join(reasons, ";")}, record...)
+	return r.writer.Write(row)
+}
+
+// Close Flushes the report and closes the file
+func (r *Rejects) Close() error {
+	r.writer.Flush()
+	if err := r.writer.Error(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
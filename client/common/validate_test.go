@@ -0,0 +1,36 @@
+package common
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidatorReportsEveryInvalidField(t *testing.T) {
+	validator := NewValidator(1, time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC))
+	tests := []struct {
+		record  []string
+		reasons []string
+	}{
+		{[]string{"Ana", "Lorca", "30904465", "1999-03-17", "7574"}, nil},
+		{[]string{"1", "Ana", "Lorca", "30904465", "1999-03-17", "7574"}, nil},
+		{[]string{"2", "Ana", "Lorca", "30904465", "1999-03-17", "7574"}, []string{ReasonAgency}},
+		{[]string{"Ana", "Lorca", "30904465"}, []string{ReasonFieldCount}},
+		{[]string{" ", "Lorca", "30904465", "1999-03-17", "7574"}, []string{ReasonEmptyName}},
+		{[]string{"Ana", "Lorca", "3090446x", "1999-02-30", "7574"}, []string{ReasonDocument, ReasonBirthdate}},
+		{[]string{"Ana", "Lorca", "0", "2030-01-01", "10000"}, []string{ReasonDocument, ReasonBirthdate, ReasonNumber}},
+		{[]string{"Ana", "", "123456789", "1899-12-31", "-1"}, []string{ReasonEmptyName, ReasonDocument, ReasonBirthdate, ReasonNumber}},
+		{[]string{"Lorca, Ana", "Lorca", "30904465", "1999-03-17", "7574"}, []string{ReasonName}},
+		{[]string{"Ana", "Lorca\nLopez", "30904465", "1999-03-17", "7574"}, []string{ReasonName}},
+		{[]string{strings.Repeat("a", MaxNameSize+1), "Lorca", "30904465", "1999-03-17", "7574"}, []string{ReasonName}},
+		{[]string{"Ana", "Lorca\xff", "30904465", "1999-03-17", "7574"}, []string{ReasonName}},
+		{[]string{"Ana, Maria", "Lorca", "3090446x", "1999-03-17", "7574"}, []string{ReasonName, ReasonDocument}},
+	}
+	for _, test := range tests {
+		_, reasons := validator.ParseRecord(test.record)
+		if !reflect.DeepEqual(reasons, test.reasons) {
+			t.Errorf("record %q: expected reasons %v, got %v", test.record, test.reasons, reasons)
+		}
+	}
+}
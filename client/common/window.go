@@ -0,0 +1,269 @@
+package common
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// inflightBatch Batch sent to the server and waiting for its reply
+type inflightBatch struct {
+	batch *EncodedBatch
+	// records Dataset records acknowledged once the batch is, counted from
+	// the start of the dataset
+	records int
+	acked   bool
+	// requestID ID of the request, kept when the batch is sent again
+	requestID uint64
+}
+
+// batchFrame Returns the frame of a batch in flight
+func (c *Client) batchFrame(inflight *inflightBatch) Frame {
+	return c.tracer.context(Frame{Type: MsgBatch, Payload: inflight.batch.Payload}, inflight.requestID)
+}
+
+// window Batches sent through the connection whose progress was not
+// recorded yet, in the order they were sent. The server may acknowledge
+// them in any order, but the progress only advances over the batches at
+// the front that were acknowledged, since it is a prefix of the dataset
+type window struct {
+	size    int
+	batches []*inflightBatch
+}
+
+// newWindow Creates a window of at most size batches in flight. If size
+// is not positive, batches are sent one at a time
+func newWindow(size int) *window {
+	if size <= 0 {
+		size = 1
+	}
+	return &window{size: size}
+}
+
+func (w *window) push(b *inflightBatch) {
+	w.batches = append(w.batches, b)
+}
+
+func (w *window) full() bool {
+	return len(w.batches) >= w.size
+}
+
+func (w *window) empty() bool {
+	return len(w.batches) == 0
+}
+
+// front Returns the oldest batch not acknowledged yet, or nil
+func (w *window) front() *inflightBatch {
+	if w.empty() {
+		return nil
+	}
+	return w.batches[0]
+}
+
+// find Returns the batch with the given ID, or nil if it is not in flight
+func (w *window) find(id uint32) *inflightBatch {
+	for _, b := range w.batches {
+		if b.batch.ID == id {
+			return b
+		}
+	}
+	return nil
+}
+
+// abandon Removes every batch, whose replies are no longer awaited
+func (w *window) abandon() {
+	w.batches = nil
+}
+
+// popAcked Removes and returns the acknowledged batches at the front
+func (w *window) popAcked() []*inflightBatch {
+	i := 0
+	for i < len(w.batches) && w.batches[i].acked {
+		i++
+	}
+	acked := w.batches[:i]
+	w.batches = w.batches[i:]
+	return acked
+}
+
+// sendUploadBatch Sends a batch ending at the given dataset record. Up to
+// the window size batches are sent without waiting for their replies;
+// once the window is full, the client waits for a reply before going on.
+// While the server has paused the client, and if the rate is limited, the
+// batch waits for its turn first.
+//
+// If the client is stopped while waiting, the batch is not sent and
+// errStopped is returned once the window is settled. Bets are time
+// sensitive, so if the server clock is too far off the batch is refused
+// with ErrClockSkew once the window is settled
+func (c *Client) sendUploadBatch(u *upload, batch *EncodedBatch, records int) error {
+	if skewErr := c.conn.skewErr; skewErr != nil {
+		if drainErr := c.drainWindow(u); drainErr != nil {
+			return drainErr
+		}
+		return skewErr
+	}
+	if c.gate.paused() {
+		// The replies in flight are received first, as the resume can only
+		// be read after them
+		if err := c.drainWindow(u); err != nil {
+			return err
+		}
+		if !c.gate.wait(c.stop) {
+			return errStopped
+		}
+	}
+	if c.limiter != nil {
+		if !c.limiter.Wait(batch.Count, len(batch.Payload), c.stop) {
+			if err := c.drainWindow(u); err != nil {
+				return err
+			}
+			return errStopped
+		}
+		if bets, bytes, ok := c.limiter.Rate(); ok {
+			log.Debugf("action: rate_limit | result: in_progress | client_id: %v | bets_per_second: %.1f | bytes_per_second: %.1f",
+				c.config.ID,
+				bets,
+				bytes,
+			)
+		}
+	}
+	inflight := &inflightBatch{batch: batch, records: records, requestID: c.tracer.nextID()}
+	u.window.push(inflight)
+	if err := c.conn.send(c.batchFrame(inflight)); err != nil {
+		log.Errorf("action: send_batch | result: fail | client_id: %v | batch_id: %v | request_id: %v | error_class: %v | error: %v",
+			c.config.ID,
+			batch.ID,
+			requestID(inflight.requestID),
+			errorClass(err),
+			err,
+		)
+		if err := c.failover(err, u); err != nil {
+			return err
+		}
+	}
+	for u.window.full() {
+		if err := c.awaitAck(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drainWindow Waits for the replies of every batch in flight
+func (c *Client) drainWindow(u *upload) error {
+	for !u.window.empty() {
+		if err := c.awaitAck(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// awaitAck Waits for the reply to one of the batches in flight. If the
+// server reports an error for a batch, the replies of the batches sent
+// before it are still awaited, so that their progress is recorded, the
+// rest are abandoned and the error is returned. Batches the server is too busy to handle are
+// sent again, and if the connection fails, every batch in flight is sent
+// again through the next server
+func (c *Client) awaitAck(u *upload) error {
+	ack, err := c.receiveAck()
+	var busy *ServerBusy
+	if errors.As(err, &busy) && u.window.find(busy.BatchID) != nil {
+		return c.retryBusy(u, busy)
+	}
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) && u.window.find(serverErr.BatchID) != nil {
+		log.Errorf("action: send_batch | result: fail | client_id: %v | batch_id: %v | request_id: %v | error_class: %v | error: %v",
+			c.config.ID,
+			serverErr.BatchID,
+			requestID(u.window.find(serverErr.BatchID).requestID),
+			errorClass(err),
+			err,
+		)
+		c.settleBefore(u, serverErr.BatchID)
+		u.window.abandon()
+		return err
+	}
+	if err != nil {
+		log.Errorf("action: send_batch | result: fail | client_id: %v | batch_id: %v | request_id: %v | error_class: %v | error: %v",
+			c.config.ID,
+			u.window.front().batch.ID,
+			requestID(u.window.front().requestID),
+			errorClass(err),
+			err,
+		)
+		return c.failover(err, u)
+	}
+	return c.ack(u, ack)
+}
+
+// ack Marks the acknowledged batch and records the progress made. The
+// progress is saved every time batches settle, so it survives the client
+// being killed mid upload
+func (c *Client) ack(u *upload, ack Ack) error {
+	inflight := u.window.find(ack.BatchID)
+	if inflight == nil || inflight.acked {
+		return fmt.Errorf("received acknowledgement of batch %v, which is not in flight", ack.BatchID)
+	}
+	inflight.acked = true
+	log.Infof("action: send_batch | result: success | client_id: %v | batch_id: %v | request_id: %v | bets: %v | bytes: %v",
+		c.config.ID,
+		inflight.batch.ID,
+		requestID(inflight.requestID),
+		inflight.batch.Count,
+		len(inflight.batch.Payload),
+	)
+
+	settled := u.window.popAcked()
+	for _, batch := range settled {
+		u.sent += batch.batch.Count
+		u.acked = Progress{Records: batch.records, Batch: batch.batch.ID}
+	}
+	if len(settled) > 0 {
+		c.saveProgress(u)
+	}
+	return nil
+}
+
+// retryBusy Sends again a batch the server was too busy to handle, after
+// the pause it asked for. If the client is stopped meanwhile or the server
+// stays busy for too long, the batches sent before it are settled and the
+// rest are abandoned, since the busy one will never be acknowledged, and
+// the error is returned
+func (c *Client) retryBusy(u *upload, busy *ServerBusy) error {
+	inflight := u.window.find(busy.BatchID)
+	err := c.backOff(busy, inflight.requestID)
+	if err != nil {
+		c.settleBefore(u, busy.BatchID)
+		u.window.abandon()
+		return err
+	}
+
+	if err := c.conn.send(c.batchFrame(inflight)); err != nil {
+		log.Errorf("action: send_batch | result: fail | client_id: %v | batch_id: %v | request_id: %v | error_class: %v | error: %v",
+			c.config.ID,
+			busy.BatchID,
+			requestID(inflight.requestID),
+			errorClass(err),
+			err,
+		)
+		return c.failover(err, u)
+	}
+	return nil
+}
+
+// settleBefore Waits for the replies of the batches in flight sent before
+// the failed one. Batches sent after it are abandoned
+func (c *Client) settleBefore(u *upload, failed uint32) {
+	for front := u.window.front(); front != nil && front.batch.ID < failed; front = u.window.front() {
+		ack, err := c.receiveAck()
+		if err != nil {
+			return
+		}
+		if err := c.ack(u, ack); err != nil {
+			return
+		}
+	}
+}
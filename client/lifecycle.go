@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stoppable Client operations driven by the lifecycle
+type stoppable interface {
+	// Stop Asks the client to finish gracefully
+	Stop()
+	// Close Abandons the request in flight
+	Close() error
+}
+
+// Lifecycle Runs the client and handles the process signals. SIGTERM and
+// SIGINT stop the client gracefully: it is given GracePeriod to finish the
+// request in flight before its connection is closed. SIGHUP calls Reload
+// without stopping the client
+type Lifecycle struct {
+	ID          string
+	GracePeriod time.Duration
+	Reload      func() error
+
+	client  stoppable
+	signals chan os.Signal
+}
+
+// NewLifecycle Creates the lifecycle of a client
+func NewLifecycle(id string, client stoppable, gracePeriod time.Duration) *Lifecycle {
+	return &Lifecycle{
+		ID:          id,
+		GracePeriod: gracePeriod,
+		client:      client,
+		signals:     make(chan os.Signal, 1),
+	}
+}
+
+// Run Runs fn until it returns, handling the signals received meanwhile.
+// The error returned by fn is returned
+func (l *Lifecycle) Run(fn func() error) error {
+	signal.Notify(l.signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(l.signals)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- fn()
+	}()
+
+	for {
+		select {
+		case err := <-result:
+			return err
+		case sig := <-l.signals:
+			if sig == syscall.SIGHUP {
+				l.reload()
+				continue
+			}
+			return l.shutdown(sig, result)
+		}
+	}
+}
+
+// reload Calls Reload, logging its outcome
+func (l *Lifecycle) reload() {
+	if l.Reload == nil {
+		return
+	}
+	if err := l.Reload(); err != nil {
+		log.Errorf("action: reload | result: fail | client_id: %v | error: %v", l.ID, err)
+		return
+	}
+	log.Infof("action: reload | result: success | client_id: %v", l.ID)
+}
+
+// shutdown Stops the client and waits for it to finish. Once the grace
+// period expires the connection is closed and the request in flight is
+// abandoned
+func (l *Lifecycle) shutdown(sig os.Signal, result chan error) error {
+	log.Infof("action: graceful_shutdown | result: in_progress | client_id: %v | signal: %v", l.ID, sig)
+	l.client.Stop()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(l.GracePeriod):
+	}
+
+	log.Warnf("action: forced_shutdown | result: in_progress | client_id: %v | grace_period: %v", l.ID, l.GracePeriod)
+	l.client.Close()
+	err := <-result
+	log.Warnf("action: forced_shutdown | result: success | client_id: %v", l.ID)
+	return err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeClient Client whose operation runs until it is stopped, or until it
+// is closed if it ignores Stop
+type fakeClient struct {
+	ignoreStop bool
+	stopped    chan struct{}
+	closed     chan struct{}
+}
+
+func newFakeClient(ignoreStop bool) *fakeClient {
+	return &fakeClient{ignoreStop: ignoreStop, stopped: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (c *fakeClient) Stop() { close(c.stopped) }
+
+func (c *fakeClient) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func (c *fakeClient) run() error {
+	if c.ignoreStop {
+		<-c.closed
+		return errors.New("connection closed")
+	}
+	<-c.stopped
+	return nil
+}
+
+func TestLifecycleStopsClientOnSigterm(t *testing.T) {
+	client := newFakeClient(false)
+	lifecycle := NewLifecycle("1", client, time.Hour)
+
+	lifecycle.signals <- syscall.SIGTERM
+	if err := lifecycle.Run(client.run); err != nil {
+		t.Fatalf("expected graceful shutdown, got %v", err)
+	}
+}
+
+func TestLifecycleClosesClientAfterGracePeriod(t *testing.T) {
+	client := newFakeClient(true)
+	lifecycle := NewLifecycle("1", client, 10*time.Millisecond)
+
+	lifecycle.signals <- syscall.SIGINT
+	if err := lifecycle.Run(client.run); err == nil {
+		t.Fatal("expected the abandoned operation to fail")
+	}
+}
+
+func TestLifecycleReloadsOnSighup(t *testing.T) {
+	client := newFakeClient(false)
+	lifecycle := NewLifecycle("1", client, time.Hour)
+	reloaded := make(chan struct{})
+	lifecycle.Reload = func() error {
+		close(reloaded)
+		return nil
+	}
+
+	lifecycle.signals <- syscall.SIGHUP
+	go func() {
+		<-reloaded
+		lifecycle.signals <- syscall.SIGTERM
+	}()
+	if err := lifecycle.Run(client.run); err != nil {
+		t.Fatalf("expected graceful shutdown, got %v", err)
+	}
+}
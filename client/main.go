@@ -32,9 +32,56 @@ func InitConfig() (*viper.Viper, error) {
 	// Add env variables supported
 	v.BindEnv("id")
 	v.BindEnv("server", "address")
+	v.BindEnv("server", "policy")
+	v.BindEnv("server", "cooldown")
 	v.BindEnv("loop", "period")
 	v.BindEnv("loop", "lapse")
 	v.BindEnv("log", "level")
+	v.BindEnv("tls.enabled")
+	v.BindEnv("tls.ca_file")
+	v.BindEnv("tls.server_name")
+	v.BindEnv("tls.min_version")
+	v.BindEnv("tls.cert_file")
+	v.BindEnv("tls.key_file")
+	v.BindEnv("tls.pins")
+	// The HMAC secret is never read from the config file baked in the image.
+	// Only the path of the file holding it is configured
+	v.BindEnv("hmac.secret_file")
+	v.BindEnv("compression.algorithm")
+	v.BindEnv("compression.threshold")
+	v.BindEnv("bets.dataset")
+	v.BindEnv("bets.dataset_entry")
+	v.BindEnv("bets.codec")
+	v.BindEnv("bets.progress_file")
+	v.BindEnv("bets.rejects_file")
+	v.BindEnv("bets.strict_validation")
+	v.BindEnv("bets.encoders")
+	v.BindEnv("bets.duplicates")
+	v.BindEnv("bets.duplicates_capacity")
+	v.BindEnv("batch.max_amount")
+	v.BindEnv("batch.window")
+	v.BindEnv("rate_limit.bets_per_second")
+	v.BindEnv("rate_limit.bytes_per_second")
+	v.BindEnv("rate_limit.bets_burst")
+	v.BindEnv("rate_limit.bytes_burst")
+	v.BindEnv("backpressure.max_wait")
+	v.BindEnv("breaker.failure_threshold")
+	v.BindEnv("breaker.cooldown")
+	v.BindEnv("breaker.max_probes")
+	v.BindEnv("breaker.backoff")
+	v.BindEnv("metrics.address")
+	v.BindEnv("timeouts.connect")
+	v.BindEnv("timeouts.read")
+	v.BindEnv("timeouts.write")
+	v.BindEnv("timeouts.keepalive")
+	v.BindEnv("heartbeat.interval")
+	v.BindEnv("heartbeat.missed_beats")
+	v.BindEnv("session.resume")
+	v.BindEnv("trace.enabled")
+	v.BindEnv("trace.parent")
+	v.BindEnv("clock_skew.warn_threshold")
+	v.BindEnv("clock_skew.refuse_threshold")
+	v.BindEnv("shutdown.grace_period")
 
 	// Try to read configuration from config file. If config file
 	// does not exists then ReadInConfig will fail but configuration
@@ -54,6 +101,68 @@ func InitConfig() (*viper.Viper, error) {
 		return nil, errors.Wrapf(err, "Could not parse CLI_LOOP_PERIOD env var as time.Duration.")
 	}
 
+	if _, err := time.ParseDuration(v.GetString("shutdown.grace_period")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_SHUTDOWN_GRACE_PERIOD env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("server.cooldown")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_SERVER_COOLDOWN env var as time.Duration.")
+	}
+
+	if err := common.ValidateServerPolicy(v.GetString("server.policy")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_SERVER_POLICY env var.")
+	}
+
+	for _, key := range []string{"timeouts.connect", "timeouts.read", "timeouts.write", "timeouts.keepalive"} {
+		if _, err := time.ParseDuration(v.GetString(key)); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse CLI_%v env var as time.Duration.", strings.ToUpper(strings.ReplaceAll(key, ".", "_")))
+		}
+	}
+
+	for _, key := range []string{"clock_skew.warn_threshold", "clock_skew.refuse_threshold"} {
+		if _, err := time.ParseDuration(v.GetString(key)); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse CLI_%v env var as time.Duration.", strings.ToUpper(strings.ReplaceAll(key, ".", "_")))
+		}
+	}
+
+	if _, err := time.ParseDuration(v.GetString("heartbeat.interval")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_HEARTBEAT_INTERVAL env var as time.Duration.")
+	}
+
+	if parent := v.GetString("trace.parent"); parent != "" {
+		if _, err := common.ParseTraceParent(parent); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse CLI_TRACE_PARENT env var.")
+		}
+	}
+
+	if _, err := time.ParseDuration(v.GetString("breaker.cooldown")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_BREAKER_COOLDOWN env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("breaker.backoff")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_BREAKER_BACKOFF env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("backpressure.max_wait")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_BACKPRESSURE_MAX_WAIT env var as time.Duration.")
+	}
+
+	if err := common.ValidateCompression(v.GetString("compression.algorithm")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_COMPRESSION_ALGORITHM env var.")
+	}
+
+	if _, err := common.NewBetCodec(v.GetString("bets.codec")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_BETS_CODEC env var.")
+	}
+
+	if err := common.ValidateDuplicatesPolicy(v.GetString("bets.duplicates")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_BETS_DUPLICATES env var.")
+	}
+
+	if _, err := common.ParseTLSVersion(v.GetString("tls.min_version")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_TLS_MIN_VERSION env var as a TLS version.")
+	}
+
 	return v, nil
 }
 
@@ -78,15 +187,36 @@ func InitLogger(logLevel string) error {
 // PrintConfig Print all the configuration parameters of the program.
 // For debugging purposes only
 func PrintConfig(v *viper.Viper) {
-	logrus.Infof("action: config | result: success | client_id: %s | server_address: %s | loop_lapse: %v | loop_period: %v | log_level: %s",
+	logrus.Infof("action: config | result: success | client_id: %s | server_address: %s | server_policy: %s | loop_lapse: %v | loop_period: %v | grace_period: %v | log_level: %s | tls_enabled: %v | hmac_enabled: %v | compression: %v | dataset: %v | codec: %v | batch_max_amount: %v | batch_window: %v",
 	    v.GetString("id"),
 	    v.GetString("server.address"),
+	    v.GetString("server.policy"),
 	    v.GetDuration("loop.lapse"),
 	    v.GetDuration("loop.period"),
+	    v.GetDuration("shutdown.grace_period"),
 	    v.GetString("log.level"),
+	    v.GetBool("tls.enabled"),
+	    v.GetString("hmac.secret_file") != "",
+	    v.GetString("compression.algorithm"),
+	    v.GetString("bets.dataset"),
+	    v.GetString("bets.codec"),
+	    v.GetInt("batch.max_amount"),
+	    v.GetInt("batch.window"),
     )
 }
 
+// splitList Splits a comma separated configuration value, ignoring
+// blank items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func main() {
 	v, err := InitConfig()
 	if err != nil {
@@ -102,11 +232,108 @@ func main() {
 
 	clientConfig := common.ClientConfig{
 		ServerAddress: v.GetString("server.address"),
+		// server.address may list several servers, separated by commas
+		ServerAddresses: splitList(v.GetString("server.address")),
+		ServerPolicy:    v.GetString("server.policy"),
+		ServerCooldown:  v.GetDuration("server.cooldown"),
 		ID:            v.GetString("id"),
 		LoopLapse:     v.GetDuration("loop.lapse"),
 		LoopPeriod:    v.GetDuration("loop.period"),
+		TLS: common.TLSConfig{
+			Enabled:    v.GetBool("tls.enabled"),
+			CAFile:     v.GetString("tls.ca_file"),
+			ServerName: v.GetString("tls.server_name"),
+			MinVersion: v.GetString("tls.min_version"),
+			CertFile:   v.GetString("tls.cert_file"),
+			KeyFile:    v.GetString("tls.key_file"),
+			Pins:       splitList(v.GetString("tls.pins")),
+		},
+		HMACSecretFile: v.GetString("hmac.secret_file"),
+		Compression: common.CompressionConfig{
+			Algorithm: v.GetString("compression.algorithm"),
+			Threshold: v.GetInt("compression.threshold"),
+		},
+		Bets: common.BetsConfig{
+			Dataset:            v.GetString("bets.dataset"),
+			DatasetEntry:       v.GetString("bets.dataset_entry"),
+			Codec:              v.GetString("bets.codec"),
+			BatchMaxAmount:     v.GetInt("batch.max_amount"),
+			Window:             v.GetInt("batch.window"),
+			ProgressFile:       v.GetString("bets.progress_file"),
+			RejectsFile:        v.GetString("bets.rejects_file"),
+			StrictValidation:   v.GetBool("bets.strict_validation"),
+			Encoders:           v.GetInt("bets.encoders"),
+			Duplicates:         v.GetString("bets.duplicates"),
+			DuplicatesCapacity: v.GetInt("bets.duplicates_capacity"),
+		},
+		RateLimit: common.RateLimitConfig{
+			BetsPerSecond:  v.GetFloat64("rate_limit.bets_per_second"),
+			BytesPerSecond: v.GetFloat64("rate_limit.bytes_per_second"),
+			BetsBurst:      v.GetFloat64("rate_limit.bets_burst"),
+			BytesBurst:     v.GetFloat64("rate_limit.bytes_burst"),
+		},
+		BusyMaxWait: v.GetDuration("backpressure.max_wait"),
+		Breaker: common.BreakerConfig{
+			FailureThreshold: v.GetInt("breaker.failure_threshold"),
+			Cooldown:         v.GetDuration("breaker.cooldown"),
+			MaxProbes:        v.GetInt("breaker.max_probes"),
+			Backoff:          v.GetDuration("breaker.backoff"),
+		},
+		Timeouts: common.TimeoutConfig{
+			Connect:   v.GetDuration("timeouts.connect"),
+			Read:      v.GetDuration("timeouts.read"),
+			Write:     v.GetDuration("timeouts.write"),
+			KeepAlive: v.GetDuration("timeouts.keepalive"),
+		},
+		Heartbeat: common.HeartbeatConfig{
+			Interval:    v.GetDuration("heartbeat.interval"),
+			MissedBeats: v.GetInt("heartbeat.missed_beats"),
+		},
+		ResumeSessions: v.GetBool("session.resume"),
+		Trace: common.TraceConfig{
+			Enabled: v.GetBool("trace.enabled"),
+			Parent:  v.GetString("trace.parent"),
+		},
+		ClockSkew: common.ClockSkewConfig{
+			WarnThreshold:   v.GetDuration("clock_skew.warn_threshold"),
+			RefuseThreshold: v.GetDuration("clock_skew.refuse_threshold"),
+		},
+	}
+
+	client, err := common.NewClient(clientConfig)
+	if err != nil {
+		log.Fatalf("action: create_client | result: fail | client_id: %v | error: %v", clientConfig.ID, err)
+	}
+
+	if address := v.GetString("metrics.address"); address != "" {
+		listener, err := ServeMetrics(address)
+		if err != nil {
+			log.Fatalf("action: serve_metrics | result: fail | client_id: %v | error: %v", clientConfig.ID, err)
+		}
+		defer listener.Close()
+		log.Infof("action: serve_metrics | result: success | client_id: %v | address: %v", clientConfig.ID, listener.Addr())
+	}
+
+	// The lifecycle handles the signals: SIGTERM and SIGINT stop the client,
+	// and SIGHUP reloads the log level. Other settings need a restart
+	lifecycle := NewLifecycle(clientConfig.ID, client, v.GetDuration("shutdown.grace_period"))
+	lifecycle.Reload = func() error {
+		v, err := InitConfig()
+		if err != nil {
+			return err
+		}
+		return InitLogger(v.GetString("log.level"))
 	}
 
-	client := common.NewClient(clientConfig)
-	client.StartClientLoop()
+	// Agencies with a dataset upload their bets. Otherwise the client keeps
+	// exchanging echo messages with the server
+	if clientConfig.Bets.Dataset == "" {
+		if err := lifecycle.Run(client.StartClientLoop); err != nil {
+			log.Fatalf("action: loop_finished | result: fail | client_id: %v | error: %v", clientConfig.ID, err)
+		}
+		return
+	}
+	if err := lifecycle.Run(client.SendBets); err != nil {
+		log.Fatalf("action: send_bets | result: fail | client_id: %v | error: %v", clientConfig.ID, err)
+	}
 }
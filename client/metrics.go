@@ -0,0 +1,21 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+)
+
+// ServeMetrics Serves the variables published with expvar, such as the
+// circuit breaker state, at /debug/vars on the given address. The server
+// runs until the returned listener is closed
+func ServeMetrics(address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	go http.Serve(listener, mux)
+	return listener, nil
+}
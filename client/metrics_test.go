@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+func TestServeMetricsExportsBreakerState(t *testing.T) {
+	config := common.ClientConfig{ID: "7", ServerAddress: "127.0.0.1:0"}
+	config.Breaker.FailureThreshold = 3
+	if _, err := common.NewClient(config); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := ServeMetrics("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	response, err := http.Get("http://" + listener.Addr().String() + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var vars struct {
+		States map[string]string `json:"circuit_breaker_state"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars.States["7"] != common.BreakerClosed {
+		t.Fatalf("expected breaker of agency 7 to be closed, got %v", vars.States)
+	}
+}
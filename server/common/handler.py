@@ -0,0 +1,160 @@
+import logging
+import time
+
+from common.lottery import LotteryBusy
+from common.protocol import *
+
+
+"""
+Answers the frames of a client connection. The connection settings
+negotiated in the hello, and the agency of the client, live as long as
+the connection does. Once the agency is known, the connection is bound
+to it: claims of another agency, in the hello or in the signature of a
+frame, are rejected.
+"""
+class ClientHandler:
+    def __init__(self, lottery, addr, agency=None, signer=None, push=None):
+        """
+        agency is the agency of the client certificate, if the client
+        presented one. signer is the Signer of the connection, if frames
+        are signed, whose nonces are exchanged in the hello. push sends a
+        frame to the client on its own, from any thread
+        """
+        self._lottery = lottery
+        self._addr = addr
+        self._agency = agency
+        self._signer = signer
+        self._push = push
+        self._codec = CODEC_TEXT
+        self._compression = None
+
+    def handle(self, frame: Frame, agency=None):
+        """
+        Returns the reply to a frame. agency is the agency that signed the
+        frame, if frames are signed. Compressed payloads are decompressed
+        with the algorithm negotiated in the hello, and replies are sent
+        uncompressed. A ProtocolError is raised if the frame claims another
+        agency than the one of the connection
+        """
+        if agency is not None:
+            self.__claim(agency)
+        if frame.flags & FLAG_COMPRESSED:
+            if self._compression is None:
+                raise ProtocolError('compressed frame without negotiated compression')
+            frame.payload = decompress(self._compression, frame.payload)
+            frame.flags &= ~FLAG_COMPRESSED
+        logging.debug(f'action: receive_message | result: success | ip: {self._addr} | '
+                      f'type: {frame.msg_type} | request_id: {frame.request_id:016x} | trace_parent: {frame.trace_parent}')
+
+        if frame.msg_type == MSG_ECHO:
+            msg = frame.payload.decode('utf-8', errors='replace')
+            logging.info(f'action: receive_message | result: success | ip: {self._addr} | request_id: {frame.request_id:016x} | trace_parent: {frame.trace_parent} | msg: {msg}')
+            return frame.reply(MSG_ECHO, frame.payload)
+        if frame.msg_type == MSG_PING:
+            return frame.reply(MSG_PONG, frame.payload)
+        if frame.msg_type == MSG_HELLO:
+            return frame.reply(MSG_HELLO, self.__hello(decode_hello(frame.payload)))
+        if frame.msg_type == MSG_BATCH:
+            return self.__batch(frame)
+        if frame.msg_type == MSG_DONE:
+            return self.__done(frame)
+        if frame.msg_type == MSG_WINNERS_QUERY:
+            return self.__winners(frame)
+        return frame.reply(MSG_ERROR, encode_error(0, ERROR_CODE_INTERNAL, f'unknown message type {frame.msg_type}'))
+
+    def __hello(self, offer: dict) -> bytes:
+        """
+        Accepts the codec offered if it is supported, and the first
+        compression algorithm offered that is supported. If frames are
+        signed, the nonces of the connection are exchanged
+        """
+        if offer.get('agency'):
+            self.__claim(offer['agency'])
+        if offer.get('codec') in (CODEC_TEXT, CODEC_BINARY):
+            self._codec = offer['codec']
+        accepted = {'agency': self._agency or '', 'codec': self._codec}
+        self._compression = negotiate_compression(offer.get('compression', ''))
+        if self._compression is not None:
+            accepted['compression'] = self._compression
+        if 'session' in offer and self._agency is not None:
+            token, last_batch = self._lottery.session(self._agency, offer['session'])
+            accepted['session'] = token
+            if last_batch is not None:
+                accepted['resumed'] = last_batch
+        accepted['time'] = time.time_ns()
+        if self._signer is not None:
+            try:
+                nonce = bytes.fromhex(offer.get('nonce', ''))
+            except ValueError as e:
+                raise ProtocolError(f'malformed nonce: {e}')
+            self._signer.bind(nonce)
+            accepted['nonce'] = self._signer.nonce.hex()
+        logging.info(f'action: handshake | result: success | ip: {self._addr} | agency: {self._agency} | codec: {self._codec} | compression: {self._compression}')
+        return encode_hello(accepted)
+
+    def __batch(self, frame: Frame) -> Frame:
+        """
+        Stores the bets of a batch and acknowledges it. Batches sent again
+        are acknowledged without storing them twice, and batches the
+        lottery is too busy to store are refused with a busy reply
+        """
+        batch_id = int.from_bytes(frame.payload[:4], byteorder='big') if len(frame.payload) >= 4 else 0
+        try:
+            batch_id, bets = decode_batch(frame.payload, self._codec)
+        except (ProtocolError, UnicodeDecodeError) as e:
+            logging.error(f'action: apuesta_recibida | result: fail | agency: {self._agency} | batch_id: {batch_id} | error: {e}')
+            return frame.reply(MSG_ERROR, encode_error(batch_id, ERROR_CODE_INVALID_BATCH, str(e)))
+        if self._agency is None and bets:
+            self._agency = str(bets[0].agency)
+        if any(str(bet.agency) != self._agency for bet in bets):
+            logging.error(f'action: apuesta_recibida | result: fail | agency: {self._agency} | batch_id: {batch_id} | error: bets of another agency')
+            return frame.reply(MSG_ERROR, encode_error(batch_id, ERROR_CODE_INVALID_BATCH, 'bets of another agency'))
+
+        try:
+            stored = self._lottery.store(self._agency, batch_id, bets)
+        except LotteryBusy as e:
+            logging.warning(f'action: apuesta_recibida | result: busy | agency: {self._agency} | batch_id: {batch_id} | retry_after_ms: {e.retry_after_ms}')
+            return frame.reply(MSG_BUSY, encode_busy(batch_id, e.retry_after_ms))
+        if stored:
+            logging.info(f'action: apuesta_recibida | result: success | agency: {self._agency} | batch_id: {batch_id} | cantidad: {len(bets)}')
+        return frame.reply(MSG_ACK, encode_ack(batch_id))
+
+    def __done(self, frame: Frame) -> Frame:
+        """
+        Registers that the agency finished sending its bets. If the draw
+        is still pending, the client is told once it takes place, so it
+        does not have to wait to query the winners again
+        """
+        if self._agency is None:
+            return frame.reply(MSG_ERROR, encode_error(0, ERROR_CODE_INTERNAL, 'unknown agency'))
+        on_draw = self.__push_draw if self._push is not None else None
+        if self._lottery.finish(self._agency, on_draw):
+            logging.info('action: sorteo | result: success')
+        return frame.reply(MSG_ACK, encode_ack(0))
+
+    def __push_draw(self):
+        """ Announces the client that the draw took place """
+        try:
+            self._push(Frame(MSG_PUSH, encode_push(PUSH_DRAW_COMPLETED, 'draw completed')))
+            logging.info(f'action: push | result: success | agency: {self._agency} | event: draw_completed')
+        except OSError as e:
+            # The client disconnected, and will query the winners once it
+            # connects again
+            logging.warning(f'action: push | result: fail | agency: {self._agency} | event: draw_completed | error: {e}')
+
+    def __winners(self, frame: Frame) -> Frame:
+        """ Answers the winners of the agency, once the draw took place """
+        if self._agency is None:
+            return frame.reply(MSG_ERROR, encode_error(0, ERROR_CODE_INTERNAL, 'unknown agency'))
+        winners = self._lottery.winners(self._agency)
+        if winners is None:
+            return frame.reply(MSG_ERROR, encode_error(0, ERROR_CODE_DRAW_PENDING, 'draw pending'))
+        return frame.reply(MSG_WINNERS, encode_winners(winners))
+
+    def __claim(self, agency: str):
+        """ Binds the connection to the agency, unless it is bound to another one """
+        if self._agency is None:
+            self._agency = agency
+        elif agency != self._agency:
+            logging.error(f'action: autenticar_agencia | result: fail | ip: {self._addr} | agency: {self._agency} | claimed: {agency}')
+            raise ProtocolError(f'agency {agency} does not match agency {self._agency} of the connection')
@@ -0,0 +1,113 @@
+import secrets
+import threading
+
+from common.utils import has_won, load_bets, store_bets
+
+
+class LotteryBusy(Exception):
+    """
+    Raised when a batch cannot be stored because too many are being
+    stored already. The client is asked to send it again after
+    retry_after_ms milliseconds
+    """
+    def __init__(self, retry_after_ms: int):
+        super().__init__(f'lottery busy, retry after {retry_after_ms} ms')
+        self.retry_after_ms = retry_after_ms
+
+
+"""
+Lottery shared by the connections of every agency. Batches are stored
+once per agency, so the batches a client sends again after losing a
+connection are only acknowledged. The draw takes place once every
+agency notified that it finished sending its bets.
+"""
+class Lottery:
+    def __init__(self, agencies: int, max_pending: int = 0, retry_after_ms: int = 0):
+        """
+        max_pending is the amount of batches that may wait to be stored at
+        once, without limit if it is 0. Batches beyond it are refused with
+        LotteryBusy, which asks to send them again after retry_after_ms
+        """
+        self._agencies = agencies
+        self._lock = threading.Lock()
+        self._pending = threading.BoundedSemaphore(max_pending) if max_pending > 0 else None
+        self._retry_after_ms = retry_after_ms
+        self._stored = {}
+        self._done = set()
+        self._sessions = {}
+        self._drawn = False
+        self._waiting = []
+
+    def store(self, agency: str, batch_id: int, bets: list) -> bool:
+        """
+        Stores the bets of a batch, unless the agency already stored it.
+        Returns whether the bets were stored. LotteryBusy is raised if too
+        many batches are waiting to be stored
+        """
+        if self._pending is not None and not self._pending.acquire(blocking=False):
+            raise LotteryBusy(self._retry_after_ms)
+        try:
+            with self._lock:
+                stored = self._stored.setdefault(agency, set())
+                if batch_id in stored:
+                    return False
+                store_bets(bets)
+                stored.add(batch_id)
+                return True
+        finally:
+            if self._pending is not None:
+                self._pending.release()
+
+    def finish(self, agency: str, on_draw=None) -> bool:
+        """
+        Registers that the agency finished sending its bets. Returns
+        whether the draw took place with it. If the draw is still pending,
+        on_draw is called once it takes place, from the thread of the agency
+        that completed it
+        """
+        with self._lock:
+            self._done.add(agency)
+            if self._drawn:
+                return False
+            if len(self._done) < self._agencies:
+                if on_draw is not None:
+                    self._waiting.append(on_draw)
+                return False
+            self._drawn = True
+            waiting, self._waiting = self._waiting, []
+        for notify in waiting:
+            notify()
+        return True
+
+    def winners(self, agency: str):
+        """
+        Returns the documents of the winners of the agency, or None if the
+        draw did not take place yet
+        """
+        with self._lock:
+            if not self._drawn:
+                return None
+            try:
+                return [bet.document for bet in load_bets()
+                        if str(bet.agency) == agency and has_won(bet)]
+            except FileNotFoundError:
+                # No agency stored any bet
+                return []
+
+    def session(self, agency: str, token: str):
+        """
+        Resumes the session of the agency with the given token, or starts
+        a new one if it is unknown. Returns the token of the session and,
+        if it was resumed, the last batch stored along with every batch
+        before it
+        """
+        with self._lock:
+            if self._sessions.get(token) == agency:
+                stored = self._stored.get(agency, set())
+                last_batch = 0
+                while last_batch + 1 in stored:
+                    last_batch += 1
+                return token, last_batch
+            token = secrets.token_hex(16)
+            self._sessions[token] = agency
+            return token, None
@@ -0,0 +1,441 @@
+import datetime
+import hashlib
+import hmac
+import os
+import zlib
+
+from common.utils import Bet
+
+
+""" Size of the length field that prefixes every frame. """
+FRAME_LENGTH_SIZE = 4
+""" Size of the message type and flags fields of every frame. """
+FRAME_HEADER_SIZE = 2
+""" Maximum size of a frame, length field included. """
+MAX_FRAME_SIZE = 8 * 1024
+""" Size of the request ID and trace parent length fields. """
+FRAME_CONTEXT_SIZE = 8 + 1
+
+""" Flag of the frames whose payload is wrapped in an HMAC envelope. """
+FLAG_SIGNED = 1 << 0
+""" Flag of the frames whose payload is compressed. """
+FLAG_COMPRESSED = 1 << 1
+""" Flag of the frames that carry a request ID and a trace parent. """
+FLAG_CONTEXT = 1 << 2
+
+""" Message types, as defined by the client. """
+MSG_ECHO = 1
+MSG_HELLO = 2
+MSG_BATCH = 3
+MSG_ACK = 4
+MSG_ERROR = 5
+MSG_DONE = 6
+MSG_WINNERS_QUERY = 7
+MSG_WINNERS = 8
+MSG_BUSY = 9
+MSG_PING = 10
+MSG_PONG = 11
+MSG_PUSH = 12
+
+""" Events the server pushes on its own in MSG_PUSH. """
+PUSH_DRAW_COMPLETED = 1
+
+""" Error codes sent in MSG_ERROR. """
+ERROR_CODE_INVALID_BATCH = 1
+ERROR_CODE_DRAW_PENDING = 2
+ERROR_CODE_INTERNAL = 3
+
+""" Bet codecs, negotiated in the hello. """
+CODEC_TEXT = 'text'
+CODEC_BINARY = 'binary'
+""" Size of the batch ID and amount of bets fields of a batch. """
+BATCH_HEADER_SIZE = 4 + 2
+""" Size of the fixed width fields of a bet in the binary codec. """
+BINARY_BET_FIXED_SIZE = 2 + 4 + 2 + 4
+
+""" Compression algorithms, in order of preference of the server. """
+COMPRESSION_GZIP = 'gzip'
+COMPRESSION_FLATE = 'flate'
+COMPRESSIONS = (COMPRESSION_GZIP, COMPRESSION_FLATE)
+""" Upper bound of a decompressed payload, as the client enforces. """
+MAX_DECOMPRESSED_SIZE = 64 * 1024
+
+""" Size of the MAC of a signed frame. """
+MAC_SIZE = hashlib.sha256().digest_size
+""" Directions of a signed frame, covered by its MAC. """
+DIRECTION_TO_SERVER = 1
+DIRECTION_TO_CLIENT = 2
+""" Size of the nonce the server picks for every signed connection. """
+NONCE_SIZE = 16
+
+
+class ProtocolError(ValueError):
+    """ Frame that is malformed or fails the HMAC verification. """
+
+
+""" A frame exchanged with a client. """
+class Frame:
+    def __init__(self, msg_type: int, payload: bytes, flags: int = 0,
+                 request_id: int = 0, trace_parent: str = ''):
+        self.msg_type = msg_type
+        self.flags = flags
+        self.payload = payload
+        self.request_id = request_id
+        self.trace_parent = trace_parent
+
+    def reply(self, msg_type: int, payload: bytes) -> 'Frame':
+        """
+        Creates the reply to the frame, which carries its request context
+        so the client can match it to the request
+        """
+        return Frame(msg_type, payload, request_id=self.request_id,
+                     trace_parent=self.trace_parent)
+
+
+def read_frame(sock):
+    """
+    Reads a complete frame from the socket, avoiding short-reads
+
+    Frames are encoded as a big endian uint32 length followed by that
+    amount of bytes: message type, flags, the request context if
+    FLAG_CONTEXT is set and the payload. None is returned if the client
+    closes the connection between frames
+    """
+    header = recv_exact(sock, FRAME_LENGTH_SIZE, allow_eof=True)
+    if header is None:
+        return None
+    length = int.from_bytes(header, byteorder='big')
+    if length < FRAME_HEADER_SIZE or length > MAX_FRAME_SIZE - FRAME_LENGTH_SIZE:
+        raise ProtocolError(f'invalid frame length {length}')
+    body = recv_exact(sock, length)
+
+    frame = Frame(body[0], body[FRAME_HEADER_SIZE:], flags=body[1])
+    if frame.flags & FLAG_CONTEXT:
+        context = frame.payload
+        if len(context) < FRAME_CONTEXT_SIZE:
+            raise ProtocolError('invalid frame context')
+        end = FRAME_CONTEXT_SIZE + context[8]
+        if len(context) < end:
+            raise ProtocolError('invalid frame context')
+        frame.request_id = int.from_bytes(context[:8], byteorder='big')
+        frame.trace_parent = context[FRAME_CONTEXT_SIZE:end].decode('ascii', errors='replace')
+        frame.payload = context[end:]
+    return frame
+
+
+def encode_frame(frame: Frame) -> bytes:
+    """ Encodes a frame, setting FLAG_CONTEXT if it carries a context """
+    flags = frame.flags
+    context = b''
+    if frame.request_id or frame.trace_parent:
+        flags |= FLAG_CONTEXT
+    if flags & FLAG_CONTEXT:
+        context = encode_context(frame)
+    body = bytes([frame.msg_type, flags]) + context + frame.payload
+    if FRAME_LENGTH_SIZE + len(body) > MAX_FRAME_SIZE:
+        raise ProtocolError('frame exceeds maximum size')
+    return len(body).to_bytes(FRAME_LENGTH_SIZE, byteorder='big') + body
+
+
+def encode_context(frame: Frame) -> bytes:
+    """ Encodes the request ID and trace parent of a frame """
+    trace_parent = frame.trace_parent.encode('ascii')
+    return frame.request_id.to_bytes(8, byteorder='big') + bytes([len(trace_parent)]) + trace_parent
+
+
+def write_frame(sock, frame: Frame) -> None:
+    """ Writes a complete frame to the socket, avoiding short-writes """
+    sock.sendall(encode_frame(frame))
+
+
+def recv_exact(sock, size, allow_eof=False):
+    """
+    Receive exactly size bytes from the socket, avoiding short-reads
+
+    An OSError is raised if the client closes the connection before
+    sending all the bytes. If allow_eof is set and the client closes
+    the connection before sending any byte, None is returned
+    """
+    data = b''
+    while len(data) < size:
+        chunk = sock.recv(size - len(data))
+        if not chunk:
+            if allow_eof and not data:
+                return None
+            raise OSError('connection closed by client')
+        data += chunk
+    return data
+
+
+def decode_hello(payload: bytes) -> dict:
+    """
+    Parses a hello, encoded as "key=value" lines. Unknown keys are kept,
+    so the caller can ignore them
+    """
+    hello = {}
+    for line in payload.decode('utf-8').split('\n'):
+        if not line:
+            continue
+        key, sep, value = line.partition('=')
+        if not sep:
+            raise ProtocolError(f'malformed hello line {line!r}')
+        hello[key] = value
+    return hello
+
+
+def encode_hello(hello: dict) -> bytes:
+    """ Serializes a hello as "key=value" lines """
+    return ''.join(f'{key}={value}\n' for key, value in hello.items()).encode('utf-8')
+
+
+def decode_batch(payload: bytes, codec: str):
+    """
+    Parses a batch, returning its ID and bets. The bets are encoded with
+    the codec negotiated for the connection
+    """
+    if len(payload) < BATCH_HEADER_SIZE:
+        raise ProtocolError('malformed batch')
+    batch_id = int.from_bytes(payload[:4], byteorder='big')
+    amount = int.from_bytes(payload[4:6], byteorder='big')
+    decode_bet = _decode_binary_bet if codec == CODEC_BINARY else _decode_text_bet
+    bets = []
+    offset = BATCH_HEADER_SIZE
+    for _ in range(amount):
+        bet, offset = decode_bet(payload, offset)
+        bets.append(bet)
+    if offset != len(payload):
+        raise ProtocolError('malformed batch')
+    return batch_id, bets
+
+
+def _decode_text_bet(payload, offset):
+    """
+    Decodes the bet line that starts at offset:
+    agency,first name,last name,document,birthdate,number
+    """
+    end = payload.find(b'\n', offset)
+    if end < 0:
+        raise ProtocolError('malformed bet')
+    fields = payload[offset:end].decode('utf-8').split(',')
+    if len(fields) != 6:
+        raise ProtocolError('malformed bet')
+    try:
+        return Bet(*fields), end + 1
+    except ValueError as e:
+        raise ProtocolError(f'malformed bet: {e}')
+
+
+def _decode_binary_bet(payload, offset):
+    """
+    Decodes the binary bet that starts at offset:
+    | agency (uint16) | document (uint32) | number (uint16) | birthdate (int32) |
+    | first name length (uint8) | first name | last name length (uint8) | last name |
+    where birthdate is the amount of days since the Unix epoch
+    """
+    if len(payload) < offset + BINARY_BET_FIXED_SIZE:
+        raise ProtocolError('malformed bet')
+    agency = int.from_bytes(payload[offset:offset + 2], byteorder='big')
+    document = int.from_bytes(payload[offset + 2:offset + 6], byteorder='big')
+    number = int.from_bytes(payload[offset + 6:offset + 8], byteorder='big')
+    days = int.from_bytes(payload[offset + 8:offset + 12], byteorder='big', signed=True)
+    offset += BINARY_BET_FIXED_SIZE
+    names = []
+    for _ in range(2):
+        if len(payload) < offset + 1 or len(payload) < offset + 1 + payload[offset]:
+            raise ProtocolError('malformed bet')
+        size = payload[offset]
+        try:
+            names.append(payload[offset + 1:offset + 1 + size].decode('utf-8'))
+        except UnicodeDecodeError:
+            raise ProtocolError('malformed bet')
+        offset += 1 + size
+    birthdate = datetime.date(1970, 1, 1) + datetime.timedelta(days=days)
+    return Bet(str(agency), names[0], names[1], str(document), birthdate.isoformat(), str(number)), offset
+
+
+def negotiate_compression(offer: str):
+    """
+    Returns the first algorithm of the comma separated offer of the
+    client that the server supports, or None
+    """
+    for algorithm in offer.split(','):
+        if algorithm in COMPRESSIONS:
+            return algorithm
+    return None
+
+
+def decompress(algorithm: str, payload: bytes) -> bytes:
+    """
+    Decompresses a payload with the given algorithm: gzip or raw deflate,
+    as the client compresses them. Payloads that are malformed or expand
+    beyond MAX_DECOMPRESSED_SIZE raise a ProtocolError
+    """
+    wbits = 16 + zlib.MAX_WBITS if algorithm == COMPRESSION_GZIP else -zlib.MAX_WBITS
+    decompressor = zlib.decompressobj(wbits)
+    try:
+        data = decompressor.decompress(payload, MAX_DECOMPRESSED_SIZE + 1)
+    except zlib.error as e:
+        raise ProtocolError(f'malformed compressed payload: {e}')
+    if len(data) > MAX_DECOMPRESSED_SIZE:
+        raise ProtocolError('decompressed payload exceeds maximum size')
+    if not decompressor.eof:
+        raise ProtocolError('truncated compressed payload')
+    return data
+
+
+def encode_ack(batch_id: int) -> bytes:
+    """ Serializes the acknowledgement of a batch """
+    return batch_id.to_bytes(4, byteorder='big')
+
+
+def encode_error(batch_id: int, code: int, message: str) -> bytes:
+    """ Serializes an error, referring to batch 0 if it is not about a batch """
+    message = message.encode('utf-8')[:0xffff]
+    return (batch_id.to_bytes(4, byteorder='big') + code.to_bytes(2, byteorder='big') +
+            len(message).to_bytes(2, byteorder='big') + message)
+
+
+def encode_busy(batch_id: int, retry_after_ms: int) -> bytes:
+    """
+    Serializes the reply to a request the server is too busy to handle,
+    which the client sends again after retry_after_ms milliseconds
+    """
+    return batch_id.to_bytes(4, byteorder='big') + retry_after_ms.to_bytes(4, byteorder='big')
+
+
+def encode_push(event: int, message: str) -> bytes:
+    """ Serializes an announcement the server sends on its own """
+    return bytes([event]) + message.encode('utf-8')
+
+
+def encode_winners(documents: list) -> bytes:
+    """ Serializes the documents of the winners of an agency """
+    payload = len(documents).to_bytes(4, byteorder='big')
+    for document in documents:
+        payload += int(document).to_bytes(4, byteorder='big')
+    return payload
+
+
+def load_secrets(directory: str) -> dict:
+    """
+    Loads the HMAC secrets of the agencies from a directory holding a
+    file per agency, named after its ID. Surrounding whitespace is
+    ignored, as the client does
+    """
+    secrets = {}
+    for name in os.listdir(directory):
+        with open(os.path.join(directory, name), 'rb') as file:
+            secret = file.read().strip()
+        if not secret:
+            raise ValueError(f'HMAC secret file {name} is empty')
+        secrets[name] = secret
+    return secrets
+
+
+"""
+Verifies the frames of a connection and signs its replies with the
+secret of the agency of the client. Each direction has its own
+sequence, which must strictly increase, so a signer is created for
+every connection and a client frame reflected back is rejected. Each
+side picks a nonce for the connection, sent in the hello, which the
+frames it receives must cover, so frames recorded on another
+connection are rejected. The client hello is signed before it knows
+the nonce of the server, so it must be the first frame.
+"""
+class Signer:
+    def __init__(self, secrets: dict):
+        self._secrets = secrets
+        self._agency = None
+        self._sent_seq = 0
+        self._recv_seq = 0
+        self._nonce = os.urandom(NONCE_SIZE)
+        self._peer_nonce = None
+
+    def open(self, frame: Frame) -> Frame:
+        """
+        Verifies a signed frame and returns it with the original payload.
+        The first frame binds the connection to its agency, whose frames
+        are the only ones accepted afterwards
+        """
+        if not frame.flags & FLAG_SIGNED:
+            raise ProtocolError('frame is not signed')
+        if self._peer_nonce is None and frame.msg_type != MSG_HELLO:
+            raise ProtocolError('signed connection did not start with a hello')
+        envelope = frame.payload
+        if len(envelope) < 1 or len(envelope) < 1 + envelope[0] + 8 + MAC_SIZE:
+            raise ProtocolError('frame signature mismatch')
+        agency_len = envelope[0]
+        agency = envelope[1:1 + agency_len]
+        seq = int.from_bytes(envelope[1 + agency_len:1 + agency_len + 8], byteorder='big')
+        payload = envelope[1 + agency_len + 8:len(envelope) - MAC_SIZE]
+        mac = envelope[len(envelope) - MAC_SIZE:]
+
+        name = agency.decode('utf-8', errors='replace')
+        secret = self._secrets.get(name)
+        if secret is None or (self._agency is not None and name != self._agency):
+            raise ProtocolError('frame signature mismatch')
+        nonce = self._nonce if self._peer_nonce is not None else b''
+        expected = compute_mac(secret, DIRECTION_TO_SERVER, frame, nonce, agency, seq, payload)
+        if not hmac.compare_digest(mac, expected):
+            raise ProtocolError('frame signature mismatch')
+        if seq <= self._recv_seq:
+            raise ProtocolError('frame sequence replayed')
+        self._agency = name
+        self._recv_seq = seq
+
+        frame.flags &= ~FLAG_SIGNED
+        frame.payload = payload
+        return frame
+
+    def bind(self, peer_nonce: bytes):
+        """
+        Sets the nonce the client picked for the connection, which the
+        replies cover. The client frames that follow must cover the nonce
+        of the server
+        """
+        if not peer_nonce:
+            raise ProtocolError('hello of a signed connection without nonce')
+        self._peer_nonce = peer_nonce
+
+    def seal(self, frame: Frame) -> Frame:
+        """
+        Wraps the payload of a reply in a signed envelope using the next
+        sequence number of the server
+        """
+        self._sent_seq += 1
+        frame.flags |= FLAG_SIGNED
+        if frame.request_id or frame.trace_parent:
+            frame.flags |= FLAG_CONTEXT
+        agency = self._agency.encode('utf-8')
+        seq = self._sent_seq.to_bytes(8, byteorder='big')
+        mac = compute_mac(self._secrets[self._agency], DIRECTION_TO_CLIENT, frame,
+                          self._peer_nonce or b'', agency, self._sent_seq, frame.payload)
+        frame.payload = bytes([len(agency)]) + agency + seq + frame.payload + mac
+        return frame
+
+    @property
+    def agency(self):
+        """ Agency the connection is bound to, None before its first frame """
+        return self._agency
+
+    @property
+    def nonce(self) -> bytes:
+        """ Nonce of the server for the connection, sent in the hello """
+        return self._nonce
+
+
+def compute_mac(secret, direction, frame, nonce, agency, seq, payload):
+    """
+    HMAC-SHA256 of a signed frame, as computed by the client. It covers
+    the request context if the frame carries one
+    """
+    m = hmac.new(secret, digestmod=hashlib.sha256)
+    m.update(bytes([direction, frame.msg_type, frame.flags, len(nonce)]))
+    m.update(nonce)
+    m.update(bytes([len(agency)]))
+    m.update(agency)
+    m.update(seq.to_bytes(8, byteorder='big'))
+    if frame.flags & FLAG_CONTEXT:
+        m.update(encode_context(frame))
+    m.update(payload)
+    return m.digest()
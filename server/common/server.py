@@ -1,10 +1,31 @@
 import signal
 import socket
 import logging
+import threading
+
+from common.handler import ClientHandler
+from common.lottery import Lottery
+from common.protocol import Signer, read_frame, write_frame
+from common.tls import certificate_agency
 
 
 class Server:
-    def __init__(self, port, listen_backlog):
+    def __init__(self, port, listen_backlog, agencies, secrets=None, tls_context=None,
+                 max_pending_batches=0, busy_retry_after_ms=0):
+        """
+        agencies is the amount of agencies that take part in the lottery,
+        which is drawn once all of them sent their bets. Once
+        max_pending_batches batches wait to be stored, if it is not 0, the
+        rest are refused with a busy reply that asks to send them again
+        after busy_retry_after_ms. secrets maps the
+        ID of every agency to its HMAC secret. If it is set, frames must be
+        signed by an agency and replies are signed. If tls_context is set,
+        connections are served over TLS, and client certificates bind
+        them to the agency they name
+        """
+        self._lottery = Lottery(agencies, max_pending_batches, busy_retry_after_ms)
+        self._secrets = secrets
+        self._tls_context = tls_context
         # Initialize server socket
         self._server_socket = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
         self._server_socket.bind(('', port))
@@ -15,8 +36,9 @@ class Server:
         Dummy Server loop
 
         Server that accept a new connections and establishes a
-        communication with a client. After client with communucation
-        finishes, servers starts to accept new connections again
+        communication with a client. Every connection is handled by a
+        thread of its own, so that clients waiting for the draw do not
+        keep the rest of the agencies from sending their bets
         """
 
         # TODO: Modify this program to handle signal to graceful shutdown
@@ -30,24 +52,49 @@ class Server:
                 logging.info("action: graceful_shutdown | result: success")
                 return
             
-            self.__handle_client_connection(client_sock)
+            threading.Thread(target=self.__handle_client_connection, args=(client_sock,), daemon=True).start()
 
     def __handle_client_connection(self, client_sock):
         """
-        Read message from a specific client socket and closes the socket
+        Read frames from a specific client socket, answer them and
+        closes the socket once the client disconnects
 
-        If a problem arises in the communication with the client, the
-        client socket will also be closed
+        Replies carry the request context of the client. If HMAC secrets
+        are configured, frames are verified and the replies, as well as the
+        pushes sent once the draw takes place, are signed with the sequence
+        of the server. If a problem arises in the
+        communication with the client, the client socket will also be
+        closed
         """
+        signer = Signer(self._secrets) if self._secrets is not None else None
+        write_lock = threading.Lock()
+
+        def send(frame):
+            # Pushes are sent from the threads of other connections, so
+            # frames are signed and written one at a time
+            with write_lock:
+                if signer is not None:
+                    frame = signer.seal(frame)
+                write_frame(client_sock, frame)
+
         try:
-            # TODO: Modify the receive to avoid short-reads
-            msg = client_sock.recv(1024).rstrip().decode('utf-8')
             addr = client_sock.getpeername()
-            logging.info(f'action: receive_message | result: success | ip: {addr[0]} | msg: {msg}')
-            # TODO: Modify the send to avoid short-writes
-            client_sock.send("{}\n".format(msg).encode('utf-8'))
-        except OSError as e:
-            logging.error("action: receive_message | result: fail | error: {e}")
+            agency = None
+            if self._tls_context is not None:
+                client_sock = self._tls_context.wrap_socket(client_sock, server_side=True)
+                agency = certificate_agency(client_sock.getpeercert())
+                logging.info(f'action: tls_handshake | result: success | ip: {addr[0]} | agency: {agency}')
+            handler = ClientHandler(self._lottery, addr[0], agency, signer, send)
+            while True:
+                frame = read_frame(client_sock)
+                if frame is None:
+                    break
+                if signer is not None:
+                    frame = signer.open(frame)
+                send(handler.handle(frame, signer.agency if signer is not None else None))
+        except (OSError, ValueError) as e:
+            # ssl.SSLError is an OSError, so failed TLS handshakes end here
+            logging.error(f"action: receive_message | result: fail | error: {e}")
         finally:
             client_sock.close()
 
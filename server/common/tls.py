@@ -0,0 +1,37 @@
+import ssl
+
+
+""" Prefix of the common name of the client certificate of an agency. """
+AGENCY_COMMON_NAME_PREFIX = 'agency-'
+
+
+def server_context(cert_file: str, key_file: str, client_ca_file: str) -> ssl.SSLContext:
+    """
+    Creates the TLS context of the server. If a client CA is given,
+    clients must present a certificate it signed, whose common name
+    identifies their agency
+    """
+    context = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
+    context.minimum_version = ssl.TLSVersion.TLSv1_2
+    context.load_cert_chain(cert_file, key_file)
+    if client_ca_file:
+        context.load_verify_locations(client_ca_file)
+        context.verify_mode = ssl.CERT_REQUIRED
+    return context
+
+
+def certificate_agency(cert):
+    """
+    Returns the agency of a client certificate, as returned by
+    SSLSocket.getpeercert, or None if the client did not present one.
+    A ValueError is raised if its common name does not name an agency
+    """
+    if not cert:
+        return None
+    for rdn in cert.get('subject', ()):
+        for key, value in rdn:
+            if key == 'commonName':
+                if not value.startswith(AGENCY_COMMON_NAME_PREFIX) or len(value) == len(AGENCY_COMMON_NAME_PREFIX):
+                    raise ValueError(f'certificate common name {value!r} does not name an agency')
+                return value[len(AGENCY_COMMON_NAME_PREFIX):]
+    raise ValueError('certificate has no common name')
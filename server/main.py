@@ -1,7 +1,9 @@
 #!/usr/bin/env python3
 
 from configparser import ConfigParser
+from common.protocol import load_secrets
 from common.server import Server
+from common.tls import server_context
 import logging
 import os
 
@@ -26,6 +28,17 @@ def initialize_config():
         config_params["port"] = int(os.getenv('SERVER_PORT', config["DEFAULT"]["SERVER_PORT"]))
         config_params["listen_backlog"] = int(os.getenv('SERVER_LISTEN_BACKLOG', config["DEFAULT"]["SERVER_LISTEN_BACKLOG"]))
         config_params["logging_level"] = os.getenv('LOGGING_LEVEL', config["DEFAULT"]["LOGGING_LEVEL"])
+        config_params["lottery_agencies"] = int(os.getenv('LOTTERY_AGENCIES', config["DEFAULT"]["LOTTERY_AGENCIES"]))
+        # Batches are stored without limit unless a maximum is set
+        config_params["max_pending_batches"] = int(os.getenv('LOTTERY_MAX_PENDING_BATCHES', config["DEFAULT"].get("LOTTERY_MAX_PENDING_BATCHES", "0")))
+        config_params["busy_retry_after_ms"] = int(os.getenv('LOTTERY_BUSY_RETRY_AFTER_MS', config["DEFAULT"].get("LOTTERY_BUSY_RETRY_AFTER_MS", "100")))
+        # TLS is optional, and so is the verification of client certificates
+        config_params["tls_enabled"] = os.getenv('TLS_ENABLED', config["DEFAULT"].get("TLS_ENABLED", "false")).lower() == "true"
+        config_params["tls_cert_file"] = os.getenv('TLS_CERT_FILE', config["DEFAULT"].get("TLS_CERT_FILE", ""))
+        config_params["tls_key_file"] = os.getenv('TLS_KEY_FILE', config["DEFAULT"].get("TLS_KEY_FILE", ""))
+        config_params["tls_client_ca_file"] = os.getenv('TLS_CLIENT_CA_FILE', config["DEFAULT"].get("TLS_CLIENT_CA_FILE", ""))
+        # Signing is optional, so the directory of HMAC secrets may be unset
+        config_params["hmac_secrets_dir"] = os.getenv('HMAC_SECRETS_DIR', config["DEFAULT"].get("HMAC_SECRETS_DIR", ""))
     except KeyError as e:
         raise KeyError("Key was not found. Error: {} .Aborting server".format(e))
     except ValueError as e:
@@ -39,16 +52,32 @@ def main():
     logging_level = config_params["logging_level"]
     port = config_params["port"]
     listen_backlog = config_params["listen_backlog"]
+    lottery_agencies = config_params["lottery_agencies"]
+    max_pending_batches = config_params["max_pending_batches"]
+    busy_retry_after_ms = config_params["busy_retry_after_ms"]
+    hmac_secrets_dir = config_params["hmac_secrets_dir"]
+    tls_enabled = config_params["tls_enabled"]
+    tls_client_ca_file = config_params["tls_client_ca_file"]
 
     initialize_log(logging_level)
 
     # Log config parameters at the beginning of the program to verify the configuration
     # of the component
     logging.debug(f"action: config | result: success | port: {port} | "
-                  f"listen_backlog: {listen_backlog} | logging_level: {logging_level}")
+                  f"listen_backlog: {listen_backlog} | logging_level: {logging_level} | "
+                  f"lottery_agencies: {lottery_agencies} | max_pending_batches: {max_pending_batches} | "
+                  f"busy_retry_after_ms: {busy_retry_after_ms} | "
+                  f"hmac_enabled: {bool(hmac_secrets_dir)} | tls_enabled: {tls_enabled} | "
+                  f"client_certificates: {tls_enabled and bool(tls_client_ca_file)}")
+
+    secrets = load_secrets(hmac_secrets_dir) if hmac_secrets_dir else None
+    tls_context = None
+    if tls_enabled:
+        tls_context = server_context(config_params["tls_cert_file"], config_params["tls_key_file"], tls_client_ca_file)
 
     # Initialize server and start server loop
-    server = Server(port, listen_backlog)
+    server = Server(port, listen_backlog, lottery_agencies, secrets, tls_context,
+                    max_pending_batches, busy_retry_after_ms)
     server.run()
 
 def initialize_log(logging_level):
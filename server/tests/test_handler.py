@@ -0,0 +1,57 @@
+from common.handler import ClientHandler
+from common.lottery import Lottery
+from common.protocol import *
+import threading
+import unittest
+from unittest import mock
+
+
+def batch_frame(batch_id):
+    """ Batch of a single bet of agency 1, encoded with the text codec """
+    payload = batch_id.to_bytes(4, byteorder='big') + (1).to_bytes(2, byteorder='big') + \
+        b'1,Ana,Di Lorenzo,24543210,1970-01-30,15\n'
+    return Frame(MSG_BATCH, payload)
+
+
+class TestClientHandler(unittest.TestCase):
+
+    def test_batch_is_refused_while_lottery_busy(self):
+        lottery = Lottery(1, max_pending=1, retry_after_ms=250)
+        storing = threading.Event()
+        release = threading.Event()
+
+        def store_bets(bets):
+            storing.set()
+            release.wait()
+
+        with mock.patch('common.lottery.store_bets', store_bets):
+            first = threading.Thread(target=lottery.store, args=('1', 1, []))
+            first.start()
+            storing.wait()
+            try:
+                reply = ClientHandler(lottery, '127.0.0.1', '1').handle(batch_frame(2))
+            finally:
+                release.set()
+                first.join()
+            self.assertEqual(MSG_BUSY, reply.msg_type)
+            self.assertEqual(encode_busy(2, 250), reply.payload)
+
+            reply = ClientHandler(lottery, '127.0.0.1', '1').handle(batch_frame(2))
+            self.assertEqual(MSG_ACK, reply.msg_type)
+
+    def test_draw_is_pushed_to_waiting_agencies(self):
+        lottery = Lottery(2)
+        pushed = []
+        first = ClientHandler(lottery, '127.0.0.1', '1', push=pushed.append)
+        self.assertEqual(MSG_ACK, first.handle(Frame(MSG_DONE, b'')).msg_type)
+        self.assertEqual([], pushed)
+
+        second = ClientHandler(lottery, '127.0.0.1', '2', push=pushed.append)
+        self.assertEqual(MSG_ACK, second.handle(Frame(MSG_DONE, b'')).msg_type)
+        self.assertEqual(1, len(pushed))
+        self.assertEqual(MSG_PUSH, pushed[0].msg_type)
+        self.assertEqual(PUSH_DRAW_COMPLETED, pushed[0].payload[0])
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,182 @@
+from common.protocol import *
+from common.tls import certificate_agency
+import gzip
+import socket
+import unittest
+import zlib
+
+
+""" Nonce of the client in the tests. """
+CLIENT_NONCE = b'client-nonce'
+
+
+def client_seal(secret, agency, seq, frame, nonce=b''):
+    """ Signs a frame as the client does, covering the nonce of the server """
+    frame.flags |= FLAG_SIGNED
+    if frame.request_id or frame.trace_parent:
+        frame.flags |= FLAG_CONTEXT
+    agency = agency.encode('utf-8')
+    mac = compute_mac(secret, DIRECTION_TO_SERVER, frame, nonce, agency, seq, frame.payload)
+    frame.payload = bytes([len(agency)]) + agency + seq.to_bytes(8, byteorder='big') + frame.payload + mac
+    return frame
+
+
+def handshake(signer, secret=b'secret', agency='1'):
+    """
+    Opens the signed hello of the client with sequence 1 and exchanges the
+    nonces, as the handler does
+    """
+    signer.open(client_seal(secret, agency, 1, Frame(MSG_HELLO, b'')))
+    signer.bind(CLIENT_NONCE)
+
+
+class TestProtocol(unittest.TestCase):
+
+    def setUp(self):
+        self.client, self.server = socket.socketpair()
+
+    def tearDown(self):
+        self.client.close()
+        self.server.close()
+
+    def test_frame_keeps_request_context(self):
+        write_frame(self.client, Frame(MSG_ECHO, b'ping', request_id=42, trace_parent='00-trace'))
+        frame = read_frame(self.server)
+        self.assertEqual(MSG_ECHO, frame.msg_type)
+        self.assertEqual(b'ping', frame.payload)
+        self.assertEqual(42, frame.request_id)
+        self.assertEqual('00-trace', frame.trace_parent)
+        self.assertTrue(frame.flags & FLAG_CONTEXT)
+
+    def test_read_frame_returns_none_on_eof(self):
+        self.client.close()
+        self.assertIsNone(read_frame(self.server))
+
+    def test_read_frame_rejects_invalid_length(self):
+        self.client.sendall((MAX_FRAME_SIZE).to_bytes(FRAME_LENGTH_SIZE, byteorder='big'))
+        with self.assertRaises(ProtocolError):
+            read_frame(self.server)
+
+    def test_decode_batch_with_text_codec(self):
+        payload = (7).to_bytes(4, byteorder='big') + (1).to_bytes(2, byteorder='big') + \
+            b'1,Ana,Di Lorenzo,24543210,1970-01-30,15\n'
+        batch_id, bets = decode_batch(payload, CODEC_TEXT)
+        self.assertEqual(7, batch_id)
+        self.assertEqual(1, bets[0].agency)
+        self.assertEqual('24543210', bets[0].document)
+        self.assertEqual(15, bets[0].number)
+
+    def test_decode_batch_with_binary_codec(self):
+        bet = (1).to_bytes(2, byteorder='big') + (24543210).to_bytes(4, byteorder='big') + \
+            (15).to_bytes(2, byteorder='big') + (29).to_bytes(4, byteorder='big') + b'\x03Ana\x0aDi Lorenzo'
+        batch_id, bets = decode_batch((7).to_bytes(4, byteorder='big') + (1).to_bytes(2, byteorder='big') + bet, CODEC_BINARY)
+        self.assertEqual(7, batch_id)
+        self.assertEqual('Di Lorenzo', bets[0].last_name)
+        self.assertEqual(datetime.date(1970, 1, 30), bets[0].birthdate)
+
+    def test_decode_batch_rejects_missing_bets(self):
+        payload = (7).to_bytes(4, byteorder='big') + (2).to_bytes(2, byteorder='big') + \
+            b'1,Ana,Di Lorenzo,24543210,1970-01-30,15\n'
+        with self.assertRaises(ProtocolError):
+            decode_batch(payload, CODEC_TEXT)
+
+    def test_signer_accepts_client_frames_in_sequence(self):
+        signer = Signer({'1': b'secret'})
+        handshake(signer)
+        for seq in (2, 3, 5):
+            frame = signer.open(client_seal(b'secret', '1', seq, Frame(MSG_ECHO, b'ping', request_id=seq), signer.nonce))
+            self.assertEqual(b'ping', frame.payload)
+            self.assertFalse(frame.flags & FLAG_SIGNED)
+        self.assertEqual('1', signer.agency)
+
+    def test_signer_rejects_replayed_and_unsigned_frames(self):
+        signer = Signer({'1': b'secret'})
+        handshake(signer)
+        signer.open(client_seal(b'secret', '1', 2, Frame(MSG_ECHO, b'ping'), signer.nonce))
+        with self.assertRaises(ProtocolError):
+            signer.open(client_seal(b'secret', '1', 2, Frame(MSG_ECHO, b'ping'), signer.nonce))
+        with self.assertRaises(ProtocolError):
+            signer.open(Frame(MSG_ECHO, b'ping'))
+
+    def test_signer_rejects_frames_of_other_agencies(self):
+        signer = Signer({'1': b'secret', '2': b'other'})
+        handshake(signer)
+        with self.assertRaises(ProtocolError):
+            signer.open(client_seal(b'other', '2', 2, Frame(MSG_ECHO, b'ping'), signer.nonce))
+        with self.assertRaises(ProtocolError):
+            handshake(Signer({'1': b'secret'}), secret=b'wrong')
+
+    def test_signer_rejects_changed_flags(self):
+        signer = Signer({'1': b'secret'})
+        handshake(signer)
+        frame = client_seal(b'secret', '1', 2, Frame(MSG_ECHO, b'ping'), signer.nonce)
+        frame.flags |= FLAG_COMPRESSED
+        with self.assertRaises(ProtocolError):
+            signer.open(frame)
+
+    def test_signer_rejects_reflected_replies(self):
+        signer = Signer({'1': b'secret'})
+        handshake(signer)
+        reply = signer.seal(Frame(MSG_ECHO, b'pong'))
+        with self.assertRaises(ProtocolError):
+            signer.open(reply)
+
+    def test_signer_rejects_changed_context(self):
+        signer = Signer({'1': b'secret'})
+        handshake(signer)
+        frame = client_seal(b'secret', '1', 2, Frame(MSG_ECHO, b'ping', request_id=7, trace_parent='00-a'), signer.nonce)
+        frame.request_id = 8
+        with self.assertRaises(ProtocolError):
+            signer.open(frame)
+
+    def test_signer_requires_hello_first(self):
+        # Frames before the hello could only be verified without the nonce
+        # of the server, so they could be replayed from another connection
+        with self.assertRaises(ProtocolError):
+            Signer({'1': b'secret'}).open(client_seal(b'secret', '1', 1, Frame(MSG_BATCH, b'')))
+
+    def test_signer_rejects_frames_of_another_connection(self):
+        first = Signer({'1': b'secret'})
+        handshake(first)
+        batch = client_seal(b'secret', '1', 2, Frame(MSG_BATCH, b'batch'), first.nonce)
+        second = Signer({'1': b'secret'})
+        handshake(second)
+        with self.assertRaises(ProtocolError):
+            second.open(batch)
+
+    def test_signer_seals_replies_with_client_nonce(self):
+        signer = Signer({'1': b'secret'})
+        handshake(signer)
+        reply = signer.seal(Frame(MSG_ACK, encode_ack(1)))
+        agency_len = reply.payload[0]
+        payload = reply.payload[1 + agency_len + 8:-MAC_SIZE]
+        expected = compute_mac(b'secret', DIRECTION_TO_CLIENT, reply, CLIENT_NONCE, b'1', 1, payload)
+        self.assertEqual(expected, reply.payload[-MAC_SIZE:])
+
+    def test_negotiate_compression(self):
+        self.assertEqual(COMPRESSION_FLATE, negotiate_compression('zstd,flate,gzip'))
+        self.assertIsNone(negotiate_compression('zstd'))
+        self.assertIsNone(negotiate_compression(''))
+
+    def test_decompress(self):
+        self.assertEqual(b'bets', decompress(COMPRESSION_GZIP, gzip.compress(b'bets')))
+        deflate = zlib.compressobj(wbits=-zlib.MAX_WBITS)
+        self.assertEqual(b'bets', decompress(COMPRESSION_FLATE, deflate.compress(b'bets') + deflate.flush()))
+
+    def test_decompress_rejects_malformed_and_large_payloads(self):
+        with self.assertRaises(ProtocolError):
+            decompress(COMPRESSION_GZIP, b'bets')
+        with self.assertRaises(ProtocolError):
+            decompress(COMPRESSION_GZIP, gzip.compress(bytes(MAX_DECOMPRESSED_SIZE + 1)))
+        with self.assertRaises(ProtocolError):
+            decompress(COMPRESSION_GZIP, gzip.compress(b'bets')[:-4])
+
+    def test_certificate_agency(self):
+        self.assertEqual('3', certificate_agency({'subject': ((('commonName', 'agency-3'),),)}))
+        self.assertIsNone(certificate_agency({}))
+        with self.assertRaises(ValueError):
+            certificate_agency({'subject': ((('commonName', 'server'),),)})
+
+
+if __name__ == '__main__':
+    unittest.main()